@@ -4,6 +4,7 @@ package cache
 import (
 	"fmt"
 	// "sync"
+	"sync/atomic"
 
 	lru "github.com/hashicorp/golang-lru"
 
@@ -27,6 +28,14 @@ type Manager struct {
 	access   uint64
 }
 
+// Stat reports usage of a cache.
+type Stat struct {
+	Slots  uint64 `json:"slots"`  // number of cache slots
+	Used   uint64 `json:"used"`   // occupied cache slots
+	Hits   uint64 `json:"hits"`   // lookups which found the item
+	Misses uint64 `json:"misses"` // lookups which did not
+}
+
 const logCache = false
 
 // NewCacheManager creates a new CacheManager, reports ErrConfigCache
@@ -79,15 +88,41 @@ func (cm *Manager) Contains(key interface{}) bool {
 		fmt.Printf("Check if <%v> contains.\n", key)
 	}
 
-	cm.access++
+	atomic.AddUint64(&cm.access, 1)
 	if cm.Cache.Contains(key) {
-		cm.hit++
+		atomic.AddUint64(&cm.hit, 1)
 		return true
 	}
 
 	return false
 }
 
+// Get wraps the LRU cache Get() which looks up a cache item, the lookup is
+// counted in hit/miss statistics.
+func (cm *Manager) Get(key interface{}) (interface{}, bool) {
+	if logCache {
+		fmt.Printf("Cache Get <%v>\n", key)
+	}
+
+	atomic.AddUint64(&cm.access, 1)
+	value, ok := cm.Cache.Get(key)
+	if ok {
+		atomic.AddUint64(&cm.hit, 1)
+	}
+	return value, ok
+}
+
+// Stat reports the usage and hit/miss statistics of the cache.
+func (cm *Manager) Stat() Stat {
+	hit, access := atomic.LoadUint64(&cm.hit), atomic.LoadUint64(&cm.access)
+	return Stat{
+		Slots:  cm.caps,
+		Used:   uint64(cm.Len()),
+		Hits:   hit,
+		Misses: access - hit,
+	}
+}
+
 func (cm *Manager) String() string {
 	return fmt.Sprintf("Cache slot number: %d\n"+
 		"Occupied cache slot: %d\n"+
@@ -44,3 +44,21 @@ func TestCacheManager(t *testing.T) {
 
 	cm.Purge()
 }
+
+func TestCacheManagerStat(t *testing.T) {
+	cm, err := NewCacheManager(32, 64, func(key, value interface{}) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cm.Add(1, 1)
+	cm.Get(1)
+	cm.Get(2)
+	cm.Add(2, 2)
+	cm.Add(3, 3) // evicts 1
+
+	stat := cm.Stat()
+	if stat.Slots != 2 || stat.Used != 2 || stat.Hits != 1 || stat.Misses != 1 {
+		t.Fatalf("unexpected stat %+v", stat)
+	}
+}
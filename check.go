@@ -0,0 +1,277 @@
+package ytfs
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	ydcommon "github.com/yottachain/YTFS/common"
+	"github.com/yottachain/YTFS/opt"
+	"github.com/yottachain/YTFS/storage"
+)
+
+// kinds of CheckProblem found by Check, besides the ones of tables.
+const (
+	// ProblemConfig is config.json in home which does not match config.
+	ProblemConfig = "config"
+	// ProblemIndex is index.db which can not be opened, or whose header does
+	// not match config.
+	ProblemIndex = "index"
+	// ProblemStorage is a storage which can not be opened, or whose header
+	// does not match config.
+	ProblemStorage = "storage"
+	// ProblemJournal is a journal which is not replayed yet, it is replayed
+	// when the YTFS is opened for write.
+	ProblemJournal = "journal"
+	// ProblemRecycled is a slot of recycle list which is beyond data end
+	// point, recycled twice, or used by a value.
+	ProblemRecycled = "recycled"
+	// ProblemDataEnd is data end point which does not match slots taken by
+	// values and recycle list.
+	ProblemDataEnd = "dataEnd"
+)
+
+// CheckReport is the result of Check, it serializes to JSON.
+type CheckReport struct {
+	Dir          string                 `json:"dir"`
+	Repair       bool                   `json:"repair"`
+	Tables       uint32                 `json:"tables"`
+	Entries      uint64                 `json:"entries"`
+	DataEndPoint uint64                 `json:"dataEndPoint"`
+	UsedSlots    uint64                 `json:"usedSlots"`
+	Recycled     uint64                 `json:"recycled"`
+	Problems     []storage.CheckProblem `json:"problems"`
+}
+
+// OK reports whether the YTFS is safe to open, i.e. no problem is found or
+// all of them are fixed.
+func (report *CheckReport) OK() bool {
+	for _, problem := range report.Problems {
+		if !problem.Fixed {
+			return false
+		}
+	}
+	return true
+}
+
+func (report *CheckReport) add(kind string, fixed bool, format string, args ...interface{}) {
+	report.Problems = append(report.Problems, storage.CheckProblem{
+		Kind:   kind,
+		Detail: fmt.Sprintf(format, args...),
+		Fixed:  fixed,
+	})
+}
+
+// Check verifies the YTFS in dir against config, it checks headers of index
+// and storages, then every entry of the index and the recycle list. Without
+// repair it takes no lock, so a running node can be checked, though entries
+// written during the check may be reported. Repair needs the YTFS closed.
+//
+// Without repair nothing is written, the journal is replayed in memory. With
+// repair the journal is replayed, then table sizes, invalid rows and the
+// recycle list are fixed. Headers and data end point are not fixed, nor are
+// slots which are neither used nor recycled, RebuildIndex reclaims them.
+// An index whose header can not be read is reported and never formatted.
+// Storages are never written. Index in memory is not checked, it returns
+// ErrIndexInMemory.
+func Check(dir string, config *opt.Options, repair bool) (*CheckReport, error) {
+	if config.IndexInMemory() {
+		return nil, ErrIndexInMemory
+	}
+
+	settings := *config
+	settings.Storages = append([]opt.StorageOptions{}, config.Storages...)
+	settings.ReadOnly = !repair
+	_, err := opt.FinalizeConfig(&settings)
+	if err != nil {
+		return nil, err
+	}
+	for i := range settings.Storages {
+		settings.Storages[i].ReadOnly = true
+	}
+	if _, err = os.Stat(dir); err != nil {
+		return nil, err
+	}
+
+	lock, err := lockYTFSDir(dir, !repair)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	report := &CheckReport{Dir: dir, Repair: repair, Problems: []storage.CheckProblem{}}
+	err = openYTFSDir(dir, &settings)
+	if err == ErrEmptyYTFSDir {
+		return nil, err
+	}
+	if err != nil {
+		report.add(ProblemConfig, false, "config.json: %v", err)
+	}
+
+	indexPath := path.Join(dir, "index.db")
+	if _, err = os.Stat(indexPath); err != nil {
+		report.add(ProblemIndex, false, "%v, RebuildIndex regenerates it", err)
+		return report, nil
+	}
+	if fi, err := os.Stat(indexPath + ".journal"); !repair && err == nil && fi.Size() > 0 {
+		report.add(ProblemJournal, false, "journal of %d bytes is not replayed to index.db, tables are checked with it replayed in memory", fi.Size())
+	}
+
+	// repair never formats an index whose header is lost, it would drop
+	// every row as being in the wrong range.
+	indexFile, err := storage.OpenExistingYTFSIndexFile(indexPath, &settings)
+	if err != nil {
+		report.add(ProblemIndex, false, "%v", err)
+		return report, nil
+	}
+	defer indexFile.Close()
+	checkIndexHeader(report, indexFile.MetaData(), &settings)
+
+	for i := range settings.Storages {
+		disk, err := storage.OpenYottaDisk(&settings.Storages[i])
+		if err != nil {
+			report.add(ProblemStorage, false, "%s: %v", settings.Storages[i].StorageName, err)
+			continue
+		}
+		disk.Close()
+	}
+	if !report.OK() {
+		// entries can not be checked without all storages.
+		return report, nil
+	}
+
+	dataEnd := indexFile.MetaData().DataEndPoint
+	context, err := NewContext(dir, &settings, dataEnd)
+	if err != nil {
+		return nil, err
+	}
+	defer context.Close()
+
+	err = checkEntries(report, indexFile, context, dataEnd, repair)
+	if err != nil {
+		return nil, err
+	}
+
+	if repair && len(report.Problems) != 0 {
+		// key filter is built again from the index when it is opened.
+		err = os.Remove(indexPath + ".filter")
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+func checkIndexHeader(report *CheckReport, meta *ydcommon.Header, config *opt.Options) {
+	sumT := uint64(0)
+	for _, storageOpt := range config.Storages {
+		sumT += storageOpt.StorageVolume
+	}
+
+	if meta.Tag != [4]byte{'Y', 'T', 'F', 'S'} {
+		report.add(ProblemIndex, false, "tag is %q", meta.Tag[:])
+	}
+	if meta.YtfsCapability != config.TotalVolumn {
+		report.add(ProblemIndex, false, "C is %d, config has %d", meta.YtfsCapability, config.TotalVolumn)
+	}
+	if meta.DataBlockSize != config.DataBlockSize {
+		report.add(ProblemIndex, false, "D is %d, config has %d", meta.DataBlockSize, config.DataBlockSize)
+	}
+	if meta.RangeCapacity != config.IndexTableRows {
+		report.add(ProblemIndex, false, "N is %d, config has %d", meta.RangeCapacity, config.IndexTableRows)
+	}
+	if meta.RangeCoverage != config.IndexTableCols {
+		report.add(ProblemIndex, false, "M is %d, config has %d", meta.RangeCoverage, config.IndexTableCols)
+	}
+	if meta.YtfsSize > sumT {
+		// storages are only added.
+		report.add(ProblemIndex, false, "size is %d, storages of config have %d", meta.YtfsSize, sumT)
+	}
+}
+
+// checkEntries checks every entry of index against storages, then checks the
+// recycle list and data end point against entries.
+func checkEntries(report *CheckReport, indexFile *storage.YTFSIndexFile, c *Context, dataEnd uint64, repair bool) error {
+	report.DataEndPoint = dataEnd
+	capacity := uint64(0)
+	for _, s := range c.storages {
+		capacity += s.Cap
+	}
+	if dataEnd > capacity {
+		report.add(ProblemDataEnd, false, "data end point %d is beyond %d slots of storages", dataEnd, capacity)
+	}
+
+	recycled, err := indexFile.RecycledSlots()
+	if err != nil {
+		return err
+	}
+	recycledSet := map[ydcommon.IndexTableValue]bool{}
+	for _, slot := range recycled {
+		recycledSet[slot] = true
+	}
+
+	// slots of recycle list which are taken by values.
+	taken := map[ydcommon.IndexTableValue]bool{}
+	check := func(item ydcommon.IndexItem) string {
+		value := uint64(item.OffsetIdx)
+		if value >= dataEnd {
+			return fmt.Sprintf("value %d is beyond data end point %d", value, dataEnd)
+		}
+		if _, err := c.locate(value); err != nil {
+			return fmt.Sprintf("value %d is on no storage", value)
+		}
+		blocks, err := c.ValueBlocks(item.OffsetIdx)
+		if err != nil {
+			return fmt.Sprintf("value %d: %v", value, err)
+		}
+		if value+uint64(blocks) > dataEnd {
+			return fmt.Sprintf("value %d of %d blocks is beyond data end point %d", value, blocks, dataEnd)
+		}
+
+		for i := uint32(0); i < blocks; i++ {
+			if slot := item.OffsetIdx + ydcommon.IndexTableValue(i); recycledSet[slot] {
+				taken[slot] = true
+			}
+		}
+		report.UsedSlots += uint64(blocks)
+		return ""
+	}
+
+	tables, err := indexFile.CheckTables(check, repair)
+	if err != nil {
+		return err
+	}
+	report.Tables, report.Entries = tables.Tables, tables.Entries
+	report.Problems = append(report.Problems, tables.Problems...)
+
+	valid := []ydcommon.IndexTableValue{}
+	seen := map[ydcommon.IndexTableValue]bool{}
+	for _, slot := range recycled {
+		switch {
+		case uint64(slot) >= dataEnd:
+			report.add(ProblemRecycled, repair, "slot %d is beyond data end point %d", slot, dataEnd)
+		case seen[slot]:
+			report.add(ProblemRecycled, repair, "slot %d is recycled again", slot)
+		case taken[slot]:
+			report.add(ProblemRecycled, repair, "slot %d is used by a value", slot)
+		default:
+			seen[slot] = true
+			valid = append(valid, slot)
+		}
+	}
+	if repair && len(valid) != len(recycled) {
+		err = indexFile.ReplaceRecycled(valid)
+		if err != nil {
+			return err
+		}
+	}
+	report.Recycled = uint64(len(valid))
+
+	slots := report.UsedSlots + report.Recycled
+	if slots < dataEnd {
+		report.add(ProblemDataEnd, false, "%d slots below data end point %d are neither used nor recycled, RebuildIndex reclaims them", dataEnd-slots, dataEnd)
+	} else if slots > dataEnd {
+		report.add(ProblemDataEnd, false, "values and recycle list take %d slots, more than data end point %d, values overlap", slots, dataEnd)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+// Command ytfs runs maintenance tasks on a YTFS home directory.
+//
+// Usage:
+//
+//	ytfs rebuild -home <dir> -config <config.json>
+//	ytfs check -home <dir> -config <config.json> [-repair]
+//
+// rebuild regenerates index.db from the keys saved with data blocks, when
+// index.db is lost or corrupted. check verifies index.db and the storages
+// against config, prints the report as JSON, and exits with 1 if problems are
+// left unfixed. With -repair, table sizes, invalid rows and the recycle list
+// are fixed. The YTFS must not be opened by others.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+
+	ytfs "github.com/yottachain/YTFS"
+	"github.com/yottachain/YTFS/opt"
+)
+
+type command struct {
+	usage string
+	// flags defines flags of the command besides -home and -config, it is nil
+	// if there is none.
+	flags func(flags *flag.FlagSet)
+	run   func(home string, config *opt.Options, args []string) error
+}
+
+var repair bool
+
+var commands = map[string]command{
+	"rebuild": {
+		usage: "regenerate index.db from data blocks of the storages",
+		run: func(home string, config *opt.Options, args []string) error {
+			return ytfs.RebuildIndex(home, config)
+		},
+	},
+	"check": {
+		usage: "verify index.db and the storages, -repair fixes the index",
+		flags: func(flags *flag.FlagSet) {
+			flags.BoolVar(&repair, "repair", false, "fix table sizes, invalid rows and the recycle list")
+		},
+		run: func(home string, config *opt.Options, args []string) error {
+			report, err := ytfs.Check(home, config, repair)
+			if err != nil {
+				return err
+			}
+			out, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(out))
+			if !report.OK() {
+				return fmt.Errorf("%d problems found", len(report.Problems))
+			}
+			return nil
+		},
+	},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: ytfs <command> -home <dir> [-config <config.json>]")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for name, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, cmd.usage)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	home := flags.String("home", "", "root directory of YTFS")
+	configName := flags.String("config", "", "config json file name, default is config.json in home")
+	if cmd.flags != nil {
+		cmd.flags(flags)
+	}
+	flags.Parse(os.Args[2:])
+	if *home == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *configName == "" {
+		*configName = path.Join(*home, "config.json")
+	}
+
+	config, err := opt.ParseConfig(*configName)
+	if err == nil {
+		err = cmd.run(*home, config, flags.Args())
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ytfs "+os.Args[1]+":", err)
+		os.Exit(1)
+	}
+}
@@ -13,7 +13,9 @@ type Header struct {
 	HashOffset     uint32  `json:"hashOffset"`
 	DataEndPoint   uint64  `json:"dataEndPoint"` // if no del, it is the data count, if have del, it tells the sp of context.
 	RecycleOffset  uint64  `json:"RecycleOffset"`
-	Reserved       uint64  `json:"reserved"`
+	OverflowPages  uint32  `json:"overflowPages"` // pages allocated for overflow chain.
+	Reserved       uint32  `json:"reserved"`
+	HashSeed       uint64  `json:"hashSeed"` // seed of table hashing, since index 0.06.
 }
 
 // StorageHeader header of storage
@@ -23,6 +25,9 @@ type StorageHeader struct {
 	DiskCapacity  uint64  `json:"diskCapacity"`
 	DataBlockSize uint32  `json:"dataBlkSize"`
 	DataOffset    uint32  `json:"dataOffset"`
-	DataCapacity  uint32  `json:"DataCapacity"`
-	Reserved      uint32  `json:"reserved"`
+	DataCapacity  uint64  `json:"DataCapacity"` // data blocks, 32-bit before version 0.4.
+	MetaOffset    uint64  `json:"metaOffset"`   // where block meta area begins, since version 0.2.
+	MetaSize      uint32  `json:"metaSize"`     // size of each block meta record.
+	ChecksumType  uint32  `json:"checksumType"` // ChecksumType of blocks.
+	Seq           uint64  `json:"seq"`          // seq of writes saved with block keys is not beyond it, since version 0.4.
 }
@@ -22,7 +22,9 @@ func TestHeaderPrint(t *testing.T) {
 		HashOffset     %03d           %d
 		DataCount      %03d           %d
 		RecycleOffset  %03d           %d
+		OverflowPages  %03d           %d
 		Reserved       %03d           %d
+		HashSeed       %03d           %d
 		`
 
 	fmt.Printf(infoMsg,
@@ -36,5 +38,7 @@ func TestHeaderPrint(t *testing.T) {
 		unsafe.Offsetof(header.HashOffset), unsafe.Sizeof(header.HashOffset),
 		unsafe.Offsetof(header.DataEndPoint), unsafe.Sizeof(header.DataEndPoint),
 		unsafe.Offsetof(header.RecycleOffset), unsafe.Sizeof(header.RecycleOffset),
-		unsafe.Offsetof(header.Reserved), unsafe.Sizeof(header.Reserved))
+		unsafe.Offsetof(header.OverflowPages), unsafe.Sizeof(header.OverflowPages),
+		unsafe.Offsetof(header.Reserved), unsafe.Sizeof(header.Reserved),
+		unsafe.Offsetof(header.HashSeed), unsafe.Sizeof(header.HashSeed))
 }
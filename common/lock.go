@@ -0,0 +1,45 @@
+package common
+
+import (
+	"context"
+)
+
+// LockContext calls lock and waits until it returns or ctx is done, it
+// returns ctx.Err() in the latter case. A ctx which can never be done, like
+// context.Background(), locks directly. Otherwise lock runs in a goroutine,
+// which lives until lock returns, and the lock acquired after giving up is
+// released by unlock, so the lock is never leaked.
+//
+// Usage Sample:
+//		err := LockContext(ctx, mutex.Lock, mutex.Unlock)
+//		if err != nil {
+//			return err
+//		}
+//		defer mutex.Unlock()
+func LockContext(ctx context.Context, lock func(), unlock func()) error {
+	done := ctx.Done()
+	if done == nil {
+		lock()
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		lock()
+		select {
+		case locked <- struct{}{}:
+		case <-done:
+			unlock()
+		}
+	}()
+
+	select {
+	case <-locked:
+		return nil
+	case <-done:
+		return ctx.Err()
+	}
+}
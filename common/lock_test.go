@@ -0,0 +1,43 @@
+package common
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLockContextBackground(t *testing.T) {
+	var mutex sync.Mutex
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		if err := LockContext(context.Background(), mutex.Lock, mutex.Unlock); err != nil {
+			t.Fatal(err)
+		}
+		if runtime.NumGoroutine() > before {
+			t.Fatalf("goroutine started for a background ctx")
+		}
+		mutex.Unlock()
+	}
+}
+
+func TestLockContextCancel(t *testing.T) {
+	var mutex sync.Mutex
+	mutex.Lock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := LockContext(ctx, mutex.Lock, mutex.Unlock); err != context.DeadlineExceeded {
+		t.Fatalf("LockContext() = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// the lock acquired by the cancelled waiter must be released.
+	mutex.Unlock()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := LockContext(ctx, mutex.Lock, mutex.Unlock); err != nil {
+		t.Fatal(err)
+	}
+	mutex.Unlock()
+}
@@ -17,6 +17,20 @@ const (
 	BlockStorageType
 	// DummyStorageType Dummy storage type
 	DummyStorageType
+	// MmapStorageType Memory-mapped file or disk storage type
+	MmapStorageType
+)
+
+// ChecksumType represent the checksum algorithm of data blocks.
+type ChecksumType uint32
+
+const (
+	// CRC32CChecksumType CRC-32 with Castagnoli polynomial
+	CRC32CChecksumType ChecksumType = iota
+	// XXHash64ChecksumType 64-bit xxHash
+	XXHash64ChecksumType
+	// NoChecksumType blocks are not checked
+	NoChecksumType
 )
 
 const (
@@ -42,7 +56,7 @@ func (h *Hash) SetBytes(b []byte) {
 func HexToHash(s string) Hash { return BytesToHash(FromHex(s)) }
 
 type IndexTableKey Hash
-type IndexTableValue uint32
+type IndexTableValue uint64
 type IndexTable map[IndexTableKey]IndexTableValue
 type IndexItem struct {
 	Hash      IndexTableKey
@@ -1,8 +1,8 @@
 package ytfs
 
 import (
+	"context"
 	"fmt"
-	"math"
 	"sync"
 
 	ydcommon "github.com/yottachain/YTFS/common"
@@ -19,17 +19,23 @@ type storageContext struct {
 	// storage name
 	Name string
 	// full capability of data block
-	Cap uint32
+	Cap uint64
 	// used data block slot number
-	Len uint32
+	Len uint64
 	// Storage
 	Disk *storage.YottaDisk
 }
 
 type storagePointer struct {
-	dev    uint8  // device id, from 0~255
-	posIdx uint32 // device inside offset id.
-	index  uint32 // global id of data. if one device can hold 1 data, then 0 == [0, 0], 1 == [1, 0], 2 == [2, 0]
+	dev    uint32 // device id.
+	posIdx uint64 // device inside offset id.
+	index  uint64 // global id of data. if one device can hold 1 data, then 0 == [0, 0], 1 == [1, 0], 2 == [2, 0]
+}
+
+// slotRecycler keeps data slots released by delete, so they can be reused.
+type slotRecycler interface {
+	popRecycled() (ydcommon.IndexTableValue, bool, error)
+	pushRecycled(value ydcommon.IndexTableValue) error
 }
 
 // Context - the running YTFS context
@@ -37,6 +43,11 @@ type Context struct {
 	config   *opt.Options
 	sp       *storagePointer
 	storages []*storageContext
+	recycler slotRecycler
+	// seq of the last write, saved with keys of data blocks
+	seq uint64
+	// seq saved to headers of storages, seq of writes is not beyond it
+	seqLimit uint64
 	// cm     		*cache.Manager
 	lock sync.RWMutex
 }
@@ -48,10 +59,6 @@ func NewContext(dir string, config *opt.Options, dataCount uint64) (*Context, er
 		return nil, err
 	}
 
-	if dataCount > math.MaxUint32 {
-		return nil, errors.ErrContextOverflow
-	}
-
 	context := &Context{
 		config:   config,
 		sp:       nil,
@@ -59,7 +66,15 @@ func NewContext(dir string, config *opt.Options, dataCount uint64) (*Context, er
 		lock:     sync.RWMutex{},
 	}
 
-	context.SetStoragePointer(uint32(dataCount))
+	err = context.loadSeq()
+	if err != nil {
+		for _, s := range storages {
+			s.Disk.Close()
+		}
+		return nil, err
+	}
+
+	context.SetStoragePointer(dataCount)
 	fmt.Println("Create YTFS content success, current sp = ", context.sp)
 	return context, nil
 }
@@ -70,6 +85,9 @@ func initStorages(config *opt.Options) ([]*storageContext, error) {
 		disk, err := storage.OpenYottaDisk(&storageOpt)
 		if err != nil {
 			// TODO: handle error if necessary, like keep using successed storages.
+			for _, opened := range contexts {
+				opened.Disk.Close()
+			}
 			return nil, err
 		}
 		contexts = append(contexts, &storageContext{
@@ -84,7 +102,7 @@ func initStorages(config *opt.Options) ([]*storageContext, error) {
 }
 
 // SetStoragePointer set the storage pointer position of current storage context
-func (c *Context) SetStoragePointer(globalID uint32) error {
+func (c *Context) SetStoragePointer(globalID uint64) error {
 	sp, err := c.locate(globalID)
 	if sp != nil {
 		c.sp = sp
@@ -93,17 +111,16 @@ func (c *Context) SetStoragePointer(globalID uint32) error {
 }
 
 // Locate find the correct offset in correct device
-func (c *Context) locate(idx uint32) (*storagePointer, error) {
+func (c *Context) locate(idx uint64) (*storagePointer, error) {
 	// TODO: binary search
-	var dev, posIdx uint32 = 0, 0
-	var devBegin, devEnd uint32 = 0, 0
+	var dev uint32
+	var devBegin, devEnd uint64 = 0, 0
 	for _, s := range c.storages {
 		devEnd += s.Cap
 		if devBegin <= idx && idx < devEnd {
-			posIdx = idx - devBegin
 			return &storagePointer{
-				uint8(dev),
-				posIdx,
+				dev,
+				idx - devBegin,
 				idx,
 			}, nil
 		}
@@ -112,7 +129,7 @@ func (c *Context) locate(idx uint32) (*storagePointer, error) {
 	}
 
 	return &storagePointer{
-		uint8(len(c.storages)),
+		uint32(len(c.storages)),
 		0,
 		0,
 	}, errors.ErrContextIDMapping
@@ -141,22 +158,22 @@ func (c *Context) fastforward(n int, commit bool) error {
 	var err error
 	i := 0
 	for i = 0; i < n && err == nil; i++ {
-			err = c.forward()
+		err = c.forward()
 	}
 	if !commit {
-			*c.sp = sp
+		*c.sp = sp
 	}
 
 	if i < n && err != nil {
-			// last i reach the eof is ok.
-			return err
+		// last i reach the eof is ok.
+		return err
 	}
 
 	return nil
 }
 
 func (c *Context) save() *storagePointer {
-	saveSP := *c.sp;
+	saveSP := *c.sp
 	return &saveSP
 }
 
@@ -166,20 +183,44 @@ func (c *Context) restore(sp *storagePointer) {
 
 func (c *Context) eof() bool {
 	sp := c.sp
-	return sp.dev >= uint8(len(c.storages)) || (sp.dev == uint8(len(c.storages)-1) && sp.posIdx == c.storages[sp.dev].Cap)
+	return sp.dev >= uint32(len(c.storages)) || (sp.dev == uint32(len(c.storages)-1) && sp.posIdx == c.storages[sp.dev].Cap)
 }
 
 func (c *Context) setEOF() {
 	sp := c.sp
-	sp.dev = uint8(len(c.storages) - 1)
+	sp.dev = uint32(len(c.storages) - 1)
 	sp.posIdx = c.storages[sp.dev].Cap
 }
 
-// Get gets the value from offset of the correct device
+// Get gets the value from offset of the correct device, value of multiple
+// blocks is read from all its blocks.
 func (c *Context) Get(globalIdx ydcommon.IndexTableValue) (value []byte, err error) {
-	c.lock.RLock()
+	return c.GetContext(context.Background(), globalIdx)
+}
+
+// GetContext gets the value from offset of the correct device, it gives up
+// if ctx is done before the device is available.
+func (c *Context) GetContext(ctx context.Context, globalIdx ydcommon.IndexTableValue) (value []byte, err error) {
+	return c.get(ctx, nil, globalIdx)
+}
+
+// GetKeyContext is GetContext of the value of key. It returns
+// ErrDataNotFound if the value is not of key, e.g. it is deleted and its
+// slot is reused after key is looked up in the index. Storages which do not
+// save keys are not checked.
+func (c *Context) GetKeyContext(ctx context.Context, key ydcommon.IndexTableKey, globalIdx ydcommon.IndexTableValue) (value []byte, err error) {
+	return c.get(ctx, &key, globalIdx)
+}
+
+func (c *Context) get(ctx context.Context, key *ydcommon.IndexTableKey, globalIdx ydcommon.IndexTableValue) (value []byte, err error) {
+	// writes take the lock exclusively, the key and data read are of the
+	// same value.
+	err = ydcommon.LockContext(ctx, c.lock.RLock, c.lock.RUnlock)
+	if err != nil {
+		return nil, err
+	}
 	defer c.lock.RUnlock()
-	sp, err := c.locate(uint32(globalIdx))
+	sp, err := c.locate(uint64(globalIdx))
 	if err != nil {
 		return nil, err
 	}
@@ -188,14 +229,115 @@ func (c *Context) Get(globalIdx ydcommon.IndexTableValue) (value []byte, err err
 		fmt.Printf("get data globalId %d @%v\n", globalIdx, sp)
 	}
 
-	return c.storages[sp.dev].Disk.ReadData(ydcommon.IndexTableValue(sp.posIdx))
+	blocks, blockKey, hasKey, err := c.storages[sp.dev].Disk.ValueKeyContext(ctx, ydcommon.IndexTableValue(sp.posIdx))
+	if err != nil {
+		return nil, err
+	}
+	if key != nil && hasKey && (blockKey.Key != *key || blockKey.Seq == 0) {
+		return nil, errors.ErrDataNotFound
+	}
+
+	value, err = c.storages[sp.dev].Disk.ReadDataContext(ctx, ydcommon.IndexTableValue(sp.posIdx))
+	for i := uint32(1); i < blocks && err == nil; i++ {
+		if len(value) != int(i*c.config.DataBlockSize) {
+			// only the last block of a value can be partial.
+			return nil, errors.ErrDataCorrupted
+		}
+
+		sp, err = c.locate(uint64(globalIdx) + uint64(i))
+		if err != nil {
+			return nil, err
+		}
+		// block count has no checksum, blocks of other values are not taken.
+		var continues bool
+		continues, err = c.storages[sp.dev].Disk.ContinuesValueContext(ctx, ydcommon.IndexTableValue(sp.posIdx))
+		if err != nil {
+			return nil, err
+		}
+		if !continues {
+			return nil, errors.ErrDataCorrupted
+		}
+
+		var block []byte
+		block, err = c.storages[sp.dev].Disk.ReadDataContext(ctx, ydcommon.IndexTableValue(sp.posIdx))
+		value = append(value, block...)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// ValueBlocks reports the number of consecutive slots taken by the value
+// which begins from globalIdx. The count is saved without checksum, it
+// returns ErrDataCorrupted if the blocks it counts do not continue the
+// value, so that slots of other values are never taken as its.
+func (c *Context) ValueBlocks(globalIdx ydcommon.IndexTableValue) (uint32, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	sp, err := c.locate(uint64(globalIdx))
+	if err != nil {
+		return 0, err
+	}
+
+	blocks, err := c.storages[sp.dev].Disk.ValueBlocksContext(context.Background(), ydcommon.IndexTableValue(sp.posIdx))
+	for i := uint32(1); i < blocks && err == nil; i++ {
+		sp, err = c.locate(uint64(globalIdx) + uint64(i))
+		if err != nil {
+			return 0, errors.ErrDataCorrupted
+		}
+		var continues bool
+		continues, err = c.storages[sp.dev].Disk.ContinuesValueContext(context.Background(), ydcommon.IndexTableValue(sp.posIdx))
+		if err == nil && !continues {
+			err = errors.ErrDataCorrupted
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	return blocks, nil
+}
+
+// Put puts the vale to a recycled slot if there is any, otherwise to offset
+// that current sp points to of the corrent device. Value larger than one
+// block takes consecutive new slots as BatchPut does. key is saved with the
+// data, so that the index can be rebuilt from storages.
+func (c *Context) Put(key ydcommon.IndexTableKey, value []byte) (uint64, error) {
+	return c.PutContext(context.Background(), key, value)
 }
 
-// Put puts the vale to offset that current sp points to of the corrent device
-func (c *Context) Put(value []byte) (uint32, error) {
-	c.lock.Lock()
+// PutContext is Put which gives up if ctx is done before the data is written.
+func (c *Context) PutContext(ctx context.Context, key ydcommon.IndexTableKey, value []byte) (uint64, error) {
+	err := ydcommon.LockContext(ctx, c.lock.Lock, c.lock.Unlock)
+	if err != nil {
+		return 0, err
+	}
 	defer c.lock.Unlock()
-	index, err := c.putAt(value, c.sp)
+
+	if len(value) > int(c.config.DataBlockSize) {
+		indexes, err := c.batchPut(ctx, []ydcommon.IndexTableKey{key}, [][]byte{value})
+		if err != nil {
+			return 0, err
+		}
+		return indexes[0], nil
+	}
+
+	if c.recycler != nil {
+		slot, ok, err := c.recycler.popRecycled()
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return c.putRecycled(ctx, key, value, slot)
+		}
+	}
+
+	keys, err := c.blockKeys([]ydcommon.IndexTableKey{key}, []uint32{1})
+	if err != nil {
+		return 0, err
+	}
+	index, err := c.putAt(ctx, [][]byte{value}, []uint32{1}, keys, c.sp)
 	if err != nil {
 		return index, err
 	}
@@ -204,72 +346,237 @@ func (c *Context) Put(value []byte) (uint32, error) {
 }
 
 // PutAt puts the vale to specific offset of the corrent device
-func (c *Context) PutAt(value []byte, globalID uint32) (uint32, error) {
+func (c *Context) PutAt(key ydcommon.IndexTableKey, value []byte, globalID uint64) (uint64, error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	sp, err := c.locate(globalID)
 	if err != nil {
 		return 0, err
 	}
-	index, err := c.putAt(value, sp)
+	if len(value) > int(c.config.DataBlockSize) && !c.multiBlockValues() {
+		return 0, errors.ErrDataTooLarge
+	}
+	blocks, valueBlocks := storage.SplitValues([][]byte{value}, c.config.DataBlockSize)
+	keys, err := c.blockKeys([]ydcommon.IndexTableKey{key}, valueBlocks)
+	if err != nil {
+		return 0, err
+	}
+	index, err := c.putAt(context.Background(), blocks, valueBlocks, keys, sp)
 	if err != nil {
 		return index, err
 	}
 	return index, nil
 }
 
-// BatchPut puts the value array to offset that current sp points to of the corrent device
-func (c *Context) BatchPut(cnt int, valueArray []byte) (uint32, error) {
-	c.lock.Lock()
+// BatchPut puts the values to consecutive offsets begin from the one that
+// current sp points to of the corrent device, each value takes as many slots
+// as its blocks. It reports the offset of each value. keys[i] is the key of
+// values[i].
+func (c *Context) BatchPut(keys []ydcommon.IndexTableKey, values [][]byte) ([]uint64, error) {
+	return c.BatchPutContext(context.Background(), keys, values)
+}
+
+// BatchPutContext is BatchPut which gives up if ctx is done before all data
+// is written.
+func (c *Context) BatchPutContext(ctx context.Context, keys []ydcommon.IndexTableKey, values [][]byte) ([]uint64, error) {
+	err := ydcommon.LockContext(ctx, c.lock.Lock, c.lock.Unlock)
+	if err != nil {
+		return nil, err
+	}
 	defer c.lock.Unlock()
 
+	return c.batchPut(ctx, keys, values)
+}
+
+func (c *Context) batchPut(ctx context.Context, keys []ydcommon.IndexTableKey, values [][]byte) ([]uint64, error) {
+	for _, value := range values {
+		if len(value) > int(c.config.DataBlockSize) && !c.multiBlockValues() {
+			return nil, errors.ErrDataTooLarge
+		}
+	}
+
+	blocks, valueBlocks := storage.SplitValues(values, c.config.DataBlockSize)
+	blockKeys, err := c.blockKeys(keys, valueBlocks)
+	if err != nil {
+		return nil, err
+	}
+	cnt := len(blocks)
 	// TODO: Can we leave this check to disk??
 	if err := c.fastforward(cnt, false); err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	var err error
-	var index uint32
-	if (c.sp.posIdx + uint32(cnt) <= c.storages[c.sp.dev].Cap) {
-		index, err = c.putAt(valueArray, c.sp)
+	var index uint64
+	if c.sp.posIdx+uint64(cnt) <= c.storages[c.sp.dev].Cap {
+		index, err = c.putAt(ctx, blocks, valueBlocks, blockKeys, c.sp)
 	} else {
-		currentSP := *c.sp;
+		currentSP := *c.sp
 		step1 := c.storages[currentSP.dev].Cap - currentSP.posIdx
-		index, err = c.putAt(valueArray[:step1*c.config.DataBlockSize], &currentSP)
-		step2 := uint32(cnt) - step1
+		index, err = c.putAt(ctx, blocks[:step1], valueBlocks[:step1], blockKeys[:step1], &currentSP)
+		step2 := uint64(cnt) - step1
 		currentSP.dev++
 		currentSP.posIdx = 0
 		currentSP.index += step1
-		if (currentSP.posIdx + uint32(step2) > c.storages[currentSP.dev].Cap) {
-				return 0, errors.New("Batch across 3 storage devices, not supported")
+		if currentSP.posIdx+step2 > c.storages[currentSP.dev].Cap {
+			return nil, errors.New("Batch across 3 storage devices, not supported")
+		}
+		if err != nil {
+			return nil, err
 		}
-		_, err = c.putAt(valueArray[step1*c.config.DataBlockSize:], &currentSP)
+		_, err = c.putAt(ctx, blocks[step1:], valueBlocks[step1:], blockKeys[step1:], &currentSP)
 	}
 
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	c.fastforward(cnt, true)
-	return index, nil
+
+	indexes := make([]uint64, 0, len(values))
+	for i, n := range valueBlocks {
+		if n != 0 {
+			indexes = append(indexes, index+uint64(i))
+		}
+	}
+	return indexes, nil
 }
 
-func (c *Context) putAt(value []byte, sp *storagePointer) (uint32, error) {
+// multiBlockValues reports whether all storages save values larger than a
+// data block, storages of version 0.1 keep no block meta.
+func (c *Context) multiBlockValues() bool {
+	for _, s := range c.storages {
+		if !s.Disk.MultiBlockValues() {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Context) putRecycled(ctx context.Context, key ydcommon.IndexTableKey, value []byte, slot ydcommon.IndexTableValue) (uint64, error) {
+	sp, err := c.locate(uint64(slot))
+	var keys []storage.BlockKey
+	if err == nil {
+		keys, err = c.blockKeys([]ydcommon.IndexTableKey{key}, []uint32{1})
+	}
+	if err == nil {
+		_, err = c.writeAt(ctx, [][]byte{value}, []uint32{1}, keys, sp)
+	}
+
+	if err != nil {
+		// give the slot back, so it is not lost.
+		c.recycler.pushRecycled(slot)
+		return 0, err
+	}
+	return sp.index, nil
+}
+
+func (c *Context) putAt(ctx context.Context, blocks [][]byte, valueBlocks []uint32, keys []storage.BlockKey, sp *storagePointer) (uint64, error) {
 	if c.eof() {
 		return 0, errors.ErrDataOverflow
 	}
 
+	return c.writeAt(ctx, blocks, valueBlocks, keys, sp)
+}
+
+func (c *Context) writeAt(ctx context.Context, blocks [][]byte, valueBlocks []uint32, keys []storage.BlockKey, sp *storagePointer) (uint64, error) {
 	if debugPrint {
-		fmt.Printf("put data %x @ %v\n", value[:32], sp)
+		fmt.Printf("put %d data @ %v\n", len(blocks), sp)
 	}
 
 	dataPos := sp.posIdx
-	err := c.storages[sp.dev].Disk.WriteData(ydcommon.IndexTableValue(dataPos), value)
+	err := c.storages[sp.dev].Disk.WriteBlocksContext(ctx, ydcommon.IndexTableValue(dataPos), blocks, valueBlocks, keys)
 	if err != nil {
 		return sp.index, err
 	}
 	return sp.index, nil
 }
 
+// seqReserve is the number of seqs saved ahead to headers of storages, so
+// that seq of writes goes up across restarts without a header write each.
+const seqReserve = 1 << 16
+
+// loadSeq begins seq of writes after the seq saved to headers of storages.
+// Storages which save keys but not seq, created before it, are read for the
+// highest seq of their blocks, which is saved then.
+func (c *Context) loadSeq() error {
+	scanned := false
+	begin := uint64(0)
+	for _, s := range c.storages {
+		seq, ok := s.Disk.Seq()
+		if !ok && !c.config.ReadOnly {
+			err := s.scanBlockRecords(begin, func(index uint64, record storage.BlockRecord) error {
+				if record.Seq > seq {
+					seq = record.Seq
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			scanned = true
+		}
+		if seq > c.seq {
+			c.seq = seq
+		}
+		begin += s.Cap
+	}
+
+	c.seqLimit = c.seq
+	if scanned {
+		return c.reserveSeq()
+	}
+	return nil
+}
+
+// reserveSeq saves seqs ahead of the last one to headers of storages.
+func (c *Context) reserveSeq() error {
+	limit := c.seq + seqReserve
+	for _, s := range c.storages {
+		err := s.Disk.SaveSeq(limit)
+		if err != nil {
+			return err
+		}
+	}
+	c.seqLimit = limit
+	return nil
+}
+
+// blockKeys assigns keys of values to the blocks where the values begin,
+// all of them are saved by the same write with a new seq, which is never
+// given to a write before, even of an earlier run.
+func (c *Context) blockKeys(keys []ydcommon.IndexTableKey, valueBlocks []uint32) ([]storage.BlockKey, error) {
+	if c.seq >= c.seqLimit {
+		err := c.reserveSeq()
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.seq++
+	seq := c.seq
+
+	blockKeys := make([]storage.BlockKey, len(valueBlocks))
+	i := 0
+	for block, n := range valueBlocks {
+		if n != 0 {
+			blockKeys[block] = storage.BlockKey{Key: keys[i], Seq: seq}
+			i++
+		}
+	}
+	return blockKeys, nil
+}
+
+// ClearKey marks the value which begins from globalIdx as deleted on its
+// device, so that it is not brought back by RebuildIndex.
+func (c *Context) ClearKey(globalIdx ydcommon.IndexTableValue) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	sp, err := c.locate(uint64(globalIdx))
+	if err != nil {
+		return err
+	}
+
+	return c.storages[sp.dev].Disk.ClearBlockKey(ydcommon.IndexTableValue(sp.posIdx))
+}
+
 // Close finishes all actions and close all storages
 func (c *Context) Close() {
 	for _, storage := range c.storages {
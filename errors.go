@@ -11,4 +11,6 @@ var (
 	ErrEmptyYTFSDir        = errors.New("YTFS: dir has no ytfs contents")
 	ErrSettingMismatch     = errors.New("YTFS: ytfs initailize failed because new config not consistent")
 	ErrConfigIndexMismatch = errors.New("YTFS: ytfs initailize failed because indexDB and config mismatch")
+	ErrIndexShrink         = errors.New("YTFS: index can not be resized to smaller N or C")
+	ErrIndexInMemory       = errors.New("YTFS: index in memory can not be checked or rebuilt")
 )
@@ -3,6 +3,7 @@ package errors
 
 import (
 	"errors"
+	"fmt"
 )
 
 // Common errors.
@@ -10,7 +11,7 @@ var (
 	ErrHeadNotFound     = errors.New("YTFS: head not found")
 	ErrDataNotFound     = errors.New("YTFS: data not found")
 	ErrDataOverflow     = errors.New("YTFS: overflow happens, all data disk full")
-	ErrContextOverflow  = errors.New("YTFS: context can not support >32bit address")
+	ErrDataTooLarge     = errors.New("YTFS: data is larger than data block")
 	ErrConfigCache      = errors.New("YTFS: Cache size config error")
 	ErrStorageSize      = errors.New("YTFS: storage size does not meet settings")
 	ErrStorageType      = errors.New("YTFS: Unknown storage type")
@@ -20,8 +21,43 @@ var (
 	ErrRangeFull        = errors.New("YTFS: Range is full")
 	ErrReadOnly         = errors.New("YTFS: read-only mode")
 	ErrClosed           = errors.New("YTFS: closed")
+	ErrTableEnd         = errors.New("YTFS: table end")
+	ErrIndexCorrupted   = errors.New("YTFS: index table is corrupted")
+	ErrIndexVersion     = errors.New("YTFS: unknown index version")
+	ErrDataCorrupted    = errors.New("YTFS: data checksum mismatch")
+	ErrNoBlockKey       = errors.New("YTFS: storage does not save keys of data blocks")
+	ErrDirectIO         = errors.New("YTFS: direct I/O is not supported on this platform")
+	ErrStorageBackend   = errors.New("YTFS: storage backend is not registered")
 )
 
+// ErrLocked is returned when a YTFS home or storage is held by another
+// process.
+type ErrLocked struct {
+	Path string // path of the locked file
+	PID  int    // pid of the process holding the lock, 0 if unknown
+}
+
+func (e *ErrLocked) Error() string {
+	return fmt.Sprintf("YTFS: %s is locked by process %d", e.Path, e.PID)
+}
+
+// ErrStorageCapacity is ErrStorageSize with both numbers, it is returned
+// when a device or file system can not hold the storage size of config.
+type ErrStorageCapacity struct {
+	Path      string // path of the storage
+	Required  uint64 // storage size of config
+	Available uint64 // bytes the device or file system can hold
+}
+
+func (e *ErrStorageCapacity) Error() string {
+	return fmt.Sprintf("%v: %s needs %d bytes, only %d available", ErrStorageSize, e.Path, e.Required, e.Available)
+}
+
+// Is makes errors.Is(err, ErrStorageSize) true, for go 1.13 and later.
+func (e *ErrStorageCapacity) Is(target error) bool {
+	return target == ErrStorageSize
+}
+
 // New returns an error that formats as the given text.
 func New(text string) error {
 	return errors.New(text)
@@ -1,10 +1,15 @@
 package ytfs
 
 import (
+	"context"
+	"os"
 	"path"
 	"sort"
+	"sync"
 
+	"github.com/yottachain/YTFS/cache"
 	ydcommon "github.com/yottachain/YTFS/common"
+	"github.com/yottachain/YTFS/errors"
 	"github.com/yottachain/YTFS/opt"
 	"github.com/yottachain/YTFS/storage"
 )
@@ -16,9 +21,24 @@ type IndexDB struct {
 
 	// index file
 	indexFile *storage.YTFSIndexFile
+
+	// filter of all keys, saved to filterName when closed, unless the name
+	// is empty. It is nil if disabled by config.
+	filter     *keyFilter
+	filterName string
+	readOnly   bool
+
+	// lock of indexFile, which is swapped by resize
+	lock sync.RWMutex
 }
 
 // NewIndexDB creates a new index db based on input file if it's exist.
+//
+// The key filter is loaded from index.db.filter, or built from the index
+// if the file does not exist or is of another size. A writable db removes
+// the file until it is closed, so the file never falls behind the index,
+// even if the process crashes. The filter holds config.KeyFilterSize keys,
+// or as many as data slots if it is 0, and is disabled if it is negative.
 func NewIndexDB(dir string, config *opt.Options) (*IndexDB, error) {
 	fileName := path.Join(dir, "index.db")
 	indexFile, err := storage.OpenYTFSIndexFile(fileName, config)
@@ -28,27 +48,99 @@ func NewIndexDB(dir string, config *opt.Options) (*IndexDB, error) {
 
 	err = validateDBSchema(indexFile.MetaData(), config)
 	if err != nil {
+		indexFile.Close()
 		return nil, err
 	}
 
+	slots := uint64(config.KeyFilterSize)
+	if config.KeyFilterSize == 0 {
+		for _, storageOpt := range config.Storages {
+			slots += storageOpt.StorageVolume / uint64(config.DataBlockSize)
+		}
+	}
+	var filter *keyFilter
+	if config.KeyFilterSize >= 0 {
+		filter = newKeyFilter(slots)
+	}
+	filterName := fileName + ".filter"
+	if config.IndexInMemory() {
+		// index in memory keeps no file, the filter is built every time.
+		filterName = ""
+	}
+	if filter != nil && (filterName == "" || !loadKeyFilter(filter, filterName)) {
+		err = buildKeyFilter(filter, indexFile)
+		if err != nil {
+			indexFile.Close()
+			return nil, err
+		}
+	}
+	if !config.ReadOnly && filterName != "" {
+		// a filter file left while the filter is disabled would miss keys
+		// when it is enabled again.
+		err = os.Remove(filterName)
+		if err != nil && !os.IsNotExist(err) {
+			indexFile.Close()
+			return nil, err
+		}
+	}
+	if filter == nil {
+		filterName = ""
+	}
+
 	return &IndexDB{
-		schema:    indexFile.MetaData(),
-		indexFile: indexFile,
+		schema:     indexFile.MetaData(),
+		indexFile:  indexFile,
+		filter:     filter,
+		filterName: filterName,
+		readOnly:   config.ReadOnly,
 	}, nil
 }
 
 // Get queries value corresponding to the input key.
 func (db *IndexDB) Get(key ydcommon.IndexTableKey) (ydcommon.IndexTableValue, error) {
+	if !db.filter.mayContain(key) {
+		return 0, errors.ErrDataNotFound
+	}
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
 	return db.indexFile.Get(key)
 }
 
-// Put add new key value pair to db.
-func (db *IndexDB) Put(key ydcommon.IndexTableKey, value ydcommon.IndexTableValue) error {
-	return db.indexFile.Put(key, value)
+// GetContext queries value corresponding to the input key, it gives up if
+// ctx is done before the index is available.
+func (db *IndexDB) GetContext(ctx context.Context, key ydcommon.IndexTableKey) (ydcommon.IndexTableValue, error) {
+	if !db.filter.mayContain(key) {
+		return 0, errors.ErrDataNotFound
+	}
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return db.indexFile.GetContext(ctx, key)
+}
+
+// Put add new key value pair to db, the value takes blocks data slots.
+func (db *IndexDB) Put(key ydcommon.IndexTableKey, value ydcommon.IndexTableValue, blocks uint32) error {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	// the key is added first, so it is never found missing by the filter
+	// once it is in the index. A failed write takes it back.
+	db.filter.add(key)
+	err := db.indexFile.PutBlocks(key, value, blocks)
+	if err != nil {
+		db.filter.remove(key)
+		return err
+	}
+	return nil
 }
 
 // BatchPut add a set of new key value pairs to db.
-func (db *IndexDB) BatchPut(kvPairs []ydcommon.IndexItem) (map[ydcommon.IndexTableKey]byte, error) {
+// Values take data slots until dataEnd.
+func (db *IndexDB) BatchPut(kvPairs []ydcommon.IndexItem, dataEnd uint64) (map[ydcommon.IndexTableKey]byte, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
 	// sorr kvPair by hash entry to make sure write in sequence.
 	sort.Slice(kvPairs, func(i, j int) bool {
 		return db.indexFile.GetTableEntryIndex(kvPairs[i].Hash) < db.indexFile.GetTableEntryIndex(kvPairs[j].Hash)
@@ -62,17 +154,89 @@ func (db *IndexDB) BatchPut(kvPairs []ydcommon.IndexItem) (map[ydcommon.IndexTab
 	// 		}
 	// }
 	// return nil
-	return db.indexFile.BatchPut(kvPairs)
+	// keys are added first as Put does.
+	for _, kvPair := range kvPairs {
+		db.filter.add(kvPair.Hash)
+	}
+	conflicts, err := db.indexFile.BatchPutBlocks(kvPairs, dataEnd)
+	if err != nil {
+		for _, kvPair := range kvPairs {
+			db.filter.remove(kvPair.Hash)
+		}
+		return conflicts, err
+	}
+	return nil, nil
+}
+
+// Delete removes the key from db, the blocks data slots it points to are
+// saved to recycle list for reuse.
+func (db *IndexDB) Delete(key ydcommon.IndexTableKey, blocks uint32) (ydcommon.IndexTableValue, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	value, err := db.indexFile.Delete(key, blocks)
+	if err != nil {
+		return value, err
+	}
+
+	db.filter.remove(key)
+	return value, nil
+}
+
+func (db *IndexDB) popRecycled() (ydcommon.IndexTableValue, bool, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return db.indexFile.PopRecycled()
+}
+
+func (db *IndexDB) pushRecycled(value ydcommon.IndexTableValue) error {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return db.indexFile.Recycle(value)
+}
+
+// replaceRecycled saves slots as the recycle list in one txn.
+func (db *IndexDB) replaceRecycled(slots []ydcommon.IndexTableValue) error {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return db.indexFile.ReplaceRecycled(slots)
+}
+
+// CacheStat reports usage of the range table cache.
+func (db *IndexDB) CacheStat() cache.Stat {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return db.indexFile.CacheStat()
 }
 
-// Close finishes all actions and close db connection.
+// KeyFilterStat reports the status of the key filter.
+func (db *IndexDB) KeyFilterStat() KeyFilterStat {
+	return db.filter.stat()
+}
+
+// IndexStat reports the fill status and op counters of the index.
+func (db *IndexDB) IndexStat() (storage.IndexStat, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return db.indexFile.IndexStat()
+}
+
+// Close finishes all actions and close db connection. The key filter is
+// saved after the index is synced.
 func (db *IndexDB) Close() {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
 	db.indexFile.Close()
+	if !db.readOnly && db.filterName != "" {
+		saveKeyFilter(db.filter, db.filterName)
+	}
 }
 
 // Reset finishes all actions and close db connection.
 func (db *IndexDB) Reset() {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
 	db.indexFile.Format()
+	db.filter.reset()
 }
 
 func validateDBSchema(meta *ydcommon.Header, opt *opt.Options) error {
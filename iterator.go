@@ -0,0 +1,111 @@
+package ytfs
+
+import (
+	"bytes"
+	"sort"
+
+	ydcommon "github.com/yottachain/YTFS/common"
+	"github.com/yottachain/YTFS/errors"
+	"github.com/yottachain/YTFS/storage"
+)
+
+// Iterator iterates over all key/position pairs saved in a YTFS, table by
+// table, the overflow chain comes last. It works on the live index, so
+// the YTFS keeps serving while iterating, each table is read as a snapshot
+// and items put or deleted during iteration may or may not be reported.
+//
+// Usage Sample:
+//		it := ytfs.NewIterator()
+//		for it.Next() {
+//			fmt.Println(it.Key(), it.Value())
+//		}
+//		if it.Err() != nil {
+//			...
+//		}
+type Iterator struct {
+	ytfs   *YTFS
+	tables *storage.TableIterator
+	items  []ydcommon.IndexItem
+	cursor int
+	err    error
+}
+
+// NewIterator creates an Iterator of all items in YTFS.
+func (ytfs *YTFS) NewIterator() *Iterator {
+	return &Iterator{
+		ytfs:   ytfs,
+		tables: storage.NewTableIterator(ytfs.db.indexFile),
+		items:  nil,
+		cursor: 0,
+	}
+}
+
+// Next moves the iterator to the next item, it returns false when all
+// items are iterated or an error happens.
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	it.cursor++
+	for it.cursor >= len(it.items) {
+		table, err := it.tables.GetNoNilTable()
+		if err != nil {
+			if err != errors.ErrTableEnd {
+				it.err = err
+			}
+			it.items = nil
+			return false
+		}
+		it.loadItems(table)
+	}
+
+	return true
+}
+
+func (it *Iterator) loadItems(table ydcommon.IndexTable) {
+	it.items = make([]ydcommon.IndexItem, 0, len(table))
+	for key, value := range table {
+		it.items = append(it.items, ydcommon.IndexItem{Hash: key, OffsetIdx: value})
+	}
+	sort.Slice(it.items, func(i, j int) bool {
+		return bytes.Compare(it.items[i].Hash[:], it.items[j].Hash[:]) < 0
+	})
+	it.cursor = 0
+}
+
+// Seek moves the iterator to the beginning of the given table, the next
+// call of Next reports the first item of that table. The overflow chain
+// begins from the table of index Meta().RangeCapacity, followed by
+// Meta().OverflowPages pages.
+func (it *Iterator) Seek(tableIndex uint32) {
+	it.tables.Seek(tableIndex)
+	it.items = nil
+	it.cursor = 0
+	it.err = nil
+}
+
+// TableIndex reports the table which current item belongs to.
+func (it *Iterator) TableIndex() uint32 {
+	return it.tables.TableIndex() - 1
+}
+
+// Key reports the key of current item.
+func (it *Iterator) Key() ydcommon.IndexTableKey {
+	return it.items[it.cursor].Hash
+}
+
+// Value reports the global data position of current item.
+func (it *Iterator) Value() ydcommon.IndexTableValue {
+	return it.items[it.cursor].OffsetIdx
+}
+
+// Data reads the data block of current item.
+func (it *Iterator) Data() ([]byte, error) {
+	return it.ytfs.context.Get(it.Value())
+}
+
+// Err reports the error which stops the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,296 @@
+package ytfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io/ioutil"
+	"math/bits"
+	"math/rand"
+	"os"
+	"sync"
+
+	ydcommon "github.com/yottachain/YTFS/common"
+	"github.com/yottachain/YTFS/errors"
+	"github.com/yottachain/YTFS/storage"
+)
+
+const (
+	filterBucketSize = 4
+	filterMaxKicks   = 500
+	// filterLoadFactor is the load of buckets when all data slots are used.
+	filterLoadFactor = 0.9
+	filterHeaderSize = 16
+)
+
+var (
+	filterTag     = [4]byte{'Y', 'T', 'K', 'F'}
+	filterVersion = uint32(1)
+)
+
+// keyFilter is a cuckoo filter over all keys of the index, so that a key
+// which does not exist is usually found missing without reading index.db.
+// It has false positives but no false negatives, and unlike Bloom filter
+// keys can be removed.
+//
+// Each key is a 16-bit fingerprint in one of its 2 buckets, the 2nd bucket
+// is derived from the 1st one and the fingerprint, so a fingerprint can be
+// kicked to its other bucket without knowing the key.
+//
+// A nil filter is disabled, every key may exist.
+type keyFilter struct {
+	buckets [][filterBucketSize]uint16
+	// keys the filter is sized for.
+	capacity uint64
+	count    uint32
+	// full is set when a fingerprint has no room, every key may exist then.
+	full bool
+	rand *rand.Rand
+	lock sync.RWMutex
+}
+
+// newKeyFilter creates an empty filter which holds slots keys.
+func newKeyFilter(slots uint64) *keyFilter {
+	n := uint64(float64(slots)/(filterBucketSize*filterLoadFactor)) + 1
+	n = uint64(1) << uint(bits.Len64(n-1))
+	return &keyFilter{
+		buckets:  make([][filterBucketSize]uint16, n),
+		capacity: slots,
+		rand:     rand.New(rand.NewSource(int64(slots))),
+	}
+}
+
+// KeyFilterStat is the status of the key filter.
+type KeyFilterStat struct {
+	// Capacity is the number of keys the filter is sized for, 0 if it is
+	// disabled by config.KeyFilterSize.
+	Capacity uint64 `json:"capacity"`
+	Keys     uint32 `json:"keys"`
+	// Full is set once a key found no room, every lookup reads the index
+	// then, until the filter is built again by the next open. A larger
+	// config.KeyFilterSize keeps it from filling up again.
+	Full bool `json:"full"`
+}
+
+func (filter *keyFilter) stat() KeyFilterStat {
+	if filter == nil {
+		return KeyFilterStat{}
+	}
+
+	filter.lock.RLock()
+	defer filter.lock.RUnlock()
+	return KeyFilterStat{Capacity: filter.capacity, Keys: filter.count, Full: filter.full}
+}
+
+// fingerprint and index of the 1st bucket of key. Keys are hashed again,
+// as they are not always evenly distributed.
+func (filter *keyFilter) locate(key ydcommon.IndexTableKey) (uint16, uint64) {
+	h := fnv.New64a()
+	h.Write(key[:])
+	sum := h.Sum64()
+	fp := uint16(sum >> 48)
+	if fp == 0 {
+		// 0 tells an empty entry.
+		fp = 1
+	}
+	return fp, sum & uint64(len(filter.buckets)-1)
+}
+
+func (filter *keyFilter) altIndex(i uint64, fp uint16) uint64 {
+	return (i ^ (uint64(fp) * 0x5bd1e995)) & uint64(len(filter.buckets)-1)
+}
+
+func (filter *keyFilter) insertAt(i uint64, fp uint16) bool {
+	for j, entry := range filter.buckets[i] {
+		if entry == 0 {
+			filter.buckets[i][j] = fp
+			return true
+		}
+	}
+	return false
+}
+
+// add adds key to filter.
+func (filter *keyFilter) add(key ydcommon.IndexTableKey) {
+	if filter == nil {
+		return
+	}
+
+	filter.lock.Lock()
+	defer filter.lock.Unlock()
+
+	if filter.full {
+		return
+	}
+
+	fp, i := filter.locate(key)
+	filter.count++
+	if filter.insertAt(i, fp) || filter.insertAt(filter.altIndex(i, fp), fp) {
+		return
+	}
+
+	for kick := 0; kick < filterMaxKicks; kick++ {
+		j := filter.rand.Intn(filterBucketSize)
+		fp, filter.buckets[i][j] = filter.buckets[i][j], fp
+		i = filter.altIndex(i, fp)
+		if filter.insertAt(i, fp) {
+			return
+		}
+	}
+	filter.full = true
+	fmt.Printf("YTFS key filter is full at %d keys of %d, lookups of missing keys read the index until it is reopened, set a larger keyFilterSize\n", filter.count, filter.capacity)
+}
+
+// remove removes key from filter, key must have been added.
+func (filter *keyFilter) remove(key ydcommon.IndexTableKey) {
+	if filter == nil {
+		return
+	}
+
+	filter.lock.Lock()
+	defer filter.lock.Unlock()
+
+	if filter.full {
+		return
+	}
+
+	fp, i := filter.locate(key)
+	for _, b := range []uint64{i, filter.altIndex(i, fp)} {
+		for j, entry := range filter.buckets[b] {
+			if entry == fp {
+				filter.buckets[b][j] = 0
+				filter.count--
+				return
+			}
+		}
+	}
+}
+
+// mayContain reports false if key is not in filter for sure.
+func (filter *keyFilter) mayContain(key ydcommon.IndexTableKey) bool {
+	if filter == nil {
+		return true
+	}
+
+	filter.lock.RLock()
+	defer filter.lock.RUnlock()
+
+	if filter.full {
+		return true
+	}
+
+	fp, i := filter.locate(key)
+	for _, b := range []uint64{i, filter.altIndex(i, fp)} {
+		for _, entry := range filter.buckets[b] {
+			if entry == fp {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reset removes all keys from filter.
+func (filter *keyFilter) reset() {
+	if filter == nil {
+		return
+	}
+
+	filter.lock.Lock()
+	defer filter.lock.Unlock()
+
+	for i := range filter.buckets {
+		filter.buckets[i] = [filterBucketSize]uint16{}
+	}
+	filter.count = 0
+	filter.full = false
+}
+
+// buildKeyFilter adds all keys of index file to filter.
+func buildKeyFilter(filter *keyFilter, indexFile *storage.YTFSIndexFile) error {
+	ti := storage.NewTableIterator(indexFile)
+	for {
+		table, err := ti.GetNoNilTable()
+		if err == errors.ErrTableEnd {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for key := range table {
+			filter.add(key)
+		}
+	}
+}
+
+// key filter sidecar file layout, crc32 covers all bytes before it.
+// +-----+---------+---------+-------+---------+-------+
+// | tag | version | buckets | count | buckets | crc32 |
+// +-----+---------+---------+-------+---------+-------+
+
+// saveKeyFilter saves filter to fileName, which is written to a temp file
+// then renamed. Filter which is full is not saved.
+func saveKeyFilter(filter *keyFilter, fileName string) error {
+	filter.lock.RLock()
+	defer filter.lock.RUnlock()
+
+	if filter.full {
+		err := os.Remove(fileName)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	bodySize := filterHeaderSize + len(filter.buckets)*filterBucketSize*2
+	dat := make([]byte, bodySize+4)
+	copy(dat, filterTag[:])
+	binary.LittleEndian.PutUint32(dat[4:], filterVersion)
+	binary.LittleEndian.PutUint32(dat[8:], uint32(len(filter.buckets)))
+	binary.LittleEndian.PutUint32(dat[12:], filter.count)
+	entries := dat[filterHeaderSize:]
+	for i, bucket := range filter.buckets {
+		for j, entry := range bucket {
+			binary.LittleEndian.PutUint16(entries[(i*filterBucketSize+j)*2:], entry)
+		}
+	}
+	binary.LittleEndian.PutUint32(dat[bodySize:], crc32.ChecksumIEEE(dat[:bodySize]))
+
+	tmpName := fileName + ".tmp"
+	err := ioutil.WriteFile(tmpName, dat, 0644)
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return os.Rename(tmpName, fileName)
+}
+
+// loadKeyFilter loads filter from fileName, it reports false if the file
+// does not exist, or does not match filter.
+func loadKeyFilter(filter *keyFilter, fileName string) bool {
+	dat, err := ioutil.ReadFile(fileName)
+	bodySize := filterHeaderSize + len(filter.buckets)*filterBucketSize*2
+	if err != nil || len(dat) != bodySize+4 {
+		return false
+	}
+	if crc32.ChecksumIEEE(dat[:bodySize]) != binary.LittleEndian.Uint32(dat[bodySize:]) {
+		return false
+	}
+	if !bytes.Equal(dat[:4], filterTag[:]) || binary.LittleEndian.Uint32(dat[4:]) != filterVersion ||
+		binary.LittleEndian.Uint32(dat[8:]) != uint32(len(filter.buckets)) {
+		return false
+	}
+
+	filter.lock.Lock()
+	defer filter.lock.Unlock()
+	entries := dat[filterHeaderSize:]
+	for i := range filter.buckets {
+		for j := range filter.buckets[i] {
+			filter.buckets[i][j] = binary.LittleEndian.Uint16(entries[(i*filterBucketSize+j)*2:])
+		}
+	}
+	filter.count = binary.LittleEndian.Uint32(dat[12:])
+	return true
+}
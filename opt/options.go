@@ -2,11 +2,15 @@
 package opt
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"math"
-	"math/bits"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 
 	// "unsafe"
 
@@ -22,13 +26,18 @@ const (
 	MaxRangeNumber   = math.MaxInt32 // 2G
 )
 
+// ConfigHistorySize is the number of previous configs kept by SaveConfig.
+const ConfigHistorySize = 16
+
 // config errors
 var (
-	ErrConfigC          = errors.New("yotta config: config.C should in range [sum(Ti), MaxDiskCapability]")
+	ErrConfigC          = errors.New("yotta config: config.C should not be less than sum(Ti)")
 	ErrConfigN          = errors.New("yotta config: config.N should be power of 2 and less than MAX_RANGE")
 	ErrConfigD          = errors.New("yotta config: config.D should be consistent with YTFS")
 	ErrConfigM          = errors.New("yotta config: config.M setting is incorrect")
 	ErrConfigSyncPeriod = errors.New("yotta config: config.SyncPeriod setting is not power of 2")
+	ErrConfigChecksum   = errors.New("yotta config: unknown storage checksum type")
+	ErrConfigIndexType  = errors.New("yotta config: index can not be kept in storage of this type")
 )
 
 // Options Config options
@@ -41,6 +50,49 @@ type Options struct {
 	IndexTableRows uint32           `json:"N"`
 	DataBlockSize  uint32           `json:"D"`
 	TotalVolumn    uint64           `json:"C"`
+	IndexCacheSize uint64           `json:"indexCacheSize"` // bytes of decoded index tables in memory, 0 to search tables on disk.
+	// KeyFilterSize is the number of keys the key filter holds, 0 to size it
+	// by data slots, negative to disable it so that every lookup reads the
+	// index.
+	KeyFilterSize int64 `json:"keyFilterSize,omitempty"`
+	// IndexStorageType is FileStorageType to keep the index in index.db of
+	// the YTFS dir, or DummyStorageType to keep it in memory.
+	IndexStorageType ytfs.StorageType `json:"indexType"`
+	// IndexBackend names the backend which opens the index, it overrides
+	// IndexStorageType as StorageOptions.Backend does.
+	IndexBackend        string          `json:"indexBackend,omitempty"`
+	IndexBackendOptions json.RawMessage `json:"indexBackendOptions,omitempty"`
+}
+
+// IndexStorageOptions returns the options to open the index at path with.
+func (opt *Options) IndexStorageOptions(path string) *StorageOptions {
+	return &StorageOptions{
+		StorageName:    path,
+		StorageType:    opt.IndexStorageType,
+		ReadOnly:       opt.ReadOnly,
+		Backend:        opt.IndexBackend,
+		BackendOptions: opt.IndexBackendOptions,
+	}
+}
+
+// IndexInMemory reports whether the index is kept in memory, so that it has
+// no journal nor key filter file, and can not be checked or rebuilt.
+func (opt *Options) IndexInMemory() bool {
+	return opt.IndexStorageOptions("").BackendName() == MemoryBackend
+}
+
+// InMemory reports whether the index and all storages are kept in memory, a
+// YTFS of such config has nothing in its dir, which is not even created.
+func (opt *Options) InMemory() bool {
+	if !opt.IndexInMemory() {
+		return false
+	}
+	for _, storageOpt := range opt.Storages {
+		if storageOpt.BackendName() != MemoryBackend {
+			return false
+		}
+	}
+	return true
 }
 
 // Equal compares 2 Options to tell if it is equal
@@ -68,25 +120,43 @@ func DefaultOptions() *Options {
 	if err != nil {
 		panic(err)
 	}
+	tmpFile1.Close()
 	tmpFile2, err := ioutil.TempFile("", "yotta-play-2")
 	if err != nil {
 		panic(err)
 	}
+	tmpFile2.Close()
+
+	return defaultOptions(tmpFile1.Name(), tmpFile2.Name(), ytfs.FileStorageType)
+}
 
+// memoryOptionsCount makes names of storages of MemoryOptions unique.
+var memoryOptionsCount uint64
+
+// MemoryOptions is the default config with the index and storages kept in
+// memory, nothing is written to disk. Each call makes new storages.
+func MemoryOptions() *Options {
+	n := atomic.AddUint64(&memoryOptionsCount, 1)
+	config := defaultOptions(fmt.Sprintf("yotta-memory-%d-1", n), fmt.Sprintf("yotta-memory-%d-2", n), ytfs.DummyStorageType)
+	config.IndexStorageType = ytfs.DummyStorageType
+	return config
+}
+
+func defaultOptions(storage1, storage2 string, storageType ytfs.StorageType) *Options {
 	config := &Options{
 		YTFSTag: "ytfs default setting",
 		Storages: []StorageOptions{
 			{
-				StorageName:   tmpFile1.Name(),
-				StorageType:   ytfs.FileStorageType,
+				StorageName:   storage1,
+				StorageType:   storageType,
 				ReadOnly:      false,
 				SyncPeriod:    1,
 				StorageVolume: 1 << 20,
 				DataBlockSize: 1 << 15,
 			},
 			{
-				StorageName:   tmpFile2.Name(),
-				StorageType:   ytfs.FileStorageType,
+				StorageName:   storage2,
+				StorageType:   storageType,
 				ReadOnly:      false,
 				SyncPeriod:    1,
 				StorageVolume: 1 << 20,
@@ -99,6 +169,7 @@ func DefaultOptions() *Options {
 		IndexTableRows: 1 << 13,
 		DataBlockSize:  1 << 15, // Just save HashLen for test.
 		TotalVolumn:    2 << 30, // 1G
+		IndexCacheSize: 1 << 24, // 16M
 	}
 
 	newConfig, err := FinalizeConfig(config)
@@ -130,23 +201,96 @@ func ParseConfig(fileName string) (*Options, error) {
 	return newConfig, nil
 }
 
-// SaveConfig saves config to file.
+// SaveConfig saves config to file. It writes a temp file and renames it to
+// fileName after fsync, so fileName always holds a complete config. The
+// previous config is kept as fileName.1, the older ones as fileName.2 ...,
+// up to ConfigHistorySize of them. Nothing is done if the config does not
+// change.
 func SaveConfig(config *Options, fileName string) error {
-	return nil
+	dat, err := json.MarshalIndent(config, "", "	")
+	if err != nil {
+		return err
+	}
+
+	oldDat, err := ioutil.ReadFile(fileName)
+	if err == nil && bytes.Equal(oldDat, dat) {
+		return nil
+	}
+
+	tmpName := fileName + ".tmp"
+	err = writeFileSync(tmpName, dat)
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	if oldDat != nil {
+		err = saveConfigHistory(fileName, oldDat)
+		if err != nil {
+			os.Remove(tmpName)
+			return err
+		}
+	}
+
+	err = os.Rename(tmpName, fileName)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(fileName))
+}
+
+// saveConfigHistory shifts fileName.N to fileName.N+1, and saves dat as
+// fileName.1, the oldest one beyond ConfigHistorySize is dropped.
+func saveConfigHistory(fileName string, dat []byte) error {
+	os.Remove(fmt.Sprintf("%s.%d", fileName, ConfigHistorySize))
+	for i := ConfigHistorySize - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", fileName, i), fmt.Sprintf("%s.%d", fileName, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return writeFileSync(fileName+".1", dat)
+}
+
+func writeFileSync(fileName string, dat []byte) error {
+	fp, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = fp.Write(dat)
+	if err == nil {
+		err = fp.Sync()
+	}
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	fp, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	return fp.Sync()
 }
 
 // FinalizeConfig finalizes the config, it does following things:
 // 1. Do a few calculation according to config setting.
 // 2. Check if config setting is valid.
 func FinalizeConfig(config *Options) (*Options, error) {
-	// check C in range
-	maxDiskCapability := uint64(1) << ((uint32)(bits.Len32(config.DataBlockSize)) + (uint32)(32))
+	// check C in range, data slots are addressed by 64-bit values, so C is
+	// not limited by D.
 	sumT := uint64(0)
 	for _, ti := range config.Storages {
 		sumT += ti.StorageVolume
 	}
 
-	if config.TotalVolumn > maxDiskCapability || config.TotalVolumn < sumT {
+	if config.TotalVolumn < sumT {
 		return nil, ErrConfigC
 	}
 
@@ -166,6 +310,19 @@ func FinalizeConfig(config *Options) (*Options, error) {
 		return nil, ErrConfigSyncPeriod
 	}
 
+	// index grows with its tables, storages of fixed size can not keep it.
+	switch config.IndexStorageOptions("").BackendName() {
+	case "", BlockBackend, MmapBackend:
+		return nil, ErrConfigIndexType
+	}
+
+	// read-only YTFS never writes to its storages.
+	if config.ReadOnly {
+		for i := range config.Storages {
+			config.Storages[i].ReadOnly = true
+		}
+	}
+
 	// check if YTFS param consistency with YTFS storage.
 	for _, storageOpt := range config.Storages {
 		if (storageOpt.DataBlockSize != config.DataBlockSize) || !ytfs.IsPowerOfTwo((uint64)(config.DataBlockSize)) {
@@ -175,6 +332,10 @@ func FinalizeConfig(config *Options) (*Options, error) {
 		if !ytfs.IsPowerOfTwo((uint64)(storageOpt.SyncPeriod)) {
 			return nil, ErrConfigSyncPeriod
 		}
+
+		if storageOpt.ChecksumType > ytfs.NoChecksumType {
+			return nil, ErrConfigChecksum
+		}
 	}
 
 	// TODO: return new object.
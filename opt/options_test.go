@@ -4,21 +4,36 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
 	"testing"
+
+	ytfs "github.com/yottachain/YTFS/common"
 )
 
+// removeConfig removes config file fileName and configs kept with it.
+func removeConfig(fileName string) {
+	matches, _ := filepath.Glob(fileName + ".*")
+	for _, name := range append(matches, fileName) {
+		os.Remove(name)
+	}
+}
+
 func TestSaveConfig(t *testing.T) {
 	file, err := ioutil.TempFile("", "sample-config.json")
 	if err != nil {
 		t.Fatal(err)
 	}
-	config := DefaultOptions()
+	file.Close()
+	defer removeConfig(file.Name())
+	config := MemoryOptions()
 	SaveConfig(config, file.Name())
 	t.Log("Save config file success", file.Name())
 }
 
 func TestFinalizeConfig(t *testing.T) {
-	config := DefaultOptions()
+	config := MemoryOptions()
 	config.TotalVolumn = 128 << 40
 	config.IndexTableCols = 1024
 	config, err := FinalizeConfig(config)
@@ -30,13 +45,15 @@ func TestFinalizeConfig(t *testing.T) {
 }
 
 func TestParseConfig(t *testing.T) {
-	config := DefaultOptions()
+	config := MemoryOptions()
 	config.TotalVolumn = 128 << 40
 	config.IndexTableCols = 1024
 	file, err := ioutil.TempFile("", "sample-config.json")
 	if err != nil {
 		t.Fatal(err)
 	}
+	file.Close()
+	defer removeConfig(file.Name())
 	SaveConfig(config, file.Name())
 
 	str, err := json.MarshalIndent(config, "", "	")
@@ -57,23 +74,113 @@ func expectedError(t *testing.T, got, expected error) {
 }
 
 func TestParseConfigError(t *testing.T) {
-	config := DefaultOptions()
+	config := MemoryOptions()
 	config.SyncPeriod = 0
 	_, err := FinalizeConfig(config)
 	expectedError(t, err, nil)
 
-	config = DefaultOptions()
+	config = MemoryOptions()
 	config.SyncPeriod = 3
 	_, err = FinalizeConfig(config)
 	expectedError(t, err, ErrConfigSyncPeriod)
 
-	config = DefaultOptions()
+	config = MemoryOptions()
 	config.Storages[0].SyncPeriod = 3
 	_, err = FinalizeConfig(config)
 	expectedError(t, err, ErrConfigSyncPeriod)
 
-	config = DefaultOptions()
+	config = MemoryOptions()
 	config.IndexTableRows = 11
 	_, err = FinalizeConfig(config)
 	expectedError(t, err, ErrConfigN)
+
+	config = MemoryOptions()
+	config.Storages[1].ChecksumType = ytfs.NoChecksumType + 1
+	_, err = FinalizeConfig(config)
+	expectedError(t, err, ErrConfigChecksum)
+
+	config = MemoryOptions()
+	config.IndexStorageType = ytfs.BlockStorageType
+	_, err = FinalizeConfig(config)
+	expectedError(t, err, ErrConfigIndexType)
+
+	config = MemoryOptions()
+	config.IndexBackend = MmapBackend
+	_, err = FinalizeConfig(config)
+	expectedError(t, err, ErrConfigIndexType)
+
+	config = MemoryOptions()
+	config.IndexBackend = "custom"
+	_, err = FinalizeConfig(config)
+	expectedError(t, err, nil)
+	if config.IndexInMemory() || config.InMemory() {
+		t.Fatal("index of custom backend is taken as in memory")
+	}
+}
+
+func TestSaveConfigHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yotta-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileName := path.Join(dir, "config.json")
+	config := MemoryOptions()
+	for _, rows := range []uint32{1 << 10, 1 << 11, 1 << 12, 1 << 12} {
+		config.IndexTableRows = rows
+		err = SaveConfig(config, fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, rows := range []uint32{1 << 12, 1 << 11, 1 << 10} {
+		name := fileName
+		if i > 0 {
+			name = fmt.Sprintf("%s.%d", fileName, i)
+		}
+		saved, err := ParseConfig(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if saved.IndexTableRows != rows {
+			t.Fatalf("%s: expect N %d, got %d", name, rows, saved.IndexTableRows)
+		}
+	}
+
+	if _, err := os.Stat(fileName + ".3"); !os.IsNotExist(err) {
+		t.Fatal("unchanged config should not be saved to history")
+	}
+	if _, err := os.Stat(fileName + ".tmp"); !os.IsNotExist(err) {
+		t.Fatal("temp config file is left")
+	}
+}
+
+func TestOptionsEqual(t *testing.T) {
+	config := MemoryOptions()
+	changes := []func(storage *StorageOptions){
+		func(storage *StorageOptions) { storage.Backend = "custom" },
+		func(storage *StorageOptions) { storage.DataBlockSize *= 2 },
+	}
+	for i, change := range changes {
+		other := *config
+		other.Storages = append([]StorageOptions{}, config.Storages...)
+		if !config.Equal(&other) {
+			t.Fatal("copy of config is not equal")
+		}
+		change(&other.Storages[1])
+		if config.Equal(&other) {
+			t.Fatalf("change %d of storage is not detected", i)
+		}
+	}
+
+	// options of newly created storage only.
+	other := *config
+	other.Storages = append([]StorageOptions{}, config.Storages...)
+	other.Storages[1].ChecksumType = ytfs.NoChecksumType
+	other.Storages[1].DirectIO = true
+	if !config.Equal(&other) {
+		t.Fatal("change of checksum type or direct I/O is not allowed")
+	}
 }
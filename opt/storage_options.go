@@ -2,6 +2,7 @@
 package opt
 
 import (
+	"encoding/json"
 	"errors"
 	"io/ioutil"
 
@@ -15,19 +16,57 @@ var (
 	ErrStorageConfigMetaPeriod = errors.New("yotta storage config: Meta sync period should be power of 2")
 )
 
+// names of built-in storage backends, they are opened for StorageType when
+// no Backend is named.
+const (
+	FileBackend   = "file"
+	BlockBackend  = "block"
+	MemoryBackend = "memory"
+	MmapBackend   = "mmap"
+)
+
+var storageTypeBackends = map[ytfs.StorageType]string{
+	ytfs.FileStorageType:  FileBackend,
+	ytfs.BlockStorageType: BlockBackend,
+	ytfs.DummyStorageType: MemoryBackend,
+	ytfs.MmapStorageType:  MmapBackend,
+}
+
 // StorageOptions sets options of YTFS storage
 type StorageOptions struct {
-	StorageName   string           `json:"storage"`
-	StorageType   ytfs.StorageType `json:"type"`
-	ReadOnly      bool             `json:"readonly"`
-	SyncPeriod    uint32           `json:"syncPeriod"`
-	StorageVolume uint64           `json:"storageSize"`
-	DataBlockSize uint32           `json:"dataBlockSize"`
+	StorageName   string            `json:"storage"`
+	StorageType   ytfs.StorageType  `json:"type"`
+	ReadOnly      bool              `json:"readonly"`
+	SyncPeriod    uint32            `json:"syncPeriod"`
+	StorageVolume uint64            `json:"storageSize"`
+	DataBlockSize uint32            `json:"dataBlockSize"`
+	ChecksumType  ytfs.ChecksumType `json:"checksumType"` // checksum of blocks, for newly created storage.
+	// DirectIO opens a block storage with O_DIRECT, bypassing the page cache.
+	// Newly created storage aligns its layout to the logical sector size.
+	DirectIO bool `json:"directIO"`
+	// Backend names the backend registered by storage.Register which opens
+	// the storage, it overrides StorageType. BackendOptions are left to the
+	// backend to decode.
+	Backend        string          `json:"backend,omitempty"`
+	BackendOptions json.RawMessage `json:"backendOptions,omitempty"`
+}
+
+// BackendName returns the name of the backend which opens the storage, it is
+// "" for an unknown StorageType.
+func (opt *StorageOptions) BackendName() string {
+	if opt.Backend != "" {
+		return opt.Backend
+	}
+	return storageTypeBackends[opt.StorageType]
 }
 
-// Equal compares 2 StorageOptions to tell if it is equal
+// Equal compares 2 StorageOptions to tell if it is equal, only options which
+// change how existing data is laid out or read are compared, so is backend.
+// ChecksumType and DirectIO apply to newly created storage, an existing one
+// keeps its own in header, so they may change.
 func (opt *StorageOptions) Equal(other *StorageOptions) bool {
-	return opt.StorageName == other.StorageName && opt.StorageType == other.StorageType && opt.StorageVolume == other.StorageVolume && opt.DataBlockSize == other.DataBlockSize
+	return opt.StorageName == other.StorageName && opt.StorageType == other.StorageType && opt.StorageVolume == other.StorageVolume && opt.DataBlockSize == other.DataBlockSize &&
+		opt.Backend == other.Backend
 }
 
 // DefaultStorageOptions default config
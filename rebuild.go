@@ -0,0 +1,347 @@
+package ytfs
+
+import (
+	"fmt"
+	"math/bits"
+	"os"
+	"path"
+
+	ydcommon "github.com/yottachain/YTFS/common"
+	"github.com/yottachain/YTFS/errors"
+	"github.com/yottachain/YTFS/opt"
+	"github.com/yottachain/YTFS/storage"
+)
+
+// rebuildScanBlocks is the number of block meta records read at a time.
+const rebuildScanBlocks = 4096
+
+// RebuildIndex regenerates index.db of the YTFS in dir from the keys saved
+// with data blocks, for the case that index.db is lost or corrupted. The
+// old index.db and its journal are kept with .bak suffix, and put back if
+// rebuild fails.
+//
+// All storages must be created with keys of blocks saved, it returns
+// ErrNoBlockKey otherwise. Values are put as they are read in slot order,
+// kept in bitmaps of slots rather than in memory. If several blocks claim
+// the same key, or values overlap, the latest write wins, and a value which
+// loses is not brought back even if its winner loses later. Slots below the data end point which hold
+// no live value are saved to the recycle list. Index in memory is not
+// rebuilt, it returns ErrIndexInMemory.
+func RebuildIndex(dir string, config *opt.Options) error {
+	settings, err := opt.FinalizeConfig(config)
+	if err != nil {
+		return err
+	}
+	if settings.IndexInMemory() {
+		return ErrIndexInMemory
+	}
+	if _, err = os.Stat(dir); err != nil {
+		return err
+	}
+
+	lock, err := lockYTFSDir(dir, false)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	// key filter of the old index does not tell keys of the new one.
+	indexPath := path.Join(dir, "index.db")
+	err = os.Remove(indexPath + ".filter")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	oldFiles := []string{indexPath, indexPath + ".journal"}
+	for _, name := range oldFiles {
+		err = os.Rename(name, name+".bak")
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	err = rebuildIndex(dir, settings)
+	if err != nil {
+		// put back the old index, it may still be of use.
+		for _, name := range oldFiles {
+			os.Remove(name)
+			os.Rename(name+".bak", name)
+		}
+		return err
+	}
+	return nil
+}
+
+func rebuildIndex(dir string, config *opt.Options) error {
+	ytfs, err := openLockedYTFS(dir, config)
+	if err != nil {
+		return err
+	}
+	defer ytfs.Close()
+
+	dataEnd := uint64(0)
+	err = ytfs.context.scanBlockRecords(func(index uint64, record storage.BlockRecord) error {
+		dataEnd = index + 1
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	r := &indexRebuilder{
+		ytfs:    ytfs,
+		dataEnd: dataEnd,
+		used:    newBitmap(dataEnd),
+		starts:  newBitmap(dataEnd),
+		pending: map[ydcommon.IndexTableKey]blockValue{},
+	}
+	err = ytfs.context.scanBlockRecords(func(index uint64, record storage.BlockRecord) error {
+		if record.Seq == 0 || record.Blocks == 0 {
+			return nil
+		}
+		return r.add(blockValue{record, index})
+	})
+	if err != nil {
+		return err
+	}
+	// data end point is saved even if there is no value.
+	err = r.flush()
+	if err != nil {
+		return err
+	}
+
+	// slots are popped from the end of the list, the lowest first.
+	recycled := []ydcommon.IndexTableValue{}
+	for i := dataEnd; i > 0; i-- {
+		if !r.used.get(i - 1) {
+			recycled = append(recycled, ydcommon.IndexTableValue(i-1))
+		}
+	}
+	err = ytfs.db.replaceRecycled(recycled)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Rebuild YTFS index @%s: %d values, %d recycled slots, data end %d\n", dir, r.values, len(recycled), dataEnd)
+	return nil
+}
+
+// rebuildBatchSize is the number of values put to the index at a time.
+const rebuildBatchSize = 1000
+
+// indexRebuilder puts values to the index as they are found in block
+// records. Slots taken by values are kept in bitmaps, used for every slot
+// and starts for the first slot of each value, so a value is found by the
+// slot it takes without keeping all values in memory.
+type indexRebuilder struct {
+	ytfs    *YTFS
+	dataEnd uint64
+	used    bitmap
+	starts  bitmap
+	// values not put to the index yet.
+	pending map[ydcommon.IndexTableKey]blockValue
+	values  int
+}
+
+// add puts value unless a later write of its key or of its slots is found
+// already. Earlier values it conflicts with are removed.
+func (r *indexRebuilder) add(value blockValue) error {
+	end := value.index + uint64(value.Blocks)
+	if end > r.dataEnd {
+		return nil
+	}
+
+	owners := []blockValue{}
+	owner, found, err := r.lookupKey(value.Key)
+	if err != nil {
+		return err
+	}
+	if found {
+		owners = append(owners, owner)
+	}
+	for i := value.index; i < end; i++ {
+		if !r.used.get(i) {
+			continue
+		}
+		owner, err = r.lookupSlot(i)
+		if err != nil {
+			return err
+		}
+		if !found || owner.index != owners[0].index {
+			owners = append(owners, owner)
+		}
+		// slots of the owner are skipped.
+		i = owner.index + uint64(owner.Blocks) - 1
+	}
+
+	for _, owner := range owners {
+		if owner.Seq >= value.Seq {
+			return nil
+		}
+	}
+	for _, owner := range owners {
+		err = r.remove(owner)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := value.index; i < end; i++ {
+		r.used.set(i)
+	}
+	r.starts.set(value.index)
+	r.pending[value.Key] = value
+	r.values++
+	if len(r.pending) >= rebuildBatchSize {
+		return r.flush()
+	}
+	return nil
+}
+
+// lookupKey finds the value added of key.
+func (r *indexRebuilder) lookupKey(key ydcommon.IndexTableKey) (blockValue, bool, error) {
+	if value, ok := r.pending[key]; ok {
+		return value, true, nil
+	}
+	index, err := r.ytfs.db.Get(key)
+	if err == errors.ErrDataNotFound {
+		return blockValue{}, false, nil
+	}
+	if err != nil {
+		return blockValue{}, false, err
+	}
+	value, err := r.readValue(uint64(index))
+	return value, true, err
+}
+
+// lookupSlot finds the value added which takes slot, it is the one whose
+// first slot is the nearest at or before slot, as added values never
+// overlap.
+func (r *indexRebuilder) lookupSlot(slot uint64) (blockValue, error) {
+	index, ok := r.starts.prev(slot)
+	if !ok {
+		return blockValue{}, errors.ErrDataNotFound
+	}
+	return r.readValue(index)
+}
+
+func (r *indexRebuilder) readValue(index uint64) (blockValue, error) {
+	sp, err := r.ytfs.context.locate(index)
+	if err != nil {
+		return blockValue{}, err
+	}
+	records, err := r.ytfs.context.storages[sp.dev].Disk.ReadBlockRecords(ydcommon.IndexTableValue(sp.posIdx), 1)
+	if err != nil {
+		return blockValue{}, err
+	}
+	return blockValue{records[0], index}, nil
+}
+
+// remove takes back an added value, its slots become free.
+func (r *indexRebuilder) remove(value blockValue) error {
+	for i := value.index; i < value.index+uint64(value.Blocks); i++ {
+		r.used.clear(i)
+	}
+	r.starts.clear(value.index)
+	r.values--
+	if _, ok := r.pending[value.Key]; ok {
+		delete(r.pending, value.Key)
+		return nil
+	}
+	_, err := r.ytfs.db.Delete(value.Key, 0)
+	return err
+}
+
+func (r *indexRebuilder) flush() error {
+	items := make([]ydcommon.IndexItem, 0, len(r.pending))
+	for key, value := range r.pending {
+		items = append(items, ydcommon.IndexItem{Hash: key, OffsetIdx: ydcommon.IndexTableValue(value.index)})
+	}
+	_, err := r.ytfs.db.BatchPut(items, r.dataEnd)
+	if err != nil {
+		return err
+	}
+	r.pending = map[ydcommon.IndexTableKey]blockValue{}
+	return nil
+}
+
+// bitmap keeps a bit for each data slot.
+type bitmap []uint64
+
+func newBitmap(n uint64) bitmap {
+	return make(bitmap, (n+63)/64)
+}
+
+func (b bitmap) get(i uint64) bool {
+	return b[i/64]&(1<<(i%64)) != 0
+}
+
+func (b bitmap) set(i uint64) {
+	b[i/64] |= 1 << (i % 64)
+}
+
+func (b bitmap) clear(i uint64) {
+	b[i/64] &^= 1 << (i % 64)
+}
+
+// prev finds the last bit set at or before i.
+func (b bitmap) prev(i uint64) (uint64, bool) {
+	word := b[i/64] & (^uint64(0) >> (63 - i%64))
+	for w := i / 64; ; w-- {
+		if word != 0 {
+			return w*64 + uint64(63-bits.LeadingZeros64(word)), true
+		}
+		if w == 0 {
+			return 0, false
+		}
+		word = b[w-1]
+	}
+}
+
+// blockValue is a value found in block meta records, index is the global
+// index of its first block.
+type blockValue struct {
+	storage.BlockRecord
+	index uint64
+}
+
+// scanBlockRecords reads block meta records of all storages in order, and
+// calls fn with the global index of each record ever written.
+func (c *Context) scanBlockRecords(fn func(index uint64, record storage.BlockRecord) error) error {
+	begin := uint64(0)
+	for _, s := range c.storages {
+		err := s.scanBlockRecords(begin, fn)
+		if err != nil {
+			return err
+		}
+		begin += s.Cap
+	}
+	return nil
+}
+
+// scanBlockRecords reads block meta records of the storage, whose first
+// block is of global index begin.
+func (s *storageContext) scanBlockRecords(begin uint64, fn func(index uint64, record storage.BlockRecord) error) error {
+	for pos := uint64(0); pos < s.Cap; pos += rebuildScanBlocks {
+		count := s.Cap - pos
+		if count > rebuildScanBlocks {
+			count = rebuildScanBlocks
+		}
+		records, err := s.Disk.ReadBlockRecords(ydcommon.IndexTableValue(pos), uint32(count))
+		if err != nil {
+			return err
+		}
+
+		for i, record := range records {
+			if record.Length == 0 && record.Blocks == 0 {
+				// never written.
+				continue
+			}
+			err = fn(begin+pos+uint64(i), record)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package ytfs
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/yottachain/YTFS/errors"
+	"github.com/yottachain/YTFS/opt"
+	"github.com/yottachain/YTFS/storage"
+)
+
+// ResizeIndex rehashes the index to rows ranges (N) and total volume (C),
+// range coverage (M) is calculated from them as FinalizeConfig does. Neither
+// can be smaller than the current one.
+//
+// A new index file is built from the current one and swapped in, then the
+// config is updated and saved, so the YTFS must be opened with the new N and
+// C afterwards. A YTFS in memory saves no config, the config it is opened
+// with is updated instead. The YTFS keeps serving Get during the rehash, Put
+// and Delete wait until it finishes. Iterators created before are no longer valid.
+func (ytfs *YTFS) ResizeIndex(rows uint32, totalVolume uint64) error {
+	if ytfs.config.ReadOnly {
+		return errors.ErrReadOnly
+	}
+
+	ytfs.mutex.Lock()
+	defer ytfs.mutex.Unlock()
+
+	if rows < ytfs.config.IndexTableRows || totalVolume < ytfs.config.TotalVolumn {
+		return ErrIndexShrink
+	}
+	if rows == ytfs.config.IndexTableRows && totalVolume == ytfs.config.TotalVolumn {
+		return nil
+	}
+
+	config := *ytfs.config
+	config.Storages = append([]opt.StorageOptions{}, ytfs.config.Storages...)
+	config.IndexTableRows, config.TotalVolumn = rows, totalVolume
+	settings, err := opt.FinalizeConfig(&config)
+	if err != nil {
+		return err
+	}
+
+	indexPath := path.Join(ytfs.dir, "index.db")
+	resizePath := indexPath + ".resize"
+	err = storage.RehashIndexFile(ytfs.db.indexFile, resizePath, settings)
+	if err != nil {
+		storage.RemoveIndexFile(resizePath, settings)
+		return err
+	}
+
+	err = ytfs.db.swapIndexFile(indexPath, resizePath, settings)
+	if err != nil {
+		return err
+	}
+
+	ytfs.config.IndexTableRows = settings.IndexTableRows
+	ytfs.config.IndexTableCols = settings.IndexTableCols
+	ytfs.config.TotalVolumn = settings.TotalVolumn
+	if !ytfs.config.InMemory() {
+		err = opt.SaveConfig(ytfs.config, path.Join(ytfs.dir, "config.json"))
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Resize YTFS index @%s: N = %d, M = %d, C = %d\n", ytfs.dir, settings.IndexTableRows, settings.IndexTableCols, settings.TotalVolumn)
+	return nil
+}
+
+// swapIndexFile replaces index file at indexPath by the one at newPath, and
+// opens it as the index of db. Readers wait until it is done.
+func (db *IndexDB) swapIndexFile(indexPath, newPath string, config *opt.Options) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	// old index is synced and its journal is empty once closed.
+	db.indexFile.Close()
+	err := storage.RenameIndexFile(newPath, indexPath, config)
+
+	// the old index is opened again if it is not replaced.
+	indexFile, openErr := storage.OpenYTFSIndexFile(indexPath, config)
+	if openErr != nil {
+		return openErr
+	}
+	db.indexFile = indexFile
+	db.schema = indexFile.MetaData()
+	return err
+}
@@ -0,0 +1,41 @@
+package ytfs
+
+import (
+	"github.com/yottachain/YTFS/cache"
+	"github.com/yottachain/YTFS/storage"
+)
+
+// Stats is the status of a YTFS, it serializes to JSON.
+type Stats struct {
+	// Index is the fill status of index tables, and op counters of index.
+	Index storage.IndexStat `json:"index"`
+	// Cache is usage of the index table cache.
+	Cache cache.Stat `json:"cache"`
+	// KeyFilter is the status of the key filter, which should not be full.
+	KeyFilter KeyFilterStat `json:"keyFilter"`
+	// data slots
+	Cap          uint64 `json:"cap"`
+	Len          uint64 `json:"len"`
+	DataEndPoint uint64 `json:"dataEndPoint"`
+	Recycled     uint32 `json:"recycled"`
+}
+
+// Stats reports the status of the YTFS, operators are expected to watch
+// Index.RangeFullSeconds and Index.FillHistogram, and to resize the index
+// before Put starts failing with ErrRangeFull.
+func (ytfs *YTFS) Stats() (*Stats, error) {
+	indexStat, err := ytfs.db.IndexStat()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Stats{
+		Index:        indexStat,
+		Cache:        ytfs.db.CacheStat(),
+		KeyFilter:    ytfs.db.KeyFilterStat(),
+		Cap:          ytfs.Cap(),
+		Len:          ytfs.Len(),
+		DataEndPoint: ytfs.db.schema.DataEndPoint,
+		Recycled:     ytfs.db.indexFile.RecycledCount(),
+	}, nil
+}
@@ -3,9 +3,9 @@ package storage
 import (
 	"os"
 	"sync"
-	// "syscall"
 
 	types "github.com/yottachain/YTFS/common"
+	"github.com/yottachain/YTFS/errors"
 	"github.com/yottachain/YTFS/opt"
 )
 
@@ -16,11 +16,20 @@ type BlockStorage struct {
 	fd       *FileDesc
 	reader   Reader
 	writer   Writer
+	lock     *FileLock
+
+	// direct I/O, sector is 0 without it.
+	directIO bool
+	sector   int64
+	buffers  *alignedPool
 }
 
 // OpenblkStorage returns a new filesystem-backed storage implementation with the given
 // path. This also acquire a file lock, so any subsequent attempt to open the
-// same path will fail.
+// same path will fail with *errors.ErrLocked. A read-only storage takes no
+// lock, it can be read while another process writes it. With opt.DirectIO, the storage is opened with
+// O_DIRECT, and I/O is aligned to the logical sector size. A device smaller
+// than opt.StorageVolume is refused with *errors.ErrStorageCapacity.
 //
 // The storage must be closed after use, by calling Close method.
 func OpenBlockStorage(opt *opt.StorageOptions) (Storage, error) {
@@ -32,6 +41,7 @@ func OpenBlockStorage(opt *opt.StorageOptions) (Storage, error) {
 			Cap:  0,
 			Path: opt.StorageName,
 		},
+		directIO: opt.DirectIO,
 	}
 
 	reader, err := blkStorage.Open(*blkStorage.fd)
@@ -43,13 +53,21 @@ func OpenBlockStorage(opt *opt.StorageOptions) (Storage, error) {
 	if !opt.ReadOnly {
 		writer, err := blkStorage.Create(*blkStorage.fd)
 		if err != nil {
+			reader.Close()
 			return nil, err
 		}
 		blkStorage.writer = writer
 	}
 
+	blkStorage.lock, err = lockStorage(opt.StorageName, opt.ReadOnly)
+	if err != nil {
+		blkStorage.Close()
+		return nil, err
+	}
+
 	err = blkStorage.validateStorageParam(opt)
 	if err != nil {
+		blkStorage.Close()
 		return nil, err
 	}
 
@@ -61,6 +79,9 @@ func (file *BlockStorage) Reader() (Reader, error) {
 }
 
 func (file *BlockStorage) Writer() (Writer, error) {
+	if file.readOnly {
+		return nil, errors.ErrReadOnly
+	}
 	return file.writer, nil
 }
 
@@ -73,6 +94,12 @@ func (file *BlockStorage) Lock() (Locker, error) {
 	return &file.mu, nil
 }
 
+// SectorSize reports the logical sector size which I/O of the storage is
+// aligned to, or 0 if it is not opened with direct I/O.
+func (file *BlockStorage) SectorSize() uint32 {
+	return uint32(file.sector)
+}
+
 // Close closes the storage.
 // It is valid to call Close multiple times. Other methods should not be
 // called after the storage has been closed.
@@ -82,16 +109,12 @@ func (file *BlockStorage) Close() error {
 		file.writer.Sync()
 		file.writer.Close()
 	}
+	file.lock.Unlock()
 	return nil
 }
 
 func (file *BlockStorage) validateStorageParam(opt *opt.StorageOptions) error {
-	// TODO: enable size check
-	// if file.fd.Cap < opt.StorageVolume {
-	// 	return errors.ErrStorageSize
-	// }
-
-	return nil
+	return validateCapacity(opt.StorageName, opt.StorageVolume, opt.ReadOnly)
 }
 
 // Open opens file with the given 'file descriptor' read-only.
@@ -104,7 +127,9 @@ func (file *BlockStorage) Open(fd FileDesc) (Reader, error) {
 		Path: fd.Path,
 	}
 
-	// fp, err :=  syscall.Open(fd.Path, syscall.O_RDONLY, 0777)
+	if file.directIO {
+		return file.openDirect(fd.Path, os.O_RDONLY)
+	}
 	fp, err := os.Open(fd.Path)
 	if err != nil {
 		return nil, err
@@ -117,9 +142,26 @@ func (file *BlockStorage) Open(fd FileDesc) (Reader, error) {
 // exist and opens write-only.
 // Returns ErrClosed if the underlying storage is closed.
 func (file *BlockStorage) Create(fd FileDesc) (Writer, error) {
+	if file.directIO {
+		return file.openDirect(fd.Path, os.O_RDWR)
+	}
 	fp, err := os.OpenFile(fd.Path, os.O_RDWR, 0644)
 	if err != nil {
 		return nil, err
 	}
 	return fp, nil
 }
+
+// openDirect opens path with O_DIRECT, reader and writer share a pool of
+// aligned buffers.
+func (file *BlockStorage) openDirect(path string, flag int) (*directFile, error) {
+	fp, sector, err := openDirect(path, flag)
+	if err != nil {
+		return nil, err
+	}
+	if file.buffers == nil {
+		file.sector = sector
+		file.buffers = newAlignedPool(sector)
+	}
+	return newDirectFile(fp, file.sector, file.buffers), nil
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"os"
+
+	"github.com/yottachain/YTFS/errors"
+)
+
+// validateCapacity makes sure the storage at path holds volume bytes. A block
+// device must be as large as volume, a regular file is preallocated to it
+// when it is writable, so that a storage larger than its disk is refused when
+// it is opened instead of failing halfway with a write error. It returns
+// *errors.ErrStorageCapacity, which matches errors.ErrStorageSize by
+// errors.Is, if the device or file system is too small.
+func validateCapacity(path string, volume uint64, readOnly bool) error {
+	flag := os.O_RDONLY
+	if !readOnly {
+		flag = os.O_RDWR
+	}
+	fp, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	return checkCapacity(fp, volume, readOnly)
+}
+
+// checkCapacity is validateCapacity of the opened file fp.
+func checkCapacity(fp *os.File, volume uint64, readOnly bool) error {
+	info, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	mode := info.Mode()
+	switch {
+	case mode&os.ModeDevice != 0 && mode&os.ModeCharDevice == 0:
+		size, err := deviceSize(fp)
+		if err != nil {
+			return err
+		}
+		if uint64(size) < volume {
+			return &errors.ErrStorageCapacity{Path: fp.Name(), Required: volume, Available: uint64(size)}
+		}
+	case mode.IsRegular() && !readOnly:
+		// a read-only file may be sparse, it is read as is.
+		return preallocate(fp, int64(volume))
+	}
+	return nil
+}
+
+// extend truncates the file up to size bytes if it is shorter.
+func extend(fp *os.File, size int64) error {
+	info, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() >= size {
+		return nil
+	}
+	return fp.Truncate(size)
+}
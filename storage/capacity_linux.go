@@ -0,0 +1,53 @@
+//go:build linux
+// +build linux
+
+package storage
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/yottachain/YTFS/errors"
+)
+
+// blkGetSize64 is BLKGETSIZE64, ioctl of the size of a block device in bytes.
+const blkGetSize64 = 0x80081272
+
+// deviceSize returns the size of the block device of fp.
+func deviceSize(fp *os.File) (int64, error) {
+	var size uint64
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fp.Fd(), blkGetSize64, uintptr(unsafe.Pointer(&size)))
+	if errno != 0 {
+		return 0, errno
+	}
+	return int64(size), nil
+}
+
+// preallocate allocates blocks of the file for size bytes by fallocate, the
+// file is extended if it is shorter. On a file system without fallocate it
+// is extended as a sparse file.
+func preallocate(fp *os.File, size int64) error {
+	err := syscall.Fallocate(int(fp.Fd()), 0, 0, size)
+	switch err {
+	case nil:
+		return nil
+	case syscall.ENOSPC, syscall.EFBIG:
+		info, statErr := fp.Stat()
+		if statErr != nil {
+			return statErr
+		}
+		// blocks of the file are counted as available, though part of them
+		// may be holes.
+		available := uint64(info.Size())
+		var fs syscall.Statfs_t
+		if syscall.Fstatfs(int(fp.Fd()), &fs) == nil {
+			available += fs.Bavail * uint64(fs.Bsize)
+		}
+		return &errors.ErrStorageCapacity{Path: fp.Name(), Required: uint64(size), Available: available}
+	case syscall.EOPNOTSUPP:
+		return extend(fp, size)
+	default:
+		return err
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package storage
+
+import (
+	"io"
+	"os"
+)
+
+// deviceSize returns the size of the block device of fp by seeking to its
+// end.
+func deviceSize(fp *os.File) (int64, error) {
+	return fp.Seek(0, io.SeekEnd)
+}
+
+// preallocate extends the file to size bytes as a sparse file, fallocate is
+// supported on linux only.
+func preallocate(fp *os.File, size int64) error {
+	return extend(fp, size)
+}
@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"testing"
+
+	types "github.com/yottachain/YTFS/common"
+)
+
+func TestXXHash64(t *testing.T) {
+	cases := []struct {
+		input string
+		sum   uint64
+	}{
+		{"", 0xef46db3751d8e999},
+		{"a", 0xd24ec4f1a98c6e5b},
+		{"abc", 0x44bc2cf5ad770999},
+		{"Nobody inspects the spammish repetition", 0xfbcea83c8a378bf1},
+	}
+
+	for _, c := range cases {
+		if sum := xxhash64([]byte(c.input), 0); sum != c.sum {
+			t.Fatalf("xxhash64(%q): expect %x, got %x", c.input, c.sum, sum)
+		}
+	}
+}
+
+func TestBlockChecksum(t *testing.T) {
+	data := []byte("123456789")
+	if sum := blockChecksum(types.CRC32CChecksumType, data); sum != 0xe3069283 {
+		t.Fatalf("crc32c: expect e3069283, got %x", sum)
+	}
+	if sum := blockChecksum(types.NoChecksumType, data); sum != 0 {
+		t.Fatalf("no checksum: expect 0, got %x", sum)
+	}
+}
@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+// direct I/O
+//
+// A storage opened with StorageOptions.DirectIO bypasses the page cache, so
+// that large writes of data blocks do not evict pages of the index. Offset,
+// length and memory of each I/O must be aligned to the logical sector size,
+// directFile does the alignment for callers: I/O is split to chunks of
+// pooled aligned buffers, and partial sectors at both ends are read before
+// they are written. Storages created with direct I/O align their header
+// region, data blocks and block meta area to sectors, so that writes of
+// whole data blocks skip the read.
+
+// directChunkSize is the size of buffers in alignedPool, larger I/O is done
+// in several chunks.
+const directChunkSize = 1 << 20
+
+// alignedPool is a pool of buffers whose memory is aligned to align.
+type alignedPool struct {
+	align int64
+	pool  sync.Pool
+}
+
+func newAlignedPool(align int64) *alignedPool {
+	p := &alignedPool{align: align}
+	p.pool.New = func() interface{} {
+		buf := make([]byte, directChunkSize+align)
+		skip := int64(uintptr(unsafe.Pointer(&buf[0]))) & (align - 1)
+		if skip != 0 {
+			skip = align - skip
+		}
+		buf = buf[skip : skip+directChunkSize]
+		return &buf
+	}
+	return p
+}
+
+func (p *alignedPool) get() *[]byte {
+	return p.pool.Get().(*[]byte)
+}
+
+func (p *alignedPool) put(buf *[]byte) {
+	p.pool.Put(buf)
+}
+
+// directFile is a file opened with direct I/O, it implements Reader and
+// Writer on unaligned I/O.
+type directFile struct {
+	file    *os.File
+	sector  int64
+	buffers *alignedPool
+	pos     int64
+}
+
+func newDirectFile(file *os.File, sector int64, buffers *alignedPool) *directFile {
+	return &directFile{file: file, sector: sector, buffers: buffers}
+}
+
+func (f *directFile) alignDown(off int64) int64 {
+	return off &^ (f.sector - 1)
+}
+
+func (f *directFile) alignUp(off int64) int64 {
+	return f.alignDown(off + f.sector - 1)
+}
+
+// readSectors reads buf from off which are aligned, bytes beyond end of file
+// read as 0. It reports the bytes read before end of file.
+func (f *directFile) readSectors(buf []byte, off int64) (int, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := pread(f.file, buf[n:], off+int64(n))
+		if err != nil {
+			return n, err
+		}
+		if m == 0 || m&int(f.sector-1) != 0 {
+			// end of file, the next read would be unaligned.
+			n += m
+			break
+		}
+		n += m
+	}
+	for i := n; i < len(buf); i++ {
+		buf[i] = 0
+	}
+	return n, nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *directFile) ReadAt(p []byte, off int64) (int, error) {
+	buf := f.buffers.get()
+	defer f.buffers.put(buf)
+
+	done := 0
+	for done < len(p) {
+		pos := off + int64(done)
+		begin := f.alignDown(pos)
+		end := f.alignUp(off + int64(len(p)))
+		if end-begin > directChunkSize {
+			end = begin + directChunkSize
+		}
+
+		n, err := f.readSectors((*buf)[:end-begin], begin)
+		if err != nil {
+			return done, err
+		}
+		skip := int(pos - begin)
+		if n <= skip {
+			return done, io.EOF
+		}
+		copied := copy(p[done:], (*buf)[skip:n])
+		done += copied
+		if n < int(end-begin) && done < len(p) {
+			return done, io.EOF
+		}
+	}
+	return done, nil
+}
+
+// WriteAt implements io.WriterAt.
+func (f *directFile) WriteAt(p []byte, off int64) (int, error) {
+	buf := f.buffers.get()
+	defer f.buffers.put(buf)
+
+	done := 0
+	for done < len(p) {
+		pos := off + int64(done)
+		begin := f.alignDown(pos)
+		end := f.alignUp(off + int64(len(p)))
+		if end-begin > directChunkSize {
+			end = begin + directChunkSize
+		}
+		chunk := (*buf)[:end-begin]
+
+		// partial sectors at both ends keep the bytes around.
+		skip := pos - begin
+		size := int64(len(p) - done)
+		if size > end-begin-skip {
+			size = end - begin - skip
+		}
+		if skip != 0 {
+			if _, err := f.readSectors(chunk[:f.sector], begin); err != nil {
+				return done, err
+			}
+		}
+		if tail := skip + size; tail&(f.sector-1) != 0 && (skip == 0 || f.alignDown(tail) != 0) {
+			last := f.alignDown(tail)
+			if _, err := f.readSectors(chunk[last:last+f.sector], begin+last); err != nil {
+				return done, err
+			}
+		}
+
+		copy(chunk[skip:], p[done:done+int(size)])
+		if _, err := f.file.WriteAt(chunk, begin); err != nil {
+			return done, err
+		}
+		done += int(size)
+	}
+	return done, nil
+}
+
+// Read implements io.Reader.
+func (f *directFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+// Write implements io.Writer.
+func (f *directFile) Write(p []byte) (int, error) {
+	n, err := f.WriteAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (f *directFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		end, err := f.file.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, err
+		}
+		offset += end
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+// Sync commits written data to stable storage.
+func (f *directFile) Sync() error {
+	return f.file.Sync()
+}
+
+// Close closes the file.
+func (f *directFile) Close() error {
+	return f.file.Close()
+}
@@ -0,0 +1,52 @@
+//go:build linux
+// +build linux
+
+package storage
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// blkSectorSize is BLKSSZGET, ioctl of the logical sector size of a block
+// device.
+const blkSectorSize = 0x1268
+
+// directSectorSize is the alignment of direct I/O on regular files, which
+// is a multiple of the logical sector size of any disk they are on.
+const directSectorSize = 4096
+
+// openDirect opens path with flag and O_DIRECT, it reports the logical
+// sector size which I/O on the file must be aligned to.
+func openDirect(path string, flag int) (*os.File, int64, error) {
+	fp, err := os.OpenFile(path, flag|syscall.O_DIRECT, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return nil, 0, err
+	}
+	if info.Mode()&os.ModeDevice == 0 {
+		return fp, directSectorSize, nil
+	}
+
+	var size int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fp.Fd(), blkSectorSize, uintptr(unsafe.Pointer(&size)))
+	if errno != 0 {
+		fp.Close()
+		return nil, 0, errno
+	}
+	return fp, int64(size), nil
+}
+
+// pread reads once at off, a short read is not retried.
+func pread(fp *os.File, buf []byte, off int64) (int, error) {
+	n, err := syscall.Pread(int(fp.Fd()), buf, off)
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
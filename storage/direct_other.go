@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package storage
+
+import (
+	"io"
+	"os"
+
+	"github.com/yottachain/YTFS/errors"
+)
+
+// openDirect returns ErrDirectIO, direct I/O is supported on linux only.
+func openDirect(path string, flag int) (*os.File, int64, error) {
+	return nil, 0, errors.ErrDirectIO
+}
+
+func pread(fp *os.File, buf []byte, off int64) (int, error) {
+	n, err := fp.ReadAt(buf, off)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
@@ -5,6 +5,7 @@ import (
 	"sync"
 
 	types "github.com/yottachain/YTFS/common"
+	"github.com/yottachain/YTFS/errors"
 	"github.com/yottachain/YTFS/opt"
 )
 
@@ -15,11 +16,15 @@ type FileStorage struct {
 	fd       *FileDesc
 	reader   Reader
 	writer   Writer
+	lock     *FileLock
 }
 
 // OpenFileStorage returns a new filesystem-backed storage implementation with the given
 // path. This also acquire a file lock, so any subsequent attempt to open the
-// same path will fail.
+// same path will fail with *errors.ErrLocked. A read-only storage takes no
+// lock, it is opened only if the file exists. A writable file
+// is preallocated to opt.StorageVolume, it fails with
+// *errors.ErrStorageCapacity if the file system has no room for that.
 //
 // The storage must be closed after use, by calling Close method.
 func OpenFileStorage(opt *opt.StorageOptions) (Storage, error) {
@@ -33,14 +38,12 @@ func OpenFileStorage(opt *opt.StorageOptions) (Storage, error) {
 		},
 	}
 
-	writer, err := fileStorage.Create(*fileStorage.fd)
-	if err != nil {
-		return nil, err
-	}
 	if !opt.ReadOnly {
+		writer, err := fileStorage.Create(*fileStorage.fd)
+		if err != nil {
+			return nil, err
+		}
 		fileStorage.writer = writer
-	} else {
-		writer.Close()
 	}
 
 	reader, err := fileStorage.Open(*fileStorage.fd)
@@ -49,8 +52,15 @@ func OpenFileStorage(opt *opt.StorageOptions) (Storage, error) {
 	}
 	fileStorage.reader = reader
 
+	fileStorage.lock, err = lockStorage(opt.StorageName, opt.ReadOnly)
+	if err != nil {
+		fileStorage.Close()
+		return nil, err
+	}
+
 	err = fileStorage.validateStorageParam(opt)
 	if err != nil {
+		fileStorage.Close()
 		return nil, err
 	}
 
@@ -62,6 +72,9 @@ func (file *FileStorage) Reader() (Reader, error) {
 }
 
 func (file *FileStorage) Writer() (Writer, error) {
+	if file.readOnly {
+		return nil, errors.ErrReadOnly
+	}
 	return file.writer, nil
 }
 
@@ -83,16 +96,12 @@ func (file *FileStorage) Close() error {
 		file.writer.Sync()
 		file.writer.Close()
 	}
+	file.lock.Unlock()
 	return nil
 }
 
 func (file *FileStorage) validateStorageParam(opt *opt.StorageOptions) error {
-	// TODO: enable pre-alloc file
-	// if file.fd.Cap < opt.StorageVolume {
-	// 	return errors.ErrStorageSize
-	// }
-
-	return nil
+	return validateCapacity(opt.StorageName, opt.StorageVolume, opt.ReadOnly)
 }
 
 // Open opens file with the given 'file descriptor' read-only.
@@ -7,6 +7,8 @@ import (
 	"os"
 	// "log"
 	"testing"
+
+	"github.com/yottachain/YTFS/errors"
 )
 
 func TestFileStorageRW(t *testing.T) {
@@ -62,3 +64,35 @@ func TestFileStorageRW(t *testing.T) {
 
 	fmt.Println(a, b, c, d, e, f)
 }
+
+func TestFileStoragePreallocate(t *testing.T) {
+	config := testOptions()
+	defer os.Remove(config.StorageName)
+
+	fs, err := OpenFileStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Close()
+	info, err := os.Stat(config.StorageName)
+	if err != nil || uint64(info.Size()) != config.StorageVolume {
+		t.Fatalf("file is not preallocated to %d: %v, %v", config.StorageVolume, info, err)
+	}
+
+	// no file system holds it.
+	volume := config.StorageVolume
+	config.StorageVolume = 1 << 62
+	_, err = OpenFileStorage(config)
+	capacityErr, ok := err.(*errors.ErrStorageCapacity)
+	if !ok || !capacityErr.Is(errors.ErrStorageSize) || capacityErr.Required != config.StorageVolume || capacityErr.Available < volume {
+		t.Fatalf("storage larger than file system is opened: %v", err)
+	}
+
+	// read-only storage is read as it is.
+	config.ReadOnly = true
+	fs, err = OpenFileStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Close()
+}
@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"os"
+)
+
+// FileLock is an exclusive lock on a file, which is held until
+// Unlock or the process exits.
+type FileLock struct {
+	fp   *os.File
+	path string
+}
+
+// Unlock releases the lock. It is valid to call Unlock multiple times.
+func (lock *FileLock) Unlock() error {
+	if lock == nil || lock.fp == nil {
+		return nil
+	}
+
+	err := unlockFile(lock.fp)
+	lock.fp.Close()
+	lock.fp = nil
+	return err
+}
+
+// lockStorage locks the storage file of path, so that one process writes
+// it. A read-only storage takes no lock, it can be inspected while it is
+// written.
+func lockStorage(path string, readOnly bool) (*FileLock, error) {
+	if readOnly {
+		return nil, nil
+	}
+	return LockFile(path, false)
+}
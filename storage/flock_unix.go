@@ -0,0 +1,110 @@
+//go:build !windows
+// +build !windows
+
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/yottachain/YTFS/errors"
+)
+
+// LockFile takes an exclusive flock on path, the file is created if it does
+// not exist. If writePID is set, pid of current process is written to the
+// file, so that other processes can tell who holds the lock. It returns
+// *errors.ErrLocked if another process holds the lock.
+func LockFile(path string, writePID bool) (*FileLock, error) {
+	return lockFile(path, syscall.LOCK_EX, writePID)
+}
+
+func lockFile(path string, how int, writePID bool) (*FileLock, error) {
+	flag := os.O_RDONLY
+	if writePID {
+		flag = os.O_RDWR | os.O_CREATE
+	}
+	fp, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(fp.Fd()), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		pid := lockHolderPID(fp)
+		fp.Close()
+		return nil, &errors.ErrLocked{Path: path, PID: pid}
+	}
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+
+	if writePID {
+		fp.Truncate(0)
+		fp.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0)
+		fp.Sync()
+	}
+
+	return &FileLock{fp: fp, path: path}, nil
+}
+
+func unlockFile(fp *os.File) error {
+	return syscall.Flock(int(fp.Fd()), syscall.LOCK_UN)
+}
+
+// lockHolderPID finds the process holding flock of fp from /proc/locks, or
+// from the pid written in the file. It returns 0 if the pid is unknown.
+func lockHolderPID(fp *os.File) int {
+	info, err := fp.Stat()
+	if err != nil {
+		return 0
+	}
+
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		if pid := procLocksPID(uint64(st.Dev), uint64(st.Ino)); pid != 0 {
+			return pid
+		}
+	}
+
+	dat, err := ioutil.ReadAll(fp)
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(dat)))
+	return pid
+}
+
+// procLocksPID looks up a line like below in /proc/locks
+//
+//	1: FLOCK  ADVISORY  WRITE 2355 08:01:1234 0 EOF
+//
+// device is major:minor in hex, followed by inode.
+func procLocksPID(dev, ino uint64) int {
+	fp, err := os.Open("/proc/locks")
+	if err != nil {
+		return 0
+	}
+	defer fp.Close()
+
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+	target := fmt.Sprintf("%02x:%02x:%d", major, minor, ino)
+
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || fields[1] != "FLOCK" {
+			continue
+		}
+		if fields[5] == target {
+			pid, _ := strconv.Atoi(fields[4])
+			return pid
+		}
+	}
+	return 0
+}
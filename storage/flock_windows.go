@@ -0,0 +1,25 @@
+//go:build windows
+// +build windows
+
+package storage
+
+import (
+	"os"
+)
+
+// LockFile opens path without locking, flock is not supported on windows.
+func LockFile(path string, writePID bool) (*FileLock, error) {
+	flag := os.O_RDONLY
+	if writePID {
+		flag = os.O_RDWR | os.O_CREATE
+	}
+	fp, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileLock{fp: fp, path: path}, nil
+}
+
+func unlockFile(fp *os.File) error {
+	return nil
+}
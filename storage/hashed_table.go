@@ -0,0 +1,254 @@
+package storage
+
+import (
+	"encoding/binary"
+	"sort"
+
+	ydcommon "github.com/yottachain/YTFS/common"
+	"github.com/yottachain/YTFS/errors"
+)
+
+// hashed table layout, since index 0.07
+//
+// A table has RangeCoverage slots. A key is saved in its home slot, or in
+// the first free slot after it, wrapping around at the end of the table,
+// and lookup follows the same way until it finds the key or a free slot. A
+// row saves value+1, so a slot of 0 is free. Put writes the row and the
+// size of the table only, Delete frees the slot, and rows after it which
+// would no longer be found are moved back into it one by one, so that no
+// slot is left as a tombstone.
+// +------+--------+--------+--------+-----+
+// | size | slot 0 | slot 1 |  free  | ... |
+// +------+--------+--------+--------+-----+
+
+// hashedProbeRows is the number of slots read at a time by lookup on disk.
+const hashedProbeRows = 16
+
+// homeSlot reports the slot where the key is looked up first. Ranges are
+// routed by the low bits of the hash, so it takes the high bits.
+func (indexFile *YTFSIndexFile) homeSlot(key ydcommon.IndexTableKey) uint32 {
+	return uint32(xxhash64(key[:], indexFile.meta.HashSeed)>>32) % indexFile.meta.RangeCoverage
+}
+
+// decodeSlot decodes a slot of a hashed table, it reports false if the slot
+// is free.
+func (indexFile *YTFSIndexFile) decodeSlot(buf []byte) (ydcommon.IndexItem, bool) {
+	value := binary.LittleEndian.Uint64(buf[16:])
+	if value == 0 {
+		return ydcommon.IndexItem{}, false
+	}
+	return ydcommon.IndexItem{
+		Hash:      ydcommon.IndexTableKey(ydcommon.BytesToHash(buf[:16])),
+		OffsetIdx: ydcommon.IndexTableValue(value - 1),
+	}, true
+}
+
+func (indexFile *YTFSIndexFile) encodeSlot(buf []byte, item ydcommon.IndexItem) {
+	copy(buf, item.Hash[:])
+	binary.LittleEndian.PutUint64(buf[16:], uint64(item.OffsetIdx)+1)
+}
+
+func (indexFile *YTFSIndexFile) slotPos(tbIndex uint32, slot uint32) int64 {
+	return indexFile.tableBeginPos(tbIndex) + 4 + int64(slot)*int64(indexFile.itemSize())
+}
+
+// writeSlot writes item to the slot, or frees the slot if item is nil.
+func (indexFile *YTFSIndexFile) writeSlot(tbIndex uint32, slot uint32, item *ydcommon.IndexItem) error {
+	buf := make([]byte, indexFile.itemSize())
+	if item != nil {
+		indexFile.encodeSlot(buf, *item)
+	}
+	return indexFile.writeAt(buf, indexFile.slotPos(tbIndex, slot))
+}
+
+// loadTableSlots loads a hashed table, rows are sorted by key, and slots
+// tells the slot of each row. It returns ErrIndexCorrupted if the size of
+// the table does not match the slots in use.
+func (indexFile *YTFSIndexFile) loadTableSlots(tbIndex uint32) ([]ydcommon.IndexItem, []uint32, error) {
+	size, err := indexFile.loadTableSize(tbIndex)
+	if err != nil {
+		return nil, nil, err
+	}
+	rows := make([]ydcommon.IndexItem, 0, size)
+	slots := make([]uint32, 0, size)
+	if size == 0 {
+		// slots of an empty table are all freed.
+		return rows, slots, nil
+	}
+
+	buf := make([]byte, indexFile.meta.RangeCoverage*indexFile.itemSize())
+	err = indexFile.readAt(buf, indexFile.slotPos(tbIndex, 0))
+	if err != nil {
+		return nil, nil, err
+	}
+	for slot := uint32(0); slot < indexFile.meta.RangeCoverage; slot++ {
+		if item, ok := indexFile.decodeSlot(buf[slot*indexFile.itemSize():]); ok {
+			rows = append(rows, item)
+			slots = append(slots, slot)
+		}
+	}
+	if uint32(len(rows)) != size {
+		return nil, nil, errors.ErrIndexCorrupted
+	}
+
+	sort.Sort(&slotSorter{rows, slots})
+	return rows, slots, nil
+}
+
+// slotSorter sorts rows by key with their slots.
+type slotSorter struct {
+	rows  []ydcommon.IndexItem
+	slots []uint32
+}
+
+func (s *slotSorter) Len() int {
+	return len(s.rows)
+}
+
+func (s *slotSorter) Less(i, j int) bool {
+	return compareKey(s.rows[i].Hash, s.rows[j].Hash) < 0
+}
+
+func (s *slotSorter) Swap(i, j int) {
+	s.rows[i], s.rows[j] = s.rows[j], s.rows[i]
+	s.slots[i], s.slots[j] = s.slots[j], s.slots[i]
+}
+
+// probeTable looks up the key in a hashed table on disk, slots are read
+// from the home slot of the key until the key or a free slot is found.
+func (indexFile *YTFSIndexFile) probeTable(tbIndex uint32, key ydcommon.IndexTableKey) (ydcommon.IndexTableValue, uint32, error) {
+	size, err := indexFile.loadTableSize(tbIndex)
+	if err != nil {
+		return 0, 0, err
+	}
+	if size == 0 {
+		return 0, 0, errors.ErrDataNotFound
+	}
+
+	m, itemSize := indexFile.meta.RangeCoverage, indexFile.itemSize()
+	slot := indexFile.homeSlot(key)
+	buf := make([]byte, hashedProbeRows*itemSize)
+	for probed := uint32(0); probed < m; {
+		n := m - slot
+		if n > hashedProbeRows {
+			n = hashedProbeRows
+		}
+		err = indexFile.readAt(buf[:n*itemSize], indexFile.slotPos(tbIndex, slot))
+		if err != nil {
+			return 0, 0, err
+		}
+		for i := uint32(0); i < n && probed < m; i, probed = i+1, probed+1 {
+			item, ok := indexFile.decodeSlot(buf[i*itemSize:])
+			if !ok {
+				return 0, size, errors.ErrDataNotFound
+			}
+			if item.Hash == key {
+				return item.OffsetIdx, size, nil
+			}
+		}
+		slot = (slot + n) % m
+	}
+	return 0, size, errors.ErrDataNotFound
+}
+
+// usedSlots reports which slots of a hashed table hold rows, as the row
+// index in table.rows, or -1 if the slot is free.
+func (indexFile *YTFSIndexFile) usedSlots(table *rangeTable) []int {
+	owners := make([]int, indexFile.meta.RangeCoverage)
+	for slot := range owners {
+		owners[slot] = -1
+	}
+	for row, slot := range table.slots {
+		owners[slot] = row
+	}
+	return owners
+}
+
+// insertSlot saves item to the first free slot from its home slot.
+func (indexFile *YTFSIndexFile) insertSlot(tbIndex uint32, table *rangeTable, item ydcommon.IndexItem) error {
+	m := indexFile.meta.RangeCoverage
+	if table.len() >= m {
+		return errors.ErrRangeFull
+	}
+
+	owners := indexFile.usedSlots(table)
+	slot := indexFile.homeSlot(item.Hash)
+	for owners[slot] >= 0 {
+		slot = (slot + 1) % m
+	}
+	err := indexFile.writeSlot(tbIndex, slot, &item)
+	if err != nil {
+		return err
+	}
+
+	pos := table.search(item.Hash)
+	rows := make([]ydcommon.IndexItem, len(table.rows)+1)
+	copy(rows, table.rows[:pos])
+	rows[pos] = item
+	copy(rows[pos+1:], table.rows[pos:])
+	slots := make([]uint32, len(table.slots)+1)
+	copy(slots, table.slots[:pos])
+	slots[pos] = slot
+	copy(slots[pos+1:], table.slots[pos:])
+	return indexFile.updateSlots(tbIndex, table, rows, slots)
+}
+
+// removeSlot frees the slot of a row. Rows after it, up to the next free
+// slot, are moved back to the freed slot unless lookup from their home
+// slots passes it by.
+func (indexFile *YTFSIndexFile) removeSlot(tbIndex uint32, table *rangeTable, row int) error {
+	m := indexFile.meta.RangeCoverage
+	slots := append([]uint32{}, table.slots...)
+	owners := indexFile.usedSlots(table)
+	hole := slots[row]
+	owners[hole] = -1
+
+	for next := (hole + 1) % m; owners[next] >= 0; next = (next + 1) % m {
+		moved := owners[next]
+		home := indexFile.homeSlot(table.rows[moved].Hash)
+		if (next+m-home)%m < (next+m-hole)%m {
+			// home is after the hole, it is found without passing the hole.
+			continue
+		}
+		err := indexFile.writeSlot(tbIndex, hole, &table.rows[moved])
+		if err != nil {
+			return err
+		}
+		slots[moved], owners[hole], owners[next] = hole, moved, -1
+		hole = next
+	}
+	err := indexFile.writeSlot(tbIndex, hole, nil)
+	if err != nil {
+		return err
+	}
+
+	rows := make([]ydcommon.IndexItem, len(table.rows)-1)
+	copy(rows, table.rows[:row])
+	copy(rows[row:], table.rows[row+1:])
+	slots = append(slots[:row], slots[row+1:]...)
+	return indexFile.updateSlots(tbIndex, table, rows, slots)
+}
+
+func (indexFile *YTFSIndexFile) updateSlots(tbIndex uint32, table *rangeTable, rows []ydcommon.IndexItem, slots []uint32) error {
+	err := indexFile.setTableSize(tbIndex, uint32(len(rows)))
+	if err != nil {
+		return err
+	}
+	indexFile.cacheTableRows(tbIndex, table, rows, slots)
+	return nil
+}
+
+// encodeTableSlots lays out rows in slots of a hashed table, as they are
+// saved one by one.
+func (indexFile *YTFSIndexFile) encodeTableSlots(rows []ydcommon.IndexItem) []byte {
+	m, itemSize := indexFile.meta.RangeCoverage, indexFile.itemSize()
+	buf := make([]byte, m*itemSize)
+	for _, item := range rows {
+		slot := indexFile.homeSlot(item.Hash)
+		for binary.LittleEndian.Uint64(buf[slot*itemSize+16:]) != 0 {
+			slot = (slot + 1) % m
+		}
+		indexFile.encodeSlot(buf[slot*itemSize:], item)
+	}
+	return buf
+}
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"encoding/binary"
+	"os"
+	"path"
+	"testing"
+
+	types "github.com/yottachain/YTFS/common"
+	"github.com/yottachain/YTFS/errors"
+)
+
+// keysOfRange makes count keys which are routed to range tbIndex.
+func keysOfRange(indexFile *YTFSIndexFile, tbIndex uint32, count int) []types.IndexTableKey {
+	keys := []types.IndexTableKey{}
+	for i := uint32(0); len(keys) < count; i++ {
+		key := types.IndexTableKey{}
+		binary.BigEndian.PutUint32(key[:], i)
+		if indexFile.getTableEntryIndex(key) == tbIndex {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func noCheck(item types.IndexItem) string {
+	return ""
+}
+
+func TestHashedTablePut(t *testing.T) {
+	indexFile, indexPath, config := openTestIndexFile(t)
+	defer os.RemoveAll(path.Dir(indexPath))
+
+	// fill range 0 and part of overflow table, each put writes a row and the
+	// size of the table, and the overflow pages at most.
+	m := int(indexFile.meta.RangeCoverage)
+	keys := keysOfRange(indexFile, 0, m*3/2)
+	for i, key := range keys {
+		indexFile.begin()
+		err := indexFile.updateTable(key, types.IndexTableValue(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		written := 0
+		for _, w := range indexFile.txn.writes {
+			written += len(w.new)
+		}
+		if written > int(indexFile.itemSize())+8 {
+			t.Fatalf("put %d writes %d bytes", i, written)
+		}
+		err = indexFile.commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// rows after a freed slot are moved back, so they are still found.
+	for i := 0; i < len(keys); i += 3 {
+		_, err := indexFile.Delete(keys[i], 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	result, err := indexFile.CheckTables(noCheck, false)
+	if err != nil || len(result.Problems) != 0 {
+		t.Fatal("problems after delete:", result.Problems, err)
+	}
+	indexFile.Close()
+
+	// slots on disk are looked up without table cache.
+	config.IndexCacheSize = 0
+	indexFile, err = OpenYTFSIndexFile(indexPath, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer indexFile.Close()
+	for i, key := range keys {
+		value, err := indexFile.Get(key)
+		if i%3 == 0 {
+			if err != errors.ErrDataNotFound {
+				t.Fatalf("get deleted %d: %v, %v", i, value, err)
+			}
+			continue
+		}
+		if err != nil || value != types.IndexTableValue(i) {
+			t.Fatalf("get %d: %v, %v", i, value, err)
+		}
+	}
+}
+
+func TestHashedTableCheck(t *testing.T) {
+	indexFile, indexPath, config := openTestIndexFile(t)
+	defer os.RemoveAll(path.Dir(indexPath))
+	indexFile.Close()
+
+	// table cache finds rows wherever they are, lookup on disk does not.
+	config.IndexCacheSize = 0
+	indexFile, err := OpenYTFSIndexFile(indexPath, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer indexFile.Close()
+	m := indexFile.meta.RangeCoverage
+
+	a, b := keysOfRange(indexFile, 0, 1)[0], keysOfRange(indexFile, 1, 1)[0]
+	for i, key := range []types.IndexTableKey{a, b} {
+		err := indexFile.Put(key, types.IndexTableValue(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a is moved beyond a free slot after its home slot, range 1 claims more
+	// rows than its slots.
+	home := indexFile.homeSlot(a)
+	indexFile.writeSlot(0, home, nil)
+	indexFile.writeSlot(0, (home+2)%m, &types.IndexItem{Hash: a, OffsetIdx: 0})
+	if _, err = indexFile.Get(a); err != errors.ErrDataNotFound {
+		t.Fatal("unreachable key is found:", err)
+	}
+	sizeBuf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sizeBuf, 3)
+	indexFile.writeAt(sizeBuf, indexFile.tableBeginPos(1))
+
+	result, err := indexFile.CheckTables(noCheck, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := problemKinds(result)
+	if len(result.Problems) != 2 || kinds[ProblemTableOrder] != 1 || kinds[ProblemTableSize] != 1 {
+		t.Fatal("unexpected problems:", result.Problems)
+	}
+
+	result, err = indexFile.CheckTables(noCheck, false)
+	if err != nil || len(result.Problems) != 0 {
+		t.Fatal("problems are left after repair:", result.Problems, err)
+	}
+	for i, key := range []types.IndexTableKey{a, b} {
+		if value, err := indexFile.Get(key); err != nil || value != types.IndexTableValue(i) {
+			t.Fatalf("get %x: %v, %v", key, value, err)
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	ydcommon "github.com/yottachain/YTFS/common"
+	"github.com/yottachain/YTFS/errors"
+)
+
+// kinds of CheckProblem found in tables
+const (
+	// ProblemTableSize is a table which claims more rows than RangeCoverage,
+	// or a hashed table whose size does not match the slots in use.
+	ProblemTableSize = "tableSize"
+	// ProblemTableOrder is a table whose rows are not sorted, or a hashed
+	// table with a row which lookup from its home slot does not reach.
+	ProblemTableOrder = "tableOrder"
+	// ProblemWrongRange is a key saved in a range it is not routed to.
+	ProblemWrongRange = "wrongRange"
+	// ProblemDuplicateKey is a key saved more than once.
+	ProblemDuplicateKey = "duplicateKey"
+	// ProblemInvalidValue is a value rejected by the caller of CheckTables.
+	ProblemInvalidValue = "invalidValue"
+	// ProblemUnreachable is a key in overflow chain whose range is not full,
+	// Get never finds it.
+	ProblemUnreachable = "unreachable"
+)
+
+// CheckProblem is an inconsistency found by check.
+type CheckProblem struct {
+	Kind   string  `json:"kind"`
+	Table  *uint32 `json:"table,omitempty"` // RangeCapacity and beyond is overflow chain
+	Key    string  `json:"key,omitempty"`
+	Detail string  `json:"detail"`
+	Fixed  bool    `json:"fixed"`
+}
+
+// TableCheck is the result of CheckTables.
+type TableCheck struct {
+	Tables   uint32 // tables checked, overflow chain included
+	Entries  uint64 // valid entries
+	Problems []CheckProblem
+}
+
+type tableChecker struct {
+	indexFile *YTFSIndexFile
+	check     func(item ydcommon.IndexItem) string
+	repair    bool
+	result    TableCheck
+	// valid rows of overflow chain, and their keys.
+	chain        []ydcommon.IndexItem
+	chainKeys    map[ydcommon.IndexTableKey]bool
+	chainChanged bool
+	rangeSizes   []uint32
+}
+
+// CheckTables reads all tables and reports rows which Get can not find, or
+// which are in conflict with others. check tells why an entry is invalid, or
+// "" if it is valid, it is called once for each entry which is neither
+// duplicate nor misplaced.
+//
+// With repair, table sizes beyond RangeCoverage are cut, invalid, duplicate
+// and misplaced rows are dropped, tables are sorted or hashed again, and
+// unreachable keys of overflow chain are moved to their ranges. Of
+// duplicate keys, the one in overflow chain is kept.
+func (indexFile *YTFSIndexFile) CheckTables(check func(item ydcommon.IndexItem) string, repair bool) (*TableCheck, error) {
+	if repair && indexFile.config.ReadOnly {
+		return nil, errors.ErrReadOnly
+	}
+
+	locker, _ := indexFile.store.Lock()
+	defer locker.Unlock()
+	if indexFile.tables != nil {
+		defer indexFile.tables.Purge()
+	}
+
+	c := &tableChecker{
+		indexFile:  indexFile,
+		check:      check,
+		repair:     repair,
+		chainKeys:  map[ydcommon.IndexTableKey]bool{},
+		rangeSizes: make([]uint32, indexFile.meta.RangeCapacity),
+	}
+
+	// overflow chain first, so that keys of ranges are checked against it.
+	for tbIndex := indexFile.meta.RangeCapacity; tbIndex <= indexFile.lastOverflowTable(); tbIndex++ {
+		rows, err := c.checkTable(tbIndex)
+		if err != nil {
+			return nil, err
+		}
+		c.chain = append(c.chain, rows...)
+	}
+	for tbIndex := uint32(0); tbIndex < indexFile.meta.RangeCapacity; tbIndex++ {
+		rows, err := c.checkTable(tbIndex)
+		if err != nil {
+			return nil, err
+		}
+		if c.repair && c.changed(tbIndex) {
+			err = c.rewriteTables([]uint32{tbIndex}, rows)
+			if err != nil {
+				return nil, err
+			}
+		}
+		c.rangeSizes[tbIndex] = uint32(len(rows))
+	}
+
+	err := c.checkUnreachable()
+	if err != nil {
+		return nil, err
+	}
+	if c.repair && c.chainChanged {
+		err = c.rewriteChain()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, size := range c.rangeSizes {
+		c.result.Entries += uint64(size)
+	}
+	c.result.Entries += uint64(len(c.chain))
+	return &c.result, nil
+}
+
+func (c *tableChecker) report(kind string, tbIndex uint32, key *ydcommon.IndexTableKey, detail string) {
+	problem := CheckProblem{Kind: kind, Table: &tbIndex, Detail: detail, Fixed: c.repair}
+	if key != nil {
+		problem.Key = fmt.Sprintf("%x", key[:])
+	}
+	c.result.Problems = append(c.result.Problems, problem)
+}
+
+// changed reports whether problems are found in the table.
+func (c *tableChecker) changed(tbIndex uint32) bool {
+	problems := c.result.Problems
+	return len(problems) > 0 && *problems[len(problems)-1].Table == tbIndex
+}
+
+// checkTable reads a table and reports its problems, it returns the valid
+// rows of the table.
+func (c *tableChecker) checkTable(tbIndex uint32) ([]ydcommon.IndexItem, error) {
+	indexFile := c.indexFile
+	c.result.Tables++
+
+	sizeBuf := make([]byte, 4)
+	err := indexFile.readAt(sizeBuf, indexFile.tableBeginPos(tbIndex))
+	if err != nil {
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(sizeBuf)
+	if size > indexFile.meta.RangeCoverage {
+		c.report(ProblemTableSize, tbIndex, nil, fmt.Sprintf("%d rows, more than %d", size, indexFile.meta.RangeCoverage))
+		size = indexFile.meta.RangeCoverage
+	}
+
+	var rows []ydcommon.IndexItem
+	if indexFile.hashedTables() {
+		rows, err = c.checkSlots(tbIndex, size)
+	} else {
+		buf := make([]byte, size*indexFile.itemSize())
+		err = indexFile.readAt(buf, indexFile.tableBeginPos(tbIndex)+4)
+		rows = indexFile.decodeTableRows(buf)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	overflow := tbIndex >= indexFile.meta.RangeCapacity
+	seen := map[ydcommon.IndexTableKey]bool{}
+	for i := 1; i < len(rows) && indexFile.sortedTables(); i++ {
+		if compareKey(rows[i-1].Hash, rows[i].Hash) > 0 {
+			c.report(ProblemTableOrder, tbIndex, nil, fmt.Sprintf("row %d is out of order", i))
+			break
+		}
+	}
+
+	valid := rows[:0]
+	for _, row := range rows {
+		key := row.Hash
+		if !overflow && indexFile.getTableEntryIndex(key) != tbIndex {
+			c.report(ProblemWrongRange, tbIndex, &key, fmt.Sprintf("key of range %d", indexFile.getTableEntryIndex(key)))
+			continue
+		}
+		if seen[key] || c.chainKeys[key] {
+			c.report(ProblemDuplicateKey, tbIndex, &key, "key is saved again")
+			continue
+		}
+		seen[key] = true
+		if detail := c.check(row); detail != "" {
+			c.report(ProblemInvalidValue, tbIndex, &key, detail)
+			continue
+		}
+		valid = append(valid, row)
+	}
+
+	if overflow {
+		for _, row := range valid {
+			c.chainKeys[row.Hash] = true
+		}
+		if c.changed(tbIndex) {
+			c.chainChanged = true
+		}
+	}
+	return valid, nil
+}
+
+// checkSlots reads all slots of a hashed table, it reports a size other
+// than the slots in use, and rows which lookup does not reach as they are
+// after a free slot from their home slots.
+func (c *tableChecker) checkSlots(tbIndex uint32, size uint32) ([]ydcommon.IndexItem, error) {
+	indexFile := c.indexFile
+	m, itemSize := indexFile.meta.RangeCoverage, indexFile.itemSize()
+	buf := make([]byte, m*itemSize)
+	err := indexFile.readAt(buf, indexFile.slotPos(tbIndex, 0))
+	if err != nil {
+		return nil, err
+	}
+
+	rows := []ydcommon.IndexItem{}
+	used := make([]bool, m)
+	for slot := uint32(0); slot < m; slot++ {
+		if item, ok := indexFile.decodeSlot(buf[slot*itemSize:]); ok {
+			rows = append(rows, item)
+			used[slot] = true
+		}
+	}
+	if uint32(len(rows)) != size && !c.changed(tbIndex) {
+		c.report(ProblemTableSize, tbIndex, nil, fmt.Sprintf("%d rows, %d slots in use", size, len(rows)))
+	}
+
+	for slot := uint32(0); slot < m; slot++ {
+		if !used[slot] {
+			continue
+		}
+		item, _ := indexFile.decodeSlot(buf[slot*itemSize:])
+		for s := indexFile.homeSlot(item.Hash); s != slot; s = (s + 1) % m {
+			if !used[s] {
+				c.report(ProblemTableOrder, tbIndex, nil, fmt.Sprintf("slot %d is not reached from slot %d", slot, indexFile.homeSlot(item.Hash)))
+				return rows, nil
+			}
+		}
+	}
+	return rows, nil
+}
+
+// checkUnreachable finds keys of overflow chain whose range is not full, and
+// moves them to their ranges with repair.
+func (c *tableChecker) checkUnreachable() error {
+	indexFile := c.indexFile
+	moved := map[uint32][]ydcommon.IndexItem{}
+	chain := c.chain[:0]
+	for _, row := range c.chain {
+		key := row.Hash
+		tbIndex := indexFile.getTableEntryIndex(key)
+		if c.rangeSizes[tbIndex] >= indexFile.meta.RangeCoverage {
+			chain = append(chain, row)
+			continue
+		}
+
+		c.report(ProblemUnreachable, indexFile.meta.RangeCapacity, &key, fmt.Sprintf("range %d is not full", tbIndex))
+		if !c.repair {
+			chain = append(chain, row)
+			continue
+		}
+		moved[tbIndex] = append(moved[tbIndex], row)
+		c.rangeSizes[tbIndex]++
+		c.chainChanged = true
+	}
+	c.chain = chain
+
+	for tbIndex, rows := range moved {
+		old, err := indexFile.loadTableRows(tbIndex)
+		if err != nil {
+			return err
+		}
+		err = c.rewriteTables([]uint32{tbIndex}, append(old, rows...))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewriteChain writes rows of overflow chain again, all tables but the last
+// one are full, pages no longer used are freed.
+func (c *tableChecker) rewriteChain() error {
+	indexFile := c.indexFile
+	m := int(indexFile.meta.RangeCoverage)
+	pages := 0
+	if len(c.chain) > 0 {
+		pages = (len(c.chain) - 1) / m
+	}
+
+	tables := []uint32{}
+	for tbIndex := indexFile.meta.RangeCapacity; tbIndex <= indexFile.lastOverflowTable(); tbIndex++ {
+		tables = append(tables, tbIndex)
+	}
+	indexFile.begin()
+	indexFile.meta.OverflowPages = uint32(pages)
+	err := indexFile.writeOverflowPages()
+	if err != nil {
+		indexFile.abort()
+		return err
+	}
+	return c.writeTables(tables, c.chain)
+}
+
+// rewriteTables writes rows to tables, each table is filled before the next.
+func (c *tableChecker) rewriteTables(tables []uint32, rows []ydcommon.IndexItem) error {
+	c.indexFile.begin()
+	return c.writeTables(tables, rows)
+}
+
+func (c *tableChecker) writeTables(tables []uint32, rows []ydcommon.IndexItem) error {
+	indexFile := c.indexFile
+	m := int(indexFile.meta.RangeCoverage)
+	for _, tbIndex := range tables {
+		n := len(rows)
+		if n > m {
+			n = m
+		}
+		tableRows := append([]ydcommon.IndexItem{}, rows[:n]...)
+		rows = rows[n:]
+		if indexFile.sortedTables() {
+			sortTableRows(tableRows)
+		}
+
+		var buf []byte
+		if indexFile.hashedTables() {
+			buf = indexFile.encodeTableSlots(tableRows)
+		} else {
+			buf = indexFile.encodeTableRows(tableRows)
+		}
+		err := indexFile.writeAt(buf, indexFile.tableBeginPos(tbIndex)+4)
+		if err == nil {
+			err = indexFile.setTableSize(tbIndex, uint32(len(tableRows)))
+		}
+		if err != nil {
+			indexFile.abort()
+			return err
+		}
+	}
+	if len(rows) != 0 {
+		indexFile.abort()
+		return errors.ErrRangeFull
+	}
+	return indexFile.commit()
+}
+
+// RecycledSlots reads all data slots in the recycle list.
+func (indexFile *YTFSIndexFile) RecycledSlots() ([]ydcommon.IndexTableValue, error) {
+	locker, _ := indexFile.store.Lock()
+	defer locker.Unlock()
+	return indexFile.recycledSlots()
+}
+
+// ReplaceRecycled saves slots as the recycle list, in place of the current
+// one. The list is written at once in one txn, the last slot is popped
+// first.
+func (indexFile *YTFSIndexFile) ReplaceRecycled(slots []ydcommon.IndexTableValue) error {
+	if indexFile.config.ReadOnly {
+		return errors.ErrReadOnly
+	}
+
+	valueSize := int(indexFile.valueSize())
+	buf := make([]byte, len(slots)*valueSize)
+	for i, slot := range slots {
+		indexFile.encodeValue(buf[i*valueSize:], slot)
+	}
+
+	locker, _ := indexFile.store.Lock()
+	defer locker.Unlock()
+
+	indexFile.begin()
+	if len(buf) != 0 {
+		err := indexFile.writeAt(buf, indexFile.recycleSlotPos(0))
+		if err != nil {
+			indexFile.abort()
+			return err
+		}
+	}
+	indexFile.recycle.count = uint32(len(slots))
+	return indexFile.commit()
+}
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"encoding/binary"
+	"os"
+	"path"
+	"testing"
+
+	types "github.com/yottachain/YTFS/common"
+	"github.com/yottachain/YTFS/errors"
+)
+
+func problemKinds(check *TableCheck) map[string]int {
+	kinds := map[string]int{}
+	for _, problem := range check.Problems {
+		kinds[problem.Kind]++
+	}
+	return kinds
+}
+
+func TestIndexCheckTables(t *testing.T) {
+	// keys are routed by their last 4 bytes before 0.06.
+	indexFile, indexPath, _ := openLegacyIndexFile(t, indexVersionWide)
+	defer os.RemoveAll(path.Dir(indexPath))
+	defer indexFile.Close()
+	m := int(indexFile.meta.RangeCoverage)
+	keyOf := func(i int, tbIndex uint32) types.IndexTableKey {
+		key := rangeKey(i)
+		binary.BigEndian.PutUint32(key[len(key)-4:], tbIndex)
+		return key
+	}
+
+	// range 0 is full, 2 keys in overflow chain, 2 keys in range 1.
+	for i := 0; i < m+2; i++ {
+		err := indexFile.Put(rangeKey(i), types.IndexTableValue(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		err := indexFile.Put(keyOf(i, 1), types.IndexTableValue(m+2+i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// range 0 claims more rows than it holds.
+	sizeBuf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sizeBuf, uint32(m+3))
+	indexFile.writeAt(sizeBuf, indexFile.tableBeginPos(0))
+	// range 1 has a duplicate key, a key of range 0, and an invalid value.
+	rows := []types.IndexItem{
+		{Hash: keyOf(0, 1), OffsetIdx: types.IndexTableValue(m + 2)},
+		{Hash: keyOf(0, 1), OffsetIdx: types.IndexTableValue(m + 2)},
+		{Hash: keyOf(1, 1), OffsetIdx: 9999},
+		{Hash: rangeKey(5), OffsetIdx: 5},
+	}
+	sortTableRows(rows)
+	indexFile.writeAt(indexFile.encodeTableRows(rows), indexFile.tableBeginPos(1)+4)
+	binary.LittleEndian.PutUint32(sizeBuf, uint32(len(rows)))
+	indexFile.writeAt(sizeBuf, indexFile.tableBeginPos(1))
+	// a key of range 2 is in overflow chain, Get never finds it.
+	chain := indexFile.meta.RangeCapacity
+	unreachable := types.IndexItem{Hash: keyOf(0, 2), OffsetIdx: types.IndexTableValue(m + 4)}
+	chainRows, err := indexFile.loadTableRows(chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chainRows = append(chainRows, unreachable)
+	sortTableRows(chainRows)
+	indexFile.writeAt(indexFile.encodeTableRows(chainRows), indexFile.tableBeginPos(chain)+4)
+	binary.LittleEndian.PutUint32(sizeBuf, uint32(len(chainRows)))
+	indexFile.writeAt(sizeBuf, indexFile.tableBeginPos(chain))
+
+	check := func(item types.IndexItem) string {
+		if item.OffsetIdx >= types.IndexTableValue(m+5) {
+			return "beyond data end point"
+		}
+		return ""
+	}
+	expected := map[string]int{
+		ProblemTableSize:    1,
+		ProblemDuplicateKey: 1,
+		ProblemInvalidValue: 1,
+		ProblemWrongRange:   1,
+		ProblemUnreachable:  1,
+	}
+
+	result, err := indexFile.CheckTables(check, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := problemKinds(result)
+	for kind, count := range expected {
+		if kinds[kind] != count {
+			t.Fatalf("%s: %d problems, expected %d: %v", kind, kinds[kind], count, result.Problems)
+		}
+	}
+	if len(result.Problems) != len(expected) || result.Problems[0].Fixed {
+		t.Fatal("unexpected problems:", result.Problems)
+	}
+
+	result, err = indexFile.CheckTables(check, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Problems) != len(expected) || !result.Problems[0].Fixed {
+		t.Fatal("problems are not fixed:", result.Problems)
+	}
+	if result.Entries != uint64(m+4) {
+		t.Fatalf("%d entries, expected %d", result.Entries, m+4)
+	}
+
+	result, err = indexFile.CheckTables(check, false)
+	if err != nil || len(result.Problems) != 0 {
+		t.Fatal("problems are left after repair:", result.Problems, err)
+	}
+	checkRangeKeys(t, indexFile, m+2)
+	for _, item := range []types.IndexItem{rows[0], unreachable} {
+		if value, err := indexFile.Get(item.Hash); err != nil || value != item.OffsetIdx {
+			t.Fatalf("get %x: %v, %v", item.Hash, value, err)
+		}
+	}
+	if _, err := indexFile.Get(keyOf(1, 1)); err != errors.ErrDataNotFound {
+		t.Fatal("invalid row is not dropped:", err)
+	}
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"time"
+)
+
+// FillHistogramBuckets is the number of buckets of IndexStat.FillHistogram,
+// bucket i counts ranges filled [i*10%, (i+1)*10%), and the last one counts
+// full ranges.
+const FillHistogramBuckets = 11
+
+// IndexStat is the fill status and op counters of the index.
+type IndexStat struct {
+	Ranges        uint32 `json:"ranges"`        // N, number of range tables
+	RangeCoverage uint32 `json:"rangeCoverage"` // M, rows a table holds
+	// FillHistogram counts range tables by how full they are.
+	FillHistogram [FillHistogramBuckets]uint32 `json:"fillHistogram"`
+	MinTableSize  uint32                       `json:"minTableSize"`
+	MaxTableSize  uint32                       `json:"maxTableSize"`
+	AvgTableSize  float64                      `json:"avgTableSize"`
+	Entries       uint64                       `json:"entries"` // entries of all tables
+
+	// overflow chain, including pages not allocated yet.
+	OverflowPages    uint32 `json:"overflowPages"`
+	OverflowRows     uint64 `json:"overflowRows"`
+	OverflowCapacity uint64 `json:"overflowCapacity"`
+
+	// op counters since the index is opened.
+	PutCount      uint64 `json:"putCount"`
+	GetCount      uint64 `json:"getCount"`
+	DelCount      uint64 `json:"delCount"`
+	OverflowPuts  uint64 `json:"overflowPuts"`
+	UptimeSeconds int64  `json:"uptimeSeconds"`
+
+	// RangeFullSeconds is the projected time until Put fails with
+	// ErrRangeFull, from the rate of puts to the overflow chain since the
+	// index is opened. It is -1 if nothing has been put to the chain.
+	RangeFullSeconds int64 `json:"rangeFullSeconds"`
+}
+
+// IndexStat reports the fill status and op counters of the index. Sizes of
+// all tables are read from disk for the first time, then kept as they
+// change.
+func (indexFile *YTFSIndexFile) IndexStat() (IndexStat, error) {
+	locker, _ := indexFile.store.Lock()
+	defer locker.Unlock()
+
+	err := indexFile.loadTableSizes()
+	if err != nil {
+		return IndexStat{}, err
+	}
+
+	meta := indexFile.meta
+	stat := IndexStat{
+		Ranges:           meta.RangeCapacity,
+		RangeCoverage:    meta.RangeCoverage,
+		OverflowPages:    meta.OverflowPages,
+		OverflowCapacity: uint64(indexFile.maxOverflowPages()+1) * uint64(meta.RangeCoverage),
+		PutCount:         indexFile.stat.putCount,
+		GetCount:         indexFile.stat.getCount,
+		DelCount:         indexFile.stat.delCount,
+		OverflowPuts:     indexFile.stat.overflowPuts,
+		RangeFullSeconds: -1,
+	}
+
+	stat.MinTableSize = meta.RangeCoverage
+	for _, size := range indexFile.index.sizes[:meta.RangeCapacity] {
+		if size < stat.MinTableSize {
+			stat.MinTableSize = size
+		}
+		if size > stat.MaxTableSize {
+			stat.MaxTableSize = size
+		}
+		bucket := uint64(size) * (FillHistogramBuckets - 1) / uint64(meta.RangeCoverage)
+		stat.FillHistogram[bucket]++
+		stat.Entries += uint64(size)
+	}
+	stat.AvgTableSize = float64(stat.Entries) / float64(meta.RangeCapacity)
+
+	// a page just allocated may not be written yet.
+	for tbIndex := meta.RangeCapacity; tbIndex <= indexFile.lastOverflowTable() && tbIndex < uint32(len(indexFile.index.sizes)); tbIndex++ {
+		stat.OverflowRows += uint64(indexFile.index.sizes[tbIndex])
+	}
+	stat.Entries += stat.OverflowRows
+
+	uptime := time.Since(indexFile.stat.opened)
+	stat.UptimeSeconds = int64(uptime / time.Second)
+	if stat.OverflowPuts != 0 && stat.OverflowCapacity > stat.OverflowRows {
+		rate := float64(stat.OverflowPuts) / uptime.Seconds()
+		stat.RangeFullSeconds = int64(float64(stat.OverflowCapacity-stat.OverflowRows) / rate)
+	} else if stat.OverflowCapacity <= stat.OverflowRows {
+		stat.RangeFullSeconds = 0
+	}
+	return stat, nil
+}
+
+// loadTableSizes reads sizes of all tables which are not read before.
+func (indexFile *YTFSIndexFile) loadTableSizes() error {
+	if indexFile.index.loaded {
+		return nil
+	}
+
+	for tbIndex := uint32(0); tbIndex <= indexFile.lastOverflowTable(); tbIndex++ {
+		size, err := indexFile.loadTableSize(tbIndex)
+		if err != nil {
+			return err
+		}
+		for uint32(len(indexFile.index.sizes)) <= tbIndex {
+			indexFile.index.sizes = append(indexFile.index.sizes, 0)
+		}
+		indexFile.index.sizes[tbIndex] = size
+	}
+	indexFile.index.loaded = true
+	return nil
+}
@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"unsafe"
+
+	ydcommon "github.com/yottachain/YTFS/common"
+	"github.com/yottachain/YTFS/opt"
+)
+
+// index versions
+//
+// Rows of a range table are kept sorted by key since 0.04, so that a key is
+// binary searched. Values, slots of the recycle list and DataEndPoint are
+// 64-bit since 0.05, 0.03 and 0.04 index has 32-bit values. Keys are routed
+// to ranges by xxHash of the whole key with a random seed saved in header
+// since 0.06, index before takes the last 4 bytes of the key. Rows are kept
+// in slots by hash of the key since 0.07, see hashed_table.go, so that Put
+// writes a row instead of moving the rows after it.
+//
+// Index before 0.07 is upgraded when it is opened for write, as rows do not
+// fit in place: its entries are rehashed by RehashIndexFile to a new index
+// of the current version, which has a fresh seed, so keys move to new
+// ranges. Read-only index of any version is used as it is, tables of 0.03
+// are sorted after they are loaded.
+var (
+	indexVersionUnsorted = [4]byte{'0', '.', '0', '3'}
+	indexVersionSorted   = [4]byte{'0', '.', '0', '4'}
+	indexVersionWide     = [4]byte{'0', '.', '0', '5'}
+	indexVersionKeyed    = [4]byte{'0', '.', '0', '6'}
+	indexVersionHashed   = [4]byte{'0', '.', '0', '7'}
+
+	// indexVersionCurrent is the version of new index.
+	indexVersionCurrent = indexVersionHashed
+)
+
+func knownIndexVersion(version [4]byte) bool {
+	return version == indexVersionUnsorted || version == indexVersionSorted || version == indexVersionWide || version == indexVersionKeyed || version == indexVersionHashed
+}
+
+// indexHeaderSize reports the size of header in index of version, HashSeed
+// is not in header before 0.06.
+func indexHeaderSize(version [4]byte) uint32 {
+	if keyedIndexVersion(version) {
+		return uint32(unsafe.Sizeof(ydcommon.Header{}))
+	}
+	return uint32(unsafe.Offsetof(ydcommon.Header{}.HashSeed))
+}
+
+func keyedIndexVersion(version [4]byte) bool {
+	return version == indexVersionKeyed || version == indexVersionHashed
+}
+
+// sortedTables reports whether rows of range tables are sorted on disk.
+func (indexFile *YTFSIndexFile) sortedTables() bool {
+	return indexFile.meta.Version != indexVersionUnsorted && !indexFile.hashedTables()
+}
+
+// hashedTables reports whether rows of range tables are kept in slots by
+// hash of the key.
+func (indexFile *YTFSIndexFile) hashedTables() bool {
+	return indexFile.meta.Version == indexVersionHashed
+}
+
+// indexValueSize reports the size of a value on disk in index of version.
+func indexValueSize(version [4]byte) uint32 {
+	if version == indexVersionWide || version == indexVersionKeyed || version == indexVersionHashed {
+		return 8
+	}
+	return 4
+}
+
+// indexItemSize reports the size of a table row on disk in index of version.
+func indexItemSize(version [4]byte) uint32 {
+	return uint32(len(ydcommon.IndexTableKey{})) + indexValueSize(version)
+}
+
+func (indexFile *YTFSIndexFile) valueSize() uint32 {
+	return indexValueSize(indexFile.meta.Version)
+}
+
+func (indexFile *YTFSIndexFile) itemSize() uint32 {
+	return indexItemSize(indexFile.meta.Version)
+}
+
+func (indexFile *YTFSIndexFile) encodeValue(buf []byte, value ydcommon.IndexTableValue) {
+	if indexFile.valueSize() == 8 {
+		binary.LittleEndian.PutUint64(buf, uint64(value))
+	} else {
+		binary.LittleEndian.PutUint32(buf, uint32(value))
+	}
+}
+
+func (indexFile *YTFSIndexFile) decodeValue(buf []byte) ydcommon.IndexTableValue {
+	if indexFile.valueSize() == 8 {
+		return ydcommon.IndexTableValue(binary.LittleEndian.Uint64(buf))
+	}
+	return ydcommon.IndexTableValue(binary.LittleEndian.Uint32(buf))
+}
+
+// upgradeIndexFile rehashes all entries of indexFile at path to a new index
+// of the current version with the same N and M and a fresh seed, which then
+// replaces it. indexFile is closed, and the
+// new one is opened instead. The old index is left untouched until the new
+// one is complete, so an upgrade broken in the middle is simply done again on
+// the next open.
+func upgradeIndexFile(indexFile *YTFSIndexFile, path string, config *opt.Options) (*YTFSIndexFile, error) {
+	fmt.Println("Upgrade YTFSIndexFile from", string(indexFile.meta.Version[:]), "to", string(indexVersionCurrent[:]))
+	meta := indexFile.meta
+	layout := *config
+	layout.IndexTableRows, layout.IndexTableCols = meta.RangeCapacity, meta.RangeCoverage
+	layout.TotalVolumn, layout.DataBlockSize = meta.YtfsCapability, meta.DataBlockSize
+
+	upgradePath := path + ".upgrade"
+	err := RehashIndexFile(indexFile, upgradePath, &layout)
+	indexFile.Close()
+	if err == nil {
+		err = RenameIndexFile(upgradePath, path, config)
+	}
+	if err != nil {
+		RemoveIndexFile(upgradePath, config)
+		return nil, err
+	}
+	return OpenYTFSIndexFile(path, config)
+}
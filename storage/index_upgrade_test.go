@@ -0,0 +1,248 @@
+package storage
+
+import (
+	"math"
+	"os"
+	"path"
+	"testing"
+
+	types "github.com/yottachain/YTFS/common"
+	"github.com/yottachain/YTFS/opt"
+)
+
+// rangeKey makes keys of range 0, ordered by i.
+func rangeKey(i int) types.IndexTableKey {
+	key := types.IndexTableKey{}
+	key[0], key[1] = byte(i>>8), byte(i)
+	return key
+}
+
+func tablesSorted(t *testing.T, indexFile *YTFSIndexFile) bool {
+	for tbIndex := uint32(0); tbIndex <= indexFile.lastOverflowTable(); tbIndex++ {
+		rows, err := indexFile.loadTableRows(tbIndex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 1; i < len(rows); i++ {
+			if compareKey(rows[i-1].Hash, rows[i].Hash) >= 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func checkRangeKeys(t *testing.T, indexFile *YTFSIndexFile, count int) {
+	for i := 0; i < count; i++ {
+		value, err := indexFile.Get(rangeKey(i))
+		if err != nil || value != types.IndexTableValue(i) {
+			t.Fatalf("get %d: %v, %v", i, value, err)
+		}
+	}
+}
+
+// openLegacyIndexFile creates an index of version as it is created by older
+// releases.
+func openLegacyIndexFile(t *testing.T, version [4]byte) (*YTFSIndexFile, string, *opt.Options) {
+	current := indexVersionCurrent
+	indexVersionCurrent = version
+	defer func() { indexVersionCurrent = current }()
+	return openTestIndexFile(t)
+}
+
+func TestIndexUpgradeSortsTables(t *testing.T) {
+	indexFile, indexPath, config := openLegacyIndexFile(t, indexVersionUnsorted)
+	defer os.RemoveAll(path.Dir(indexPath))
+
+	// fill range 0 and part of overflow table.
+	count := int(indexFile.meta.RangeCoverage) * 3 / 2
+	for i := 0; i < count; i++ {
+		err := indexFile.Put(rangeKey(i), types.IndexTableValue(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// rows of 0.03 index are in the order they are put.
+	for tbIndex := uint32(0); tbIndex <= indexFile.lastOverflowTable(); tbIndex++ {
+		rows, err := indexFile.loadTableRows(tbIndex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+		indexFile.writeAt(indexFile.encodeTableRows(rows), indexFile.tableBeginPos(tbIndex)+4)
+	}
+	indexFile.Close()
+
+	// read-only index of 0.03 is searched as it is.
+	config.ReadOnly = true
+	indexFile, err := OpenYTFSIndexFile(indexPath, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indexFile.sortedTables() || tablesSorted(t, indexFile) {
+		t.Fatal("read-only index is upgraded")
+	}
+	checkRangeKeys(t, indexFile, count)
+	indexFile.Close()
+
+	config.ReadOnly = false
+	config.IndexCacheSize = 0
+	indexFile, err = OpenYTFSIndexFile(indexPath, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer indexFile.Close()
+	if indexFile.meta.Version != indexVersionCurrent || !tablesSorted(t, indexFile) {
+		t.Fatal("index is not upgraded")
+	}
+	checkRangeKeys(t, indexFile, count)
+
+	// rows stay sorted when entries move between range and overflow table.
+	for i := 0; i < count; i += 3 {
+		_, err = indexFile.Delete(rangeKey(i), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !tablesSorted(t, indexFile) {
+		t.Fatal("tables are not sorted after delete")
+	}
+	for i := 0; i < count; i++ {
+		_, err := indexFile.Get(rangeKey(i))
+		if (i%3 == 0) != (err != nil) {
+			t.Fatalf("get %d: %v", i, err)
+		}
+	}
+}
+
+func TestIndexUpgradeWideValues(t *testing.T) {
+	indexFile, indexPath, config := openLegacyIndexFile(t, indexVersionSorted)
+	defer os.RemoveAll(path.Dir(indexPath))
+
+	count := int(indexFile.meta.RangeCoverage) * 3 / 2
+	for i := 0; i < count; i++ {
+		err := indexFile.PutBlocks(rangeKey(i), types.IndexTableValue(i), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := indexFile.Delete(rangeKey(count-1), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexFile.Close()
+
+	indexFile, err = OpenYTFSIndexFile(indexPath, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer indexFile.Close()
+	if indexFile.meta.Version != indexVersionCurrent {
+		t.Fatal("index is not upgraded")
+	}
+	if _, err = os.Stat(indexPath + ".upgrade"); !os.IsNotExist(err) {
+		t.Fatal("upgrade file is left:", err)
+	}
+	checkRangeKeys(t, indexFile, count-1)
+	if indexFile.meta.DataEndPoint != uint64(count) || indexFile.RecycledCount() != 1 {
+		t.Fatal("data end point or recycle list is lost:", indexFile.meta.DataEndPoint, indexFile.RecycledCount())
+	}
+
+	// values and data end point beyond 32 bits.
+	wide := types.IndexTableValue(math.MaxUint32) + 10
+	err = indexFile.PutBlocks(rangeKey(count), wide, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = indexFile.Recycle(wide + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexFile.Close()
+
+	config.ReadOnly = true
+	indexFile, err = OpenYTFSIndexFile(indexPath, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := indexFile.Get(rangeKey(count))
+	if err != nil || value != wide {
+		t.Fatal("get wide value:", value, err)
+	}
+	if indexFile.meta.DataEndPoint != uint64(wide)+1 {
+		t.Fatal("wide data end point:", indexFile.meta.DataEndPoint)
+	}
+	slots, err := indexFile.recycledSlots()
+	if err != nil || slots[len(slots)-1] != wide+1 {
+		t.Fatal("wide recycled slot:", slots, err)
+	}
+}
+
+func TestIndexKeyedHashing(t *testing.T) {
+	indexFile, indexPath, config := openTestIndexFile(t)
+	defer os.RemoveAll(path.Dir(indexPath))
+
+	if !keyedIndexVersion(indexFile.meta.Version) || indexFile.meta.HashSeed == 0 {
+		t.Fatal("new index is not keyed")
+	}
+	// keys sharing trailing bytes are spread.
+	ranges := map[uint32]bool{}
+	for i := 0; i < 64; i++ {
+		ranges[indexFile.getTableEntryIndex(rangeKey(i))] = true
+	}
+	if len(ranges) < 32 {
+		t.Fatalf("keys go to %d ranges only", len(ranges))
+	}
+
+	count := int(indexFile.meta.RangeCoverage)
+	for i := 0; i < count; i++ {
+		err := indexFile.Put(rangeKey(i), types.IndexTableValue(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	seed := indexFile.meta.HashSeed
+	indexFile.Close()
+
+	indexFile, err := OpenYTFSIndexFile(indexPath, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer indexFile.Close()
+	if indexFile.meta.HashSeed != seed {
+		t.Fatal("seed is not saved")
+	}
+	checkRangeKeys(t, indexFile, count)
+}
+
+func TestIndexUpgradeHashesTables(t *testing.T) {
+	indexFile, indexPath, config := openLegacyIndexFile(t, indexVersionWide)
+	defer os.RemoveAll(path.Dir(indexPath))
+
+	// all keys go to range 0 of index before 0.06.
+	count := int(indexFile.meta.RangeCoverage)
+	for i := 0; i < count; i++ {
+		err := indexFile.Put(rangeKey(i), types.IndexTableValue(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	indexFile.Close()
+
+	indexFile, err := OpenYTFSIndexFile(indexPath, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer indexFile.Close()
+	if !indexFile.hashedTables() || indexFile.meta.HashSeed == 0 {
+		t.Fatal("old index is not upgraded")
+	}
+	size, err := indexFile.loadTableSize(0)
+	if err != nil || size == uint32(count) {
+		t.Fatal("keys are not rehashed:", size, err)
+	}
+	checkRangeKeys(t, indexFile, count)
+}
@@ -2,18 +2,23 @@ package storage
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"os"
 
 	// "math"
-	"math/big"
+	"sort"
 	"sync"
+	"time"
 	"unsafe"
 
 	// use eth hash related func.
 	//"github.com/ethereum/go-ethereum/common"
 
+	"github.com/yottachain/YTFS/cache"
 	ydcommon "github.com/yottachain/YTFS/common"
 	"github.com/yottachain/YTFS/errors"
 	"github.com/yottachain/YTFS/opt"
@@ -24,23 +29,36 @@ var (
 )
 
 type rangeTableInfo struct {
-	sizes []uint32 // data len of each table.
+	sizes  []uint32 // data len of each table.
+	loaded bool     // sizes of all tables are read, not only the ones written.
+}
+
+type recycleInfo struct {
+	count uint32 // number of freed data slots saved at RecycleOffset.
+	saved uint32 // count saved to index file.
 }
 
 type indexStatistics struct {
-	putCount uint32
-	delCount uint32
-	getCount uint32
+	putCount uint64
+	delCount uint64
+	getCount uint64
+	// puts to overflow chain, which tell how fast it fills.
+	overflowPuts uint64
+	opened       time.Time
 }
 
 // YTFSIndexFile main struct of YTFS index
 // it defines the read/write logic of index file structure.
 type YTFSIndexFile struct {
-	meta   *ydcommon.Header
-	index  rangeTableInfo
-	store  Storage
-	config *opt.Options
-	stat   indexStatistics
+	meta    *ydcommon.Header
+	index   rangeTableInfo
+	recycle recycleInfo
+	store   Storage
+	config  *opt.Options
+	stat    indexStatistics
+	journal *journal
+	txn     *journalTxn
+	tables  *cache.Manager // decoded range tables, nil if disabled.
 	sync.Mutex
 }
 
@@ -54,350 +72,1015 @@ func (indexFile *YTFSIndexFile) Stat() uint32 {
 	return uint32(indexFile.meta.DataEndPoint)
 }
 
-// Sync syncs all pending meta and unflushed writes
+// Sync syncs all pending meta and unflushed writes. It returns ErrReadOnly
+// if the index is opened read-only.
 func (indexFile *YTFSIndexFile) Sync() error {
 	locker, _ := indexFile.store.Lock()
 	defer locker.Unlock()
+	return indexFile.syncMeta()
+}
 
+func (indexFile *YTFSIndexFile) syncMeta() error {
 	writer, err := indexFile.store.Writer()
+	if err != nil {
+		return err
+	}
+	buf := bytes.NewBuffer(nil)
+	binary.Write(buf, binary.LittleEndian, indexFile.meta)
 	writer.Seek(0, io.SeekStart)
-	err = binary.Write(writer, binary.LittleEndian, &indexFile.meta)
+	_, err = writer.Write(buf.Bytes()[:indexHeaderSize(indexFile.meta.Version)])
 	if err != nil {
 		return err
 	}
 
-	writer.Sync()
-	return nil
+	return indexFile.checkpoint()
 }
 
-// Close closes the YTFSIndexFile.
+// Close closes the YTFSIndexFile, a read-only index is closed without sync.
 func (indexFile *YTFSIndexFile) Close() error {
-	indexFile.Sync()
+	if !indexFile.config.ReadOnly {
+		indexFile.Sync()
+	}
+	if indexFile.journal != nil {
+		indexFile.journal.close()
+	}
 	indexFile.store.Close()
 	return nil
 }
 
 // Format formats the YTFSIndexFile file struct.
 func (indexFile *YTFSIndexFile) Format() error {
-	return indexFile.clearTableFromStorage()
+	if indexFile.config.ReadOnly {
+		return errors.ErrReadOnly
+	}
+
+	locker, _ := indexFile.store.Lock()
+	defer locker.Unlock()
+
+	err := indexFile.clearTableFromStorage()
+	if err != nil {
+		return err
+	}
+
+	indexFile.meta.DataEndPoint = 0
+	indexFile.recycle = recycleInfo{0, 0}
+	err = indexFile.writeRecycleCount()
+	if err != nil {
+		return err
+	}
+	return indexFile.syncMeta()
 }
 
+// getTableEntryIndex routes the key to a range, by xxHash of the key with
+// the seed of the index, or by the last 4 bytes of the key before 0.06.
 func (indexFile *YTFSIndexFile) getTableEntryIndex(key ydcommon.IndexTableKey) uint32 {
-	msb := (uint32)(big.NewInt(0).SetBytes(key[ydcommon.HashLength-4:]).Uint64())
+	if keyedIndexVersion(indexFile.meta.Version) {
+		return uint32(xxhash64(key[:], indexFile.meta.HashSeed)) & (indexFile.meta.RangeCapacity - 1)
+	}
+	msb := binary.BigEndian.Uint32(key[ydcommon.HashLength-4:])
 	return msb & (indexFile.meta.RangeCapacity - 1)
 }
+
+// GetTableEntryIndex reports the range which the key is routed to.
 func (indexFile *YTFSIndexFile) GetTableEntryIndex(key ydcommon.IndexTableKey) uint32 {
-	msb := (uint32)(big.NewInt(0).SetBytes(key[ydcommon.HashLength-4:]).Uint64())
-	return msb & (indexFile.meta.RangeCapacity - 1)
+	return indexFile.getTableEntryIndex(key)
 }
 
 // Get gets IndexTableValue from index table file
 func (indexFile *YTFSIndexFile) Get(key ydcommon.IndexTableKey) (ydcommon.IndexTableValue, error) {
-	locker, _ := indexFile.store.Lock()
-	defer locker.Unlock()
-	idx := indexFile.getTableEntryIndex(key)
-	table, err := indexFile.loadTableFromStorage(idx)
+	return indexFile.GetContext(context.Background(), key)
+}
+
+// GetContext gets IndexTableValue of the key, it gives up if ctx is done
+// before the index file is available.
+func (indexFile *YTFSIndexFile) GetContext(ctx context.Context, key ydcommon.IndexTableKey) (ydcommon.IndexTableValue, error) {
+	locker, err := lockStorageContext(ctx, indexFile.store)
 	if err != nil {
 		return 0, err
 	}
-
-	if value, ok := table[key]; ok {
+	defer locker.Unlock()
+	indexFile.stat.getCount++
+	idx := indexFile.getTableEntryIndex(key)
+	value, size, err := indexFile.lookupTable(idx, key)
+	if err == nil {
 		if debugPrint {
 			fmt.Printf("IndexDB get %x:%x\n", key, value)
 		}
 		return value, nil
 	}
+	if err != errors.ErrDataNotFound {
+		return 0, err
+	}
 
-	// check overflow region if current region is full
-	if uint32(len(table)) == indexFile.meta.RangeCoverage {
-		idx := indexFile.meta.RangeCapacity
-		table, err = indexFile.loadTableFromStorage(idx)
-		if err != nil {
-			return 0, err
-		}
-
-		if value, ok := table[key]; ok {
-			if debugPrint {
-				fmt.Printf("IndexDB get %x:%x @overflow table\n", key, value)
+	// check overflow chain if current region is full
+	if size == indexFile.meta.RangeCoverage {
+		for ofIdx := indexFile.meta.RangeCapacity; ofIdx <= indexFile.lastOverflowTable(); ofIdx++ {
+			value, _, err := indexFile.lookupTable(ofIdx, key)
+			if err == nil {
+				if debugPrint {
+					fmt.Printf("IndexDB get %x:%x @overflow table %d\n", key, value, ofIdx)
+				}
+				return value, nil
+			}
+			if err != errors.ErrDataNotFound {
+				return 0, err
 			}
-			return value, nil
 		}
 	}
 
 	if debugPrint {
-		fmt.Printf("IndexDB get %x failed, from %d-size table\n", key, len(table))
+		fmt.Printf("IndexDB get %x failed, from %d-size table\n", key, size)
 	}
 	return 0, errors.ErrDataNotFound
 }
 
-func (indexFile *YTFSIndexFile) loadTableFromStorage(tbIndex uint32) (map[ydcommon.IndexTableKey]ydcommon.IndexTableValue, error) {
-	reader, _ := indexFile.store.Reader()
-	itemSize := uint32(unsafe.Sizeof(ydcommon.IndexTableKey{}) + unsafe.Sizeof(ydcommon.IndexTableValue(0)))
-	tableAllocationSize := indexFile.meta.RangeCoverage*itemSize + 4
-	reader.Seek(int64(indexFile.meta.HashOffset)+int64(tbIndex)*int64(tableAllocationSize), io.SeekStart)
+// lookupTable finds the key in a table, it reports the table size as well.
+// Without table cache, rows are probed or binary searched on disk, so only a
+// few of them are read.
+func (indexFile *YTFSIndexFile) lookupTable(tbIndex uint32, key ydcommon.IndexTableKey) (ydcommon.IndexTableValue, uint32, error) {
+	if indexFile.tables == nil && indexFile.hashedTables() {
+		return indexFile.probeTable(tbIndex, key)
+	}
+	if indexFile.tables != nil || !indexFile.sortedTables() {
+		table, err := indexFile.loadTable(tbIndex)
+		if err != nil {
+			return 0, 0, err
+		}
+		if value, ok := table.get(key); ok {
+			return value, table.len(), nil
+		}
+		return 0, table.len(), errors.ErrDataNotFound
+	}
 
-	// read len of table
-	sizeBuf := make([]byte, 4)
-	reader.Read(sizeBuf)
-	tableSize := binary.LittleEndian.Uint32(sizeBuf)
-	if debugPrint {
-		fmt.Println("read table size :=", tableSize, "from", int64(indexFile.meta.HashOffset)+int64(tbIndex)*int64(tableAllocationSize))
+	size, err := indexFile.loadTableSize(tbIndex)
+	if err != nil {
+		return 0, 0, err
 	}
 
-	// read table contents
-	tableBuf := make([]byte, tableSize*itemSize, tableSize*itemSize)
-	_, err := reader.Read(tableBuf)
+	var item ydcommon.IndexItem
+	row := sort.Search(int(size), func(i int) bool {
+		if err != nil {
+			return true
+		}
+		item, err = indexFile.loadTableRow(tbIndex, uint32(i))
+		return compareKey(item.Hash, key) >= 0
+	})
 	if err != nil {
-		return nil, err
+		return 0, 0, err
 	}
+	if row < int(size) {
+		item, err = indexFile.loadTableRow(tbIndex, uint32(row))
+		if err != nil {
+			return 0, 0, err
+		}
+		if item.Hash == key {
+			return item.OffsetIdx, size, nil
+		}
+	}
+	return 0, size, errors.ErrDataNotFound
+}
 
-	table := map[ydcommon.IndexTableKey]ydcommon.IndexTableValue{}
-	for i := uint32(0); i < tableSize; i++ {
-		key := ydcommon.BytesToHash(tableBuf[i*itemSize : i*itemSize+16])
-		value := binary.LittleEndian.Uint32(tableBuf[i*itemSize+16 : i*itemSize+20][:])
-		table[ydcommon.IndexTableKey(key)] = ydcommon.IndexTableValue(value)
+func (indexFile *YTFSIndexFile) loadTableFromStorage(tbIndex uint32) (map[ydcommon.IndexTableKey]ydcommon.IndexTableValue, error) {
+	rows, err := indexFile.loadTableRows(tbIndex)
+	if err != nil {
+		return nil, err
 	}
 
+	table := make(map[ydcommon.IndexTableKey]ydcommon.IndexTableValue, len(rows))
+	for _, row := range rows {
+		table[row.Hash] = row.OffsetIdx
+	}
 	return table, nil
 }
 
 func (indexFile *YTFSIndexFile) clearTableFromStorage() error {
-	writer, _ := indexFile.store.Writer()
-	itemSize := uint32(unsafe.Sizeof(ydcommon.IndexTableKey{}) + unsafe.Sizeof(ydcommon.IndexTableValue(0)))
-	tableAllocationSize := indexFile.meta.RangeCoverage*itemSize + 4
-	valueBuf := make([]byte, 4)
+	// +1 for overflow region, and overflow pages follow.
+	for tbIndex := uint32(0); tbIndex <= indexFile.lastOverflowTable(); tbIndex++ {
+		err := indexFile.clearTable(tbIndex)
+		if err != nil {
+			return err
+		}
+	}
+	if indexFile.tables != nil {
+		indexFile.tables.Purge()
+	}
+	indexFile.meta.OverflowPages = 0
+	return indexFile.writeOverflowPages()
+}
 
-	for tbIndex := uint32(0); tbIndex < indexFile.meta.RangeCapacity; tbIndex++ {
-		writer.Seek(int64(indexFile.meta.HashOffset)+int64(tbIndex)*int64(tableAllocationSize), io.SeekStart)
-		tableSize := 0
-		binary.LittleEndian.PutUint32(valueBuf, uint32(tableSize))
-		_, err := writer.Write(valueBuf)
+// clearTable removes all rows of a table, slots of a hashed table are freed
+// unless the table is empty.
+func (indexFile *YTFSIndexFile) clearTable(tbIndex uint32) error {
+	if indexFile.hashedTables() {
+		sizeBuf := make([]byte, 4)
+		err := indexFile.readAt(sizeBuf, indexFile.tableBeginPos(tbIndex))
 		if err != nil {
 			return err
 		}
+		if binary.LittleEndian.Uint32(sizeBuf) != 0 {
+			err = indexFile.writeAt(make([]byte, indexFile.meta.RangeCoverage*indexFile.itemSize()), indexFile.slotPos(tbIndex, 0))
+			if err != nil {
+				return err
+			}
+		}
 	}
-	return nil
+	return indexFile.setTableSize(tbIndex, 0)
 }
 
 // Put saves a key value pair.
 func (indexFile *YTFSIndexFile) Put(key ydcommon.IndexTableKey, value ydcommon.IndexTableValue) error {
+	return indexFile.PutBlocks(key, value, 1)
+}
+
+// PutBlocks saves a key value pair, the value takes blocks consecutive data
+// slots.
+func (indexFile *YTFSIndexFile) PutBlocks(key ydcommon.IndexTableKey, value ydcommon.IndexTableValue, blocks uint32) error {
+	if indexFile.config.ReadOnly {
+		return errors.ErrReadOnly
+	}
+
 	locker, _ := indexFile.store.Lock()
 	defer locker.Unlock()
 
-	idx := indexFile.getTableEntryIndex(key)
-	table, err := indexFile.loadTableFromStorage(idx)
+	indexFile.begin()
+	err := indexFile.updateTable(key, value)
+	if err == nil {
+		indexFile.extendDataEndPoint(uint64(value) + uint64(blocks))
+		err = indexFile.writeDataEndPoint()
+	}
 	if err != nil {
+		indexFile.abort()
 		return err
 	}
 
-	if _, ok := table[key]; ok {
-		return errors.ErrConflict
+	err = indexFile.commit()
+	if err != nil {
+		return err
 	}
 
-	rowCount := uint32(len(table))
-	if rowCount >= indexFile.meta.RangeCoverage {
-		// move to overflow region
-		idx = indexFile.meta.RangeCapacity
-		table, err = indexFile.loadTableFromStorage(idx)
+	indexFile.stat.putCount++
+	return indexFile.syncPeriodically(uint32(indexFile.stat.putCount))
+}
+
+// BatchPut saves a key value pair.
+// If any key conflicts, nothing is saved and the conflicts are reported.
+func (indexFile *YTFSIndexFile) BatchPut(kvPairs []ydcommon.IndexItem) (map[ydcommon.IndexTableKey]byte, error) {
+	return indexFile.BatchPutBlocks(kvPairs, 0)
+}
+
+// BatchPutBlocks is BatchPut of values which may take multiple data slots,
+// all the slots are below dataEnd.
+func (indexFile *YTFSIndexFile) BatchPutBlocks(kvPairs []ydcommon.IndexItem, dataEnd uint64) (map[ydcommon.IndexTableKey]byte, error) {
+	if indexFile.config.ReadOnly {
+		return nil, errors.ErrReadOnly
+	}
+
+	locker, _ := indexFile.store.Lock()
+	defer locker.Unlock()
+
+	indexFile.begin()
+	conflicts := map[ydcommon.IndexTableKey]byte{}
+	for _, kvPair := range kvPairs {
+		err := indexFile.updateTable(kvPair.Hash, kvPair.OffsetIdx)
 		if err != nil {
-			return err
-		}
-		rowCount := uint32(len(table))
-		if rowCount >= indexFile.meta.RangeCoverage {
-			return errors.ErrRangeFull
+			if err == errors.ErrConflict {
+				conflicts[kvPair.Hash] = 1
+			} else {
+				indexFile.abort()
+				return nil, err
+			}
 		}
 	}
 
-	// write cnt
-	writer, _ := indexFile.store.Writer()
-	itemSize := uint32(unsafe.Sizeof(ydcommon.IndexTableKey{}) + unsafe.Sizeof(ydcommon.IndexTableValue(0)))
-	tableAllocationSize := indexFile.meta.RangeCoverage*itemSize + 4
-	tableBeginPos := int64(indexFile.meta.HashOffset) + int64(idx)*int64(tableAllocationSize)
+	if len(conflicts) != 0 {
+		indexFile.abort()
+		return conflicts, errors.ErrConflict
+	}
 
-	valueBuf := make([]byte, 4)
-	writer.Seek(tableBeginPos, io.SeekStart)
-	tableSize := uint32(len(table)) + 1
-	binary.LittleEndian.PutUint32(valueBuf, uint32(tableSize))
-	_, err = writer.Write(valueBuf)
+	indexFile.extendDataEndPoint(dataEnd)
+	err := indexFile.writeDataEndPoint()
 	if err != nil {
-		return err
+		indexFile.abort()
+		return nil, err
 	}
 
-	// write new item
-	tableItemPos := tableBeginPos + 4 + int64(len(table))*int64(itemSize)
-	writer.Seek(tableItemPos, io.SeekStart)
-	_, err = writer.Write(key[:])
+	err = indexFile.commit()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	binary.LittleEndian.PutUint32(valueBuf, uint32(value))
-	_, err = writer.Write(valueBuf)
+	indexFile.stat.putCount++
+	return nil, indexFile.syncPeriodically(uint32(indexFile.stat.putCount))
+}
+
+func (indexFile *YTFSIndexFile) updateTable(key ydcommon.IndexTableKey, value ydcommon.IndexTableValue) error {
+	idx := indexFile.getTableEntryIndex(key)
+	table, err := indexFile.loadTable(idx)
 	if err != nil {
 		return err
 	}
 
-	indexFile.index.sizes[idx] = tableSize
-	indexFile.meta.DataEndPoint++
-	binary.LittleEndian.PutUint32(valueBuf, uint32(indexFile.meta.DataEndPoint))
-	header := indexFile.meta
-	writer.Seek(int64(unsafe.Offsetof(header.DataEndPoint)), io.SeekStart)
-	_, err = writer.Write(valueBuf)
+	if _, ok := table.get(key); ok {
+		return errors.ErrConflict
+	}
+
+	if table.len() >= indexFile.meta.RangeCoverage {
+		// move to overflow chain
+		idx, table, err = indexFile.overflowTable()
+		if err != nil {
+			return err
+		}
+		indexFile.stat.overflowPuts++
+	}
+
+	err = indexFile.insertTableRow(idx, table, ydcommon.IndexItem{Hash: key, OffsetIdx: value})
 	if err != nil {
 		return err
 	}
 
+	indexFile.extendDataEndPoint(uint64(value) + 1)
+
 	if debugPrint {
 		fmt.Printf("IndexDB put %x:%x\n", key, value)
 	}
+	return nil
+}
 
-	if (indexFile.stat.putCount & (indexFile.config.SyncPeriod - 1)) == 0 {
-		writer.Sync()
+// extendDataEndPoint moves DataEndPoint to end if it is beyond, value below
+// DataEndPoint is a reused slot from the recycle list.
+func (indexFile *YTFSIndexFile) extendDataEndPoint(end uint64) {
+	if end > indexFile.meta.DataEndPoint {
+		indexFile.meta.DataEndPoint = end
 	}
-	return err
 }
 
-// BatchPut saves a key value pair.
-func (indexFile *YTFSIndexFile) BatchPut(kvPairs []ydcommon.IndexItem) (map[ydcommon.IndexTableKey]byte, error) {
+func (indexFile *YTFSIndexFile) writeDataEndPoint() error {
+	valueBuf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(valueBuf, indexFile.meta.DataEndPoint)
+	header := indexFile.meta
+	return indexFile.writeAt(valueBuf, int64(unsafe.Offsetof(header.DataEndPoint)))
+}
+
+// Delete removes the key from index table and saves its data slots to the
+// recycle list, so the slots can be reused by later Put. blocks is the number
+// of consecutive data slots the value takes. It returns the removed value, or
+// ErrDataNotFound if the key does not exist.
+func (indexFile *YTFSIndexFile) Delete(key ydcommon.IndexTableKey, blocks uint32) (ydcommon.IndexTableValue, error) {
+	if indexFile.config.ReadOnly {
+		return 0, errors.ErrReadOnly
+	}
+
 	locker, _ := indexFile.store.Lock()
 	defer locker.Unlock()
 
-	dataWritten := uint64(0)
-	conflicts := map[ydcommon.IndexTableKey]byte{}
-	for _, kvPair := range kvPairs {
-		err := indexFile.updateTable(kvPair.Hash, kvPair.OffsetIdx)
+	indexFile.begin()
+	value, err := indexFile.deleteKey(key)
+	for i := uint32(0); i < blocks && err == nil; i++ {
+		err = indexFile.pushRecycled(value + ydcommon.IndexTableValue(i))
+	}
+	if err != nil {
+		indexFile.abort()
+		return 0, err
+	}
+
+	err = indexFile.commit()
+	if err != nil {
+		return 0, err
+	}
+
+	if debugPrint {
+		fmt.Printf("IndexDB del %x:%x\n", key, value)
+	}
+
+	indexFile.stat.delCount++
+	return value, indexFile.syncPeriodically(uint32(indexFile.stat.delCount))
+}
+
+func (indexFile *YTFSIndexFile) deleteKey(key ydcommon.IndexTableKey) (ydcommon.IndexTableValue, error) {
+	idx := indexFile.getTableEntryIndex(key)
+	table, err := indexFile.loadTable(idx)
+	if err != nil {
+		return 0, err
+	}
+
+	if row := table.find(key); row >= 0 {
+		value := table.rows[row].OffsetIdx
+		return value, indexFile.removeRangeRow(idx, table, row)
+	}
+
+	if table.len() < indexFile.meta.RangeCoverage {
+		return 0, errors.ErrDataNotFound
+	}
+
+	// full range may have spilled the key to overflow chain.
+	ofTable, ofIdx, row, err := indexFile.findOverflowRow(key)
+	if err != nil {
+		return 0, err
+	}
+	if row < 0 {
+		return 0, errors.ErrDataNotFound
+	}
+	value := ofTable.rows[row].OffsetIdx
+	return value, indexFile.removeOverflowRow(ofIdx, ofTable, row)
+}
+
+// removeRangeRow removes a row from a range table. If the range was full, one
+// of its entries may live in overflow chain, and it is moved back to the
+// range table, so that Get which only looks at overflow chain of full ranges
+// can still find it.
+func (indexFile *YTFSIndexFile) removeRangeRow(idx uint32, table *rangeTable, row int) error {
+	if table.len() == indexFile.meta.RangeCoverage {
+		ofTable, ofIdx, ofRow, err := indexFile.findOverflowRange(idx)
 		if err != nil {
-			if err == errors.ErrConflict {
-				conflicts[kvPair.Hash] = 1
-			} else {
-				return nil, err
+			return err
+		}
+		if ofRow >= 0 {
+			err = indexFile.replaceTableRow(idx, table, row, ofTable.rows[ofRow])
+			if err != nil {
+				return err
 			}
+			return indexFile.removeOverflowRow(ofIdx, ofTable, ofRow)
 		}
+	}
+
+	return indexFile.removeTableRow(idx, table, row)
+}
 
-		dataWritten++
+// insertTableRow inserts item to the table, rows after it are moved forward
+// to keep the table sorted, or item takes a free slot of a hashed table.
+func (indexFile *YTFSIndexFile) insertTableRow(tbIndex uint32, table *rangeTable, item ydcommon.IndexItem) error {
+	if indexFile.hashedTables() {
+		return indexFile.insertSlot(tbIndex, table, item)
 	}
+	pos := table.search(item.Hash)
+	rows := make([]ydcommon.IndexItem, len(table.rows)+1)
+	copy(rows, table.rows[:pos])
+	rows[pos] = item
+	copy(rows[pos+1:], table.rows[pos:])
+	return indexFile.writeTableRows(tbIndex, table, rows, pos)
+}
 
-	if len(conflicts) != 0 {
-		return conflicts, errors.ErrConflict
+// removeTableRow removes a row from the table, rows after it are moved
+// backward.
+func (indexFile *YTFSIndexFile) removeTableRow(tbIndex uint32, table *rangeTable, row int) error {
+	if indexFile.hashedTables() {
+		return indexFile.removeSlot(tbIndex, table, row)
 	}
+	rows := make([]ydcommon.IndexItem, len(table.rows)-1)
+	copy(rows, table.rows[:row])
+	copy(rows[row:], table.rows[row+1:])
+	return indexFile.writeTableRows(tbIndex, table, rows, row)
+}
 
-	return nil, indexFile.updateMeta(dataWritten)
+// replaceTableRow removes a row from the table and inserts item, the table
+// size is not changed.
+func (indexFile *YTFSIndexFile) replaceTableRow(tbIndex uint32, table *rangeTable, row int, item ydcommon.IndexItem) error {
+	if indexFile.hashedTables() {
+		err := indexFile.removeSlot(tbIndex, table, row)
+		if err != nil {
+			return err
+		}
+		return indexFile.insertSlot(tbIndex, table, item)
+	}
+	rows := make([]ydcommon.IndexItem, 0, len(table.rows))
+	rows = append(rows, table.rows[:row]...)
+	rows = append(rows, table.rows[row+1:]...)
+
+	pos := sort.Search(len(rows), func(i int) bool {
+		return compareKey(rows[i].Hash, item.Hash) >= 0
+	})
+	rows = append(rows, ydcommon.IndexItem{})
+	copy(rows[pos+1:], rows[pos:])
+	rows[pos] = item
+
+	if pos > row {
+		pos = row
+	}
+	return indexFile.writeTableRows(tbIndex, table, rows, pos)
 }
 
-func (indexFile *YTFSIndexFile) updateMeta(dataWritten uint64) error {
-	indexFile.meta.DataEndPoint += dataWritten
-	valueBuf := make([]byte, 4)
-	writer, _ := indexFile.store.Writer()
-	binary.LittleEndian.PutUint32(valueBuf, uint32(indexFile.meta.DataEndPoint))
-	header := indexFile.meta
-	writer.Seek(int64(unsafe.Offsetof(header.DataEndPoint)), io.SeekStart)
-	_, err := writer.Write(valueBuf)
+func (indexFile *YTFSIndexFile) tableAllocationSize() uint32 {
+	return indexFile.meta.RangeCoverage*indexFile.itemSize() + 4
+}
+
+// tableBeginPos reports where the table begins, table beyond RangeCapacity
+// is an overflow page.
+func (indexFile *YTFSIndexFile) tableBeginPos(tbIndex uint32) int64 {
+	if tbIndex > indexFile.meta.RangeCapacity {
+		page := tbIndex - indexFile.meta.RangeCapacity - 1
+		return indexFile.overflowPageOffset() + int64(page)*int64(indexFile.tableAllocationSize())
+	}
+	return int64(indexFile.meta.HashOffset) + int64(tbIndex)*int64(indexFile.tableAllocationSize())
+}
+
+// loadTableSize reads the number of rows of a table.
+func (indexFile *YTFSIndexFile) loadTableSize(tbIndex uint32) (uint32, error) {
+	tableBeginPos := indexFile.tableBeginPos(tbIndex)
+	sizeBuf := make([]byte, 4)
+	err := indexFile.readAt(sizeBuf, tableBeginPos)
+	if err != nil {
+		return 0, err
+	}
+	tableSize := binary.LittleEndian.Uint32(sizeBuf)
+	if debugPrint {
+		fmt.Println("read table size :=", tableSize, "from", tableBeginPos)
+	}
+	if tableSize > indexFile.meta.RangeCoverage {
+		return 0, errors.ErrIndexCorrupted
+	}
+	return tableSize, nil
+}
+
+// loadTableRows loads a table as rows in their on-disk order, rows of a
+// hashed table are sorted.
+func (indexFile *YTFSIndexFile) loadTableRows(tbIndex uint32) ([]ydcommon.IndexItem, error) {
+	if indexFile.hashedTables() {
+		rows, _, err := indexFile.loadTableSlots(tbIndex)
+		return rows, err
+	}
+	tableSize, err := indexFile.loadTableSize(tbIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	// read table contents
+	tableBuf := make([]byte, tableSize*indexFile.itemSize())
+	err = indexFile.readAt(tableBuf, indexFile.tableBeginPos(tbIndex)+4)
+	if err != nil {
+		return nil, err
+	}
+	return indexFile.decodeTableRows(tableBuf), nil
+}
+
+// loadTableRow reads a row of the table.
+func (indexFile *YTFSIndexFile) loadTableRow(tbIndex uint32, row uint32) (ydcommon.IndexItem, error) {
+	buf := make([]byte, indexFile.itemSize())
+	err := indexFile.readAt(buf, indexFile.tableBeginPos(tbIndex)+4+int64(row)*int64(indexFile.itemSize()))
+	if err != nil {
+		return ydcommon.IndexItem{}, err
+	}
+	return indexFile.decodeTableRows(buf)[0], nil
+}
+
+// writeTableRows writes rows as the new content of the table, rows before
+// row lo are not changed.
+func (indexFile *YTFSIndexFile) writeTableRows(tbIndex uint32, table *rangeTable, rows []ydcommon.IndexItem, lo int) error {
+	err := indexFile.writeAt(indexFile.encodeTableRows(rows[lo:]), indexFile.tableBeginPos(tbIndex)+4+int64(lo)*int64(indexFile.itemSize()))
 	if err != nil {
 		return err
 	}
 
-	if (indexFile.stat.putCount & (indexFile.config.SyncPeriod - 1)) == 0 {
-		err = writer.Sync()
+	if len(rows) != len(table.rows) {
+		err = indexFile.setTableSize(tbIndex, uint32(len(rows)))
 		if err != nil {
 			return err
 		}
 	}
+
+	indexFile.cacheTableRows(tbIndex, table, rows, nil)
 	return nil
 }
 
-func (indexFile *YTFSIndexFile) updateTable(key ydcommon.IndexTableKey, value ydcommon.IndexTableValue) error {
-	idx := indexFile.getTableEntryIndex(key)
-	table, err := indexFile.loadTableFromStorage(idx)
+// index table row layout, value is 8 bytes since 0.05, 4 bytes before.
+// +-----+-------+
+// | key | value |
+// +-----+-------+
+func (indexFile *YTFSIndexFile) decodeTableRows(buf []byte) []ydcommon.IndexItem {
+	itemSize := indexFile.itemSize()
+	rows := make([]ydcommon.IndexItem, uint32(len(buf))/itemSize)
+	for i := range rows {
+		row := buf[uint32(i)*itemSize:]
+		rows[i] = ydcommon.IndexItem{
+			Hash:      ydcommon.IndexTableKey(ydcommon.BytesToHash(row[:16])),
+			OffsetIdx: indexFile.decodeValue(row[16:]),
+		}
+	}
+	return rows
+}
+
+func (indexFile *YTFSIndexFile) encodeTableRows(rows []ydcommon.IndexItem) []byte {
+	itemSize := indexFile.itemSize()
+	buf := make([]byte, uint32(len(rows))*itemSize)
+	for i, item := range rows {
+		row := buf[uint32(i)*itemSize:]
+		copy(row, item.Hash[:])
+		indexFile.encodeValue(row[16:], item.OffsetIdx)
+	}
+	return buf
+}
+
+func (indexFile *YTFSIndexFile) setTableSize(tbIndex uint32, size uint32) error {
+	valueBuf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(valueBuf, size)
+	err := indexFile.writeAt(valueBuf, indexFile.tableBeginPos(tbIndex))
 	if err != nil {
 		return err
 	}
 
-	if _, ok := table[key]; ok {
-		return errors.ErrConflict
+	for uint32(len(indexFile.index.sizes)) <= tbIndex {
+		indexFile.index.sizes = append(indexFile.index.sizes, 0)
 	}
+	if txn := indexFile.txn; txn != nil {
+		if _, ok := txn.oldSizes[tbIndex]; !ok {
+			txn.oldSizes[tbIndex] = indexFile.index.sizes[tbIndex]
+		}
+	}
+	indexFile.index.sizes[tbIndex] = size
+	return nil
+}
 
-	rowCount := uint32(len(table))
-	if rowCount >= indexFile.meta.RangeCoverage {
-		// move to overflow region
-		idx = indexFile.meta.RangeCapacity
-		table, err = indexFile.loadTableFromStorage(idx)
+// readAt reads index file at off. Writes of current txn, which are not
+// applied yet, are visible to the reader. Region never written reads as 0.
+func (indexFile *YTFSIndexFile) readAt(buf []byte, off int64) error {
+	reader, _ := indexFile.store.Reader()
+	n, err := reader.ReadAt(buf, off)
+	if err == io.EOF {
+		for i := n; i < len(buf); i++ {
+			buf[i] = 0
+		}
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if txn := indexFile.txn; txn != nil {
+		end := off + int64(len(buf))
+		for _, w := range txn.writes {
+			wEnd := w.offset + int64(len(w.new))
+			if w.offset < end && off < wEnd {
+				begin, stop := off, end
+				if w.offset > begin {
+					begin = w.offset
+				}
+				if wEnd < stop {
+					stop = wEnd
+				}
+				copy(buf[begin-off:stop-off], w.new[begin-w.offset:stop-w.offset])
+			}
+		}
+	}
+	return nil
+}
+
+// writeAt writes data to index file at off. Inside a txn the write is
+// delayed until the txn commits.
+func (indexFile *YTFSIndexFile) writeAt(data []byte, off int64) error {
+	if indexFile.txn == nil {
+		writer, err := indexFile.store.Writer()
 		if err != nil {
 			return err
 		}
-		rowCount := uint32(len(table))
-		if rowCount >= indexFile.meta.RangeCoverage {
-			return errors.ErrRangeFull
+		_, err = writer.Seek(off, io.SeekStart)
+		if err != nil {
+			return err
 		}
+		_, err = writer.Write(data)
+		return err
+	}
+
+	old := make([]byte, len(data))
+	err := indexFile.readAt(old, off)
+	if err != nil {
+		return err
 	}
+	indexFile.txn.writes = append(indexFile.txn.writes, journalWrite{off, old, ydcommon.CopyBytes(data)})
+	return nil
+}
 
-	// write cnt
-	writer, _ := indexFile.store.Writer()
-	itemSize := uint32(unsafe.Sizeof(ydcommon.IndexTableKey{}) + unsafe.Sizeof(ydcommon.IndexTableValue(0)))
-	tableAllocationSize := indexFile.meta.RangeCoverage*itemSize + 4
-	tableBeginPos := int64(indexFile.meta.HashOffset) + int64(idx)*int64(tableAllocationSize)
+// begin starts a txn, writes to index file are collected until commit.
+func (indexFile *YTFSIndexFile) begin() {
+	indexFile.txn = &journalTxn{
+		writes:   []journalWrite{},
+		meta:     *indexFile.meta,
+		recycle:  indexFile.recycle,
+		oldSizes: map[uint32]uint32{},
+		tables:   map[uint32]bool{},
+	}
+}
 
-	valueBuf := make([]byte, 4)
-	writer.Seek(tableBeginPos, io.SeekStart)
-	tableSize := uint32(len(table)) + 1
-	binary.LittleEndian.PutUint32(valueBuf, uint32(tableSize))
-	_, err = writer.Write(valueBuf)
+// abort drops current txn and restores in-memory status changed by it.
+func (indexFile *YTFSIndexFile) abort() {
+	txn := indexFile.txn
+	indexFile.txn = nil
+	*indexFile.meta = txn.meta
+	indexFile.recycle = txn.recycle
+	for tbIndex, size := range txn.oldSizes {
+		indexFile.index.sizes[tbIndex] = size
+	}
+	for tbIndex := range txn.tables {
+		if indexFile.tables != nil {
+			indexFile.tables.Remove(tbIndex)
+		}
+	}
+}
+
+// commit saves current txn to journal, then applies it to index file. Once
+// applied the txn succeeds, even if its commit mark can not be written.
+func (indexFile *YTFSIndexFile) commit() error {
+	if indexFile.recycle.count != indexFile.recycle.saved {
+		err := indexFile.writeRecycleCount()
+		if err != nil {
+			indexFile.abort()
+			return err
+		}
+	}
+
+	txn := indexFile.txn
+	if len(txn.writes) == 0 {
+		indexFile.txn = nil
+		return nil
+	}
+
+	writer, err := indexFile.store.Writer()
 	if err != nil {
+		indexFile.abort()
 		return err
 	}
 
-	// write new item
-	tableItemPos := tableBeginPos + 4 + int64(len(table))*int64(itemSize)
-	writer.Seek(tableItemPos, io.SeekStart)
-	_, err = writer.Write(key[:])
+	seq := uint64(0)
+	if indexFile.journal != nil {
+		seq, err = indexFile.journal.prepare(txn.writes)
+		if err != nil {
+			indexFile.abort()
+			return err
+		}
+	}
+
+	indexFile.txn = nil
+	err = applyJournalWrites(writer, txn.writes, false)
 	if err != nil {
+		applyJournalWrites(writer, txn.writes, true)
+		if indexFile.journal != nil {
+			indexFile.journal.abort(seq)
+		}
+		indexFile.txn = txn
+		indexFile.abort()
 		return err
 	}
 
-	binary.LittleEndian.PutUint32(valueBuf, uint32(value))
-	_, err = writer.Write(valueBuf)
+	indexFile.recycle.saved = indexFile.recycle.count
+	if indexFile.journal != nil {
+		err = indexFile.journal.commit(seq)
+		if err != nil {
+			// the txn is applied, it is not a failure. Without its mark it
+			// would be rolled back on next open, the index file is synced
+			// instead so that the journal is not needed.
+			err = indexFile.checkpoint()
+			if err != nil {
+				fmt.Printf("YTFSIndexFile: txn %d is applied but not marked committed: %v\n", seq, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkpoint syncs index file, then journal is no longer needed.
+func (indexFile *YTFSIndexFile) checkpoint() error {
+	writer, err := indexFile.store.Writer()
+	if err != nil {
+		return err
+	}
+	err = writer.Sync()
 	if err != nil {
 		return err
 	}
 
-	indexFile.index.sizes[idx] = tableSize
-	if debugPrint {
-		fmt.Printf("IndexDB put %x:%x\n", key, value)
+	if indexFile.journal != nil {
+		return indexFile.journal.reset()
 	}
 	return nil
 }
 
+func (indexFile *YTFSIndexFile) syncPeriodically(opCount uint32) error {
+	if (opCount & (indexFile.config.SyncPeriod - 1)) == 0 {
+		return indexFile.checkpoint()
+	}
+	return nil
+}
+
+// recycle list layout, starts from RecycleOffset
+// +-------+--------+--------+-----+
+// | count | slot 0 | slot 1 | ... |
+// +-------+--------+--------+-----+
+func (indexFile *YTFSIndexFile) loadRecycleCount() error {
+	countBuf := make([]byte, 4)
+	err := indexFile.readAt(countBuf, int64(indexFile.meta.RecycleOffset))
+	if err != nil {
+		return err
+	}
+
+	indexFile.recycle.count = binary.LittleEndian.Uint32(countBuf)
+	indexFile.recycle.saved = indexFile.recycle.count
+	return nil
+}
+
+func (indexFile *YTFSIndexFile) writeRecycleCount() error {
+	countBuf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(countBuf, indexFile.recycle.count)
+	return indexFile.writeAt(countBuf, int64(indexFile.meta.RecycleOffset))
+}
+
+func (indexFile *YTFSIndexFile) recycleSlotPos(i uint32) int64 {
+	return int64(indexFile.meta.RecycleOffset) + 4 + int64(i)*int64(indexFile.valueSize())
+}
+
+func (indexFile *YTFSIndexFile) pushRecycled(value ydcommon.IndexTableValue) error {
+	valueBuf := make([]byte, indexFile.valueSize())
+	indexFile.encodeValue(valueBuf, value)
+	err := indexFile.writeAt(valueBuf, indexFile.recycleSlotPos(indexFile.recycle.count))
+	if err != nil {
+		return err
+	}
+
+	indexFile.recycle.count++
+	return nil
+}
+
+// Recycle saves a data slot to the recycle list.
+func (indexFile *YTFSIndexFile) Recycle(value ydcommon.IndexTableValue) error {
+	if indexFile.config.ReadOnly {
+		return errors.ErrReadOnly
+	}
+
+	locker, _ := indexFile.store.Lock()
+	defer locker.Unlock()
+
+	indexFile.begin()
+	err := indexFile.pushRecycled(value)
+	if err != nil {
+		indexFile.abort()
+		return err
+	}
+	return indexFile.commit()
+}
+
+// PopRecycled takes a data slot from the recycle list, it reports false if
+// the list is empty. The slot is taken from the list on disk when the next
+// Put commits, so it is not lost if Put does not happen because of crash.
+func (indexFile *YTFSIndexFile) PopRecycled() (ydcommon.IndexTableValue, bool, error) {
+	if indexFile.config.ReadOnly {
+		return 0, false, errors.ErrReadOnly
+	}
+
+	locker, _ := indexFile.store.Lock()
+	defer locker.Unlock()
+
+	if indexFile.recycle.count == 0 {
+		return 0, false, nil
+	}
+
+	valueBuf := make([]byte, indexFile.valueSize())
+	err := indexFile.readAt(valueBuf, indexFile.recycleSlotPos(indexFile.recycle.count-1))
+	if err != nil {
+		return 0, false, err
+	}
+
+	indexFile.recycle.count--
+	return indexFile.decodeValue(valueBuf), true, nil
+}
+
+// recycledSlots reads all data slots in the recycle list.
+func (indexFile *YTFSIndexFile) recycledSlots() ([]ydcommon.IndexTableValue, error) {
+	valueSize := indexFile.valueSize()
+	valueBuf := make([]byte, valueSize*indexFile.recycle.count)
+	err := indexFile.readAt(valueBuf, indexFile.recycleSlotPos(0))
+	if err != nil {
+		return nil, err
+	}
+
+	slots := make([]ydcommon.IndexTableValue, indexFile.recycle.count)
+	for i := range slots {
+		slots[i] = indexFile.decodeValue(valueBuf[valueSize*uint32(i):])
+	}
+	return slots, nil
+}
+
+// RecycledCount reports the number of data slots in the recycle list.
+func (indexFile *YTFSIndexFile) RecycledCount() uint32 {
+	locker, _ := indexFile.store.Lock()
+	defer locker.Unlock()
+	return indexFile.recycle.count
+}
+
 // OpenYTFSIndexFile opens or creates a YTFSIndexFile for the given storage.
 // The DB will be created if not exist, unless Error happens.
 //
 // OpenYTFSIndexFile will return ErrConfigXXX if config is incorrect.
 //
+// A read-only YTFSIndexFile is never created nor modified, journal is left
+// as it is for the next writer to replay, while it is replayed in memory, so
+// that Get never sees a txn which is rolled back.
+//
 // The returned YTFSIndexFile instance is safe for concurrent use.
 // The YTFSIndexFile must be closed after use, by calling Close method.
-//
 func OpenYTFSIndexFile(path string, ytfsConfig *opt.Options) (*YTFSIndexFile, error) {
+	return openYTFSIndexFile(path, ytfsConfig, true)
+}
+
+// OpenExistingYTFSIndexFile opens a YTFSIndexFile as OpenYTFSIndexFile
+// does, but a writable one is never created nor formatted either, it fails
+// with ErrHeadNotFound if the header can not be read, e.g. to repair it.
+func OpenExistingYTFSIndexFile(path string, ytfsConfig *opt.Options) (*YTFSIndexFile, error) {
+	return openYTFSIndexFile(path, ytfsConfig, false)
+}
+
+func openYTFSIndexFile(path string, ytfsConfig *opt.Options, create bool) (*YTFSIndexFile, error) {
 	storage, err := openIndexStorage(path, ytfsConfig)
 	if err != nil {
 		return nil, err
 	}
 
+	// index in memory does not survive a crash, there is nothing to replay.
+	var journal *journal
+	if ytfsConfig.ReadOnly && !ytfsConfig.IndexInMemory() {
+		writes, err := readJournal(path + ".journal")
+		if err == nil && len(writes) != 0 {
+			var overlay *journalOverlay
+			overlay, err = newJournalOverlay(storage, writes)
+			if err == nil {
+				storage = overlay
+			}
+		}
+		if err != nil {
+			storage.Close()
+			return nil, err
+		}
+	}
+	if !ytfsConfig.ReadOnly && !ytfsConfig.IndexInMemory() {
+		journal, err = openJournal(path + ".journal")
+		if err != nil {
+			storage.Close()
+			return nil, err
+		}
+	}
+
+	yd, err := loadYTFSIndexFile(storage, journal, ytfsConfig, create)
+	if err != nil {
+		if journal != nil {
+			journal.close()
+		}
+		storage.Close()
+		return nil, err
+	}
+
+	// index before 0.07 is rehashed to a new one of the current version.
+	if !ytfsConfig.ReadOnly && yd.meta.Version != indexVersionCurrent {
+		return upgradeIndexFile(yd, path, ytfsConfig)
+	}
+
+	fmt.Println("Open YTFSIndexFile success @" + path)
+	return yd, nil
+}
+
+func loadYTFSIndexFile(storage Storage, journal *journal, ytfsConfig *opt.Options, create bool) (*YTFSIndexFile, error) {
+	if journal != nil {
+		err := journal.recover(storage)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	header, err := readIndexHeader(storage)
+	if err == nil && header == nil {
+		// header is cut short.
+		err = errors.ErrHeadNotFound
+	}
 	if err != nil {
+		if ytfsConfig.ReadOnly || !create {
+			return nil, err
+		}
 		header, err = initializeIndexStorage(storage, ytfsConfig)
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	if !knownIndexVersion(header.Version) {
+		return nil, errors.ErrIndexVersion
+	}
+
+	tables, err := newTableCache(header.RangeCoverage, ytfsConfig.IndexCacheSize)
+	if err != nil {
+		return nil, err
+	}
+
 	yd := &YTFSIndexFile{
-		header,
-		rangeTableInfo{sizes: make([]uint32, header.RangeCapacity+1, header.RangeCapacity+1)}, // +1 for overflow region
-		storage,
-		ytfsConfig,
-		indexStatistics{0, 0, 0},
-		sync.Mutex{},
+		meta:    header,
+		index:   rangeTableInfo{sizes: make([]uint32, header.RangeCapacity+1, header.RangeCapacity+1)}, // +1 for overflow region
+		recycle: recycleInfo{0, 0},
+		store:   storage,
+		config:  ytfsConfig,
+		stat:    indexStatistics{opened: time.Now()},
+		journal: journal,
+		txn:     nil,
+		tables:  tables,
 	}
 
-	fmt.Println("Open YTFSIndexFile success @" + path)
+	err = yd.loadRecycleCount()
+	if err != nil {
+		return nil, err
+	}
 	return yd, nil
 }
 
@@ -408,7 +1091,7 @@ func initializeIndexStorage(store Storage, config *opt.Options) (*ydcommon.Heade
 	}
 
 	m, n := config.IndexTableCols, config.IndexTableRows
-	t, d, h := config.TotalVolumn, config.DataBlockSize, uint32(unsafe.Sizeof(ydcommon.Header{}))
+	t, d, h := config.TotalVolumn, config.DataBlockSize, indexHeaderSize(indexVersionCurrent)
 
 	ytfsSize := uint64(0)
 	for _, storageOption := range config.Storages {
@@ -418,7 +1101,7 @@ func initializeIndexStorage(store Storage, config *opt.Options) (*ydcommon.Heade
 	// write header.
 	header := ydcommon.Header{
 		Tag:            [4]byte{'Y', 'T', 'F', 'S'},
-		Version:        [4]byte{'0', '.', '0', '3'},
+		Version:        indexVersionCurrent,
 		YtfsCapability: t,
 		YtfsSize:       ytfsSize,
 		DataBlockSize:  d,
@@ -427,32 +1110,47 @@ func initializeIndexStorage(store Storage, config *opt.Options) (*ydcommon.Heade
 		HashOffset:     h,
 		DataEndPoint:   0,
 		RecycleOffset:  uint64(h) + (uint64(n)+1)*(uint64(m)*36+4),
-		Reserved:       0xCDCDCDCDCDCDCDCD,
+		OverflowPages:  0,
+		Reserved:       0xCDCDCDCD,
+	}
+	if keyedIndexVersion(header.Version) {
+		seed := make([]byte, 8)
+		_, err = rand.Read(seed)
+		if err != nil {
+			return nil, err
+		}
+		header.HashSeed = binary.LittleEndian.Uint64(seed)
 	}
 
+	buf := bytes.NewBuffer(nil)
+	binary.Write(buf, binary.LittleEndian, &header)
 	writer.Seek(0, io.SeekStart)
-	err = binary.Write(writer, binary.LittleEndian, &header)
+	_, err = writer.Write(buf.Bytes()[:h])
 	if err != nil {
 		return nil, err
 	}
 
-	// file layout
+	// file layout, rows are 24 bytes since 0.05, 20 bytes before.
 	// +--------------+
 	// |    header    |
 	// +---+----------+
-	// | 4 |  m*20    |  1
+	// | 4 |  m*24    |  1
 	// +---+----------+
-	// | 4 |  m*20    |  2
+	// | 4 |  m*24    |  2
 	// +---+----------+
 	// | 4 |  ....    |  ...
 	// +---+----------+
-	// | 4 |  m*20    |  n
+	// | 4 |  m*24    |  n
 	// +---+----------+
-	// | 4 |  m*20    |  n+1 for conflict/overflow
+	// | 4 |  m*24    |  n+1 for conflict/overflow
 	// +---+----------+
 	// | TAG: eofPos  |
 	// +---+----------+
-	eofPos := int64(m*20+4)*int64(n+1) + int64(h)
+	// | recycle list |  at RecycleOffset
+	// +---+----------+
+	// | 4 |  m*24    |  overflow pages, allocated on demand
+	// +---+----------+
+	eofPos := int64(m*indexItemSize(header.Version)+4)*int64(n+1) + int64(h)
 	writer.Seek(eofPos, io.SeekStart)
 	err = binary.Write(writer, binary.LittleEndian, &eofPos)
 	if err != nil {
@@ -462,9 +1160,20 @@ func initializeIndexStorage(store Storage, config *opt.Options) (*ydcommon.Heade
 	return &header, nil
 }
 
-func openIndexStorage(path string, opt *opt.Options) (Storage, error) {
+// openIndexStorage opens the index at path by the index backend of config. A
+// file index is not locked as a file storage is, the YTFS dir is.
+func openIndexStorage(path string, config *opt.Options) (Storage, error) {
+	storageConfig := config.IndexStorageOptions(path)
+	if storageConfig.BackendName() != opt.FileBackend {
+		factory, err := lookupBackend(storageConfig)
+		if err != nil {
+			return nil, err
+		}
+		return factory(storageConfig)
+	}
+
 	fileStorage := FileStorage{
-		readOnly: opt.ReadOnly,
+		readOnly: config.ReadOnly,
 		mu:       sync.RWMutex{},
 		fd: &FileDesc{
 			Type: ydcommon.DummyStorageType,
@@ -473,14 +1182,12 @@ func openIndexStorage(path string, opt *opt.Options) (Storage, error) {
 		},
 	}
 
-	writer, err := fileStorage.Create(*fileStorage.fd)
-	if err != nil {
-		return nil, err
-	}
-	if !opt.ReadOnly {
+	if !config.ReadOnly {
+		writer, err := fileStorage.Create(*fileStorage.fd)
+		if err != nil {
+			return nil, err
+		}
 		fileStorage.writer = writer
-	} else {
-		writer.Close()
 	}
 
 	reader, err := fileStorage.Open(*fileStorage.fd)
@@ -492,6 +1199,35 @@ func openIndexStorage(path string, opt *opt.Options) (Storage, error) {
 	return &fileStorage, nil
 }
 
+// RemoveIndexFile removes the index at path and its journal, in file or in
+// memory as config tells. It is not an error if they do not exist.
+func RemoveIndexFile(path string, config *opt.Options) error {
+	if config.IndexInMemory() {
+		return DeleteMemoryStorage(path)
+	}
+	for _, name := range []string{path, path + ".journal"} {
+		err := os.Remove(name)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// RenameIndexFile moves the closed index at from to to, replacing the index
+// there. The journal of from, which is empty once the index is closed, is
+// removed.
+func RenameIndexFile(from, to string, config *opt.Options) error {
+	if config.IndexInMemory() {
+		return renameMemoryStorage(from, to)
+	}
+	err := os.Rename(from, to)
+	if err == nil {
+		os.Remove(from + ".journal")
+	}
+	return err
+}
+
 func readIndexHeader(store Storage) (*ydcommon.Header, error) {
 	reader, err := store.Reader()
 	if err != nil {
@@ -515,5 +1251,13 @@ func readIndexHeader(store Storage) (*ydcommon.Header, error) {
 	if header.Tag[0] != 'Y' {
 		return nil, errors.ErrHeadNotFound
 	}
+
+	if !keyedIndexVersion(header.Version) {
+		// bytes after the header are not the seed.
+		header.HashSeed = 0
+	}
+	if header.OverflowPages == noOverflowPages {
+		header.OverflowPages = 0
+	}
 	return &header, nil
 }
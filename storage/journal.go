@@ -0,0 +1,430 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+
+	ydcommon "github.com/yottachain/YTFS/common"
+)
+
+// journal record types
+const (
+	journalPrepare byte = 'P' // intent of a txn, with all its writes.
+	journalCommit  byte = 'C' // txn is fully applied.
+	journalAbort   byte = 'A' // txn failed and was rolled back.
+)
+
+// journal record layout
+// +------+-----+--------+-----------------+-------+
+// | type | seq | length | payload(length) | crc32 |
+// +------+-----+--------+-----------------+-------+
+// prepare payload
+// +-------+--------+------+-----+-----+-----+
+// | count | offset | size | old | new | ... |
+// +-------+--------+------+-----+-----+-----+
+const journalRecordHeadSize = 1 + 8 + 4
+
+// journalWrite is one write to index file. old holds the contents before
+// the write, so the write can be rolled back.
+type journalWrite struct {
+	offset int64
+	old    []byte
+	new    []byte
+}
+
+// journalTxn collects the writes of one index update, they are applied
+// to index file all together after the txn is saved to journal.
+type journalTxn struct {
+	writes   []journalWrite
+	meta     ydcommon.Header
+	recycle  recycleInfo
+	oldSizes map[uint32]uint32
+	tables   map[uint32]bool // range tables written
+}
+
+type journalRecord struct {
+	kind   byte
+	seq    uint64
+	writes []journalWrite
+}
+
+// journal is the write-ahead log of YTFSIndexFile. Every index update is
+// saved and synced to journal before it is applied, so an update broken by
+// crash can be replayed or rolled back on next open.
+type journal struct {
+	file *os.File
+	seq  uint64
+	// end of the records written, a record which fails to be written is
+	// overwritten by the next one.
+	end int64
+}
+
+func openJournal(path string) (*journal, error) {
+	fp, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &journal{
+		file: fp,
+		seq:  0,
+	}, nil
+}
+
+// prepare saves the txn to journal and waits until it is on disk. The sync
+// can not be saved: index file is written right after prepare, and without
+// the intent on disk a crash could leave a half applied txn which nothing
+// rolls back. Each Put, BatchPut and Delete is one txn, so each of them costs
+// a flush of the journal, BenchmarkIndexFilePut compares it with an index in
+// memory, which keeps no journal. Batch many keys with BatchPut to share it.
+func (j *journal) prepare(writes []journalWrite) (uint64, error) {
+	j.seq++
+	payload := new(bytes.Buffer)
+	binary.Write(payload, binary.LittleEndian, uint32(len(writes)))
+	for _, w := range writes {
+		binary.Write(payload, binary.LittleEndian, w.offset)
+		binary.Write(payload, binary.LittleEndian, uint32(len(w.new)))
+		payload.Write(w.old)
+		payload.Write(w.new)
+	}
+
+	err := j.append(journalPrepare, j.seq, payload.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	return j.seq, j.file.Sync()
+}
+
+// commit marks txn seq applied. It is not synced, the mark goes to disk
+// with next prepare or reset. A txn whose mark is lost by crash is rolled
+// back on next open, so the last update before a power loss may be lost,
+// while index and storages still agree.
+func (j *journal) commit(seq uint64) error {
+	return j.append(journalCommit, seq, nil)
+}
+
+// abort marks txn seq rolled back.
+func (j *journal) abort(seq uint64) error {
+	err := j.append(journalAbort, seq, nil)
+	if err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+func (j *journal) append(kind byte, seq uint64, payload []byte) error {
+	buf := make([]byte, journalRecordHeadSize+len(payload)+4)
+	buf[0] = kind
+	binary.LittleEndian.PutUint64(buf[1:], seq)
+	binary.LittleEndian.PutUint32(buf[9:], uint32(len(payload)))
+	copy(buf[journalRecordHeadSize:], payload)
+	crc := crc32.ChecksumIEEE(buf[:journalRecordHeadSize+len(payload)])
+	binary.LittleEndian.PutUint32(buf[journalRecordHeadSize+len(payload):], crc)
+
+	// readRecords stops at a torn record, which would hide every record
+	// after it, so a failed write is cut off and never appended after.
+	_, err := j.file.WriteAt(buf, j.end)
+	if err != nil {
+		j.file.Truncate(j.end)
+		return err
+	}
+	j.end += int64(len(buf))
+	return nil
+}
+
+// reset drops all records, it is called after index file is synced.
+func (j *journal) reset() error {
+	err := j.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	j.seq, j.end = 0, 0
+	return j.file.Sync()
+}
+
+func (j *journal) close() error {
+	return j.file.Close()
+}
+
+// readRecords reads all complete records, a torn record at the tail which
+// has never been synced is dropped.
+func (j *journal) readRecords() ([]journalRecord, error) {
+	_, err := j.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := ioutil.ReadAll(j.file)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []journalRecord{}
+	for len(buf) >= journalRecordHeadSize+4 {
+		length := int(binary.LittleEndian.Uint32(buf[9:]))
+		if len(buf) < journalRecordHeadSize+length+4 {
+			break
+		}
+		crc := binary.LittleEndian.Uint32(buf[journalRecordHeadSize+length:])
+		if crc != crc32.ChecksumIEEE(buf[:journalRecordHeadSize+length]) {
+			break
+		}
+
+		record := journalRecord{
+			kind: buf[0],
+			seq:  binary.LittleEndian.Uint64(buf[1:]),
+		}
+		if record.kind == journalPrepare {
+			record.writes, err = decodeJournalWrites(buf[journalRecordHeadSize : journalRecordHeadSize+length])
+			if err != nil {
+				break
+			}
+		}
+		records = append(records, record)
+		buf = buf[journalRecordHeadSize+length+4:]
+	}
+
+	return records, nil
+}
+
+func decodeJournalWrites(payload []byte) ([]journalWrite, error) {
+	reader := bytes.NewReader(payload)
+	var count uint32
+	err := binary.Read(reader, binary.LittleEndian, &count)
+	if err != nil {
+		return nil, err
+	}
+
+	writes := make([]journalWrite, 0, count)
+	for i := uint32(0); i < count; i++ {
+		var offset int64
+		var size uint32
+		binary.Read(reader, binary.LittleEndian, &offset)
+		err = binary.Read(reader, binary.LittleEndian, &size)
+		if err != nil {
+			return nil, err
+		}
+		if reader.Len() < int(size)*2 {
+			return nil, fmt.Errorf("journal: write of %d bytes exceeds record", size)
+		}
+
+		w := journalWrite{offset, make([]byte, size), make([]byte, size)}
+		reader.Read(w.old)
+		reader.Read(w.new)
+		writes = append(writes, w)
+	}
+	return writes, nil
+}
+
+// recover brings store to a consistent state: txns committed are replayed,
+// since index file may lose them if it was not synced, the txn which was
+// not committed is rolled back.
+func (j *journal) recover(store Storage) error {
+	records, err := j.readRecords()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	writer, err := store.Writer()
+	if err != nil {
+		return err
+	}
+	err = applyJournalWrites(writer, replayWrites(records), false)
+	if err != nil {
+		return err
+	}
+
+	err = writer.Sync()
+	if err != nil {
+		return err
+	}
+	return j.reset()
+}
+
+// replayWrites returns the writes which recover applies, in order: new
+// contents of txns committed, and old contents of txns not committed, in
+// reverse order of their writes. Txns aborted are rolled back already.
+func replayWrites(records []journalRecord) []journalWrite {
+	prepared := map[uint64]journalRecord{}
+	order := []uint64{}
+	state := map[uint64]byte{}
+	for _, record := range records {
+		if record.kind == journalPrepare {
+			prepared[record.seq] = record
+			order = append(order, record.seq)
+		}
+		state[record.seq] = record.kind
+	}
+
+	writes := []journalWrite{}
+	for _, seq := range order {
+		txnWrites := prepared[seq].writes
+		switch state[seq] {
+		case journalCommit:
+			writes = append(writes, txnWrites...)
+		case journalPrepare:
+			for i := len(txnWrites) - 1; i >= 0; i-- {
+				w := txnWrites[i]
+				writes = append(writes, journalWrite{offset: w.offset, old: w.new, new: w.old})
+			}
+		}
+		if debugPrint {
+			fmt.Printf("Journal: recover txn %d, state %c\n", seq, state[seq])
+		}
+	}
+	return writes
+}
+
+// applyJournalWrites writes the new contents in order, or the old contents in
+// reverse order if rollback.
+func applyJournalWrites(writer Writer, writes []journalWrite, rollback bool) error {
+	for i := range writes {
+		w, data := writes[i], writes[i].new
+		if rollback {
+			w = writes[len(writes)-1-i]
+			data = w.old
+		}
+
+		_, err := writer.Seek(w.offset, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		_, err = writer.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readJournal returns the writes which recover would apply with the journal
+// at path, without changing the journal. It returns nothing if there is no
+// journal.
+func readJournal(path string) ([]journalWrite, error) {
+	fp, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	j := &journal{file: fp}
+	records, err := j.readRecords()
+	if err != nil {
+		return nil, err
+	}
+	return replayWrites(records), nil
+}
+
+// journalOverlay is a read-only index storage whose journal is replayed in
+// memory: reads see what index file would have after recover, while neither
+// is written. The journal is read once when the storage is opened.
+type journalOverlay struct {
+	Storage
+	reader *overlayReader
+}
+
+func newJournalOverlay(store Storage, writes []journalWrite) (*journalOverlay, error) {
+	base, err := store.Reader()
+	if err != nil {
+		return nil, err
+	}
+	return &journalOverlay{
+		Storage: store,
+		reader:  &overlayReader{base: base, writes: writes},
+	}, nil
+}
+
+func (overlay *journalOverlay) Reader() (Reader, error) {
+	return overlay.reader, nil
+}
+
+// overlayReader reads base with writes applied on it in order.
+type overlayReader struct {
+	base   Reader
+	writes []journalWrite
+	pos    int64
+}
+
+// ReadAt implements io.ReaderAt, bytes beyond base which are written by the
+// journal are read as well.
+func (r *overlayReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.base.ReadAt(p, off)
+	if err != nil && err != io.EOF {
+		return n, err
+	}
+	for i := n; i < len(p); i++ {
+		p[i] = 0
+	}
+
+	end := off + int64(n)
+	for _, w := range r.writes {
+		from, to := w.offset, w.offset+int64(len(w.new))
+		if from < off {
+			from = off
+		}
+		if to > off+int64(len(p)) {
+			to = off + int64(len(p))
+		}
+		if from >= to {
+			continue
+		}
+		copy(p[from-off:to-off], w.new[from-w.offset:])
+		if to > end {
+			end = to
+		}
+	}
+
+	if end < off+int64(len(p)) {
+		if end < off {
+			end = off
+		}
+		return int(end - off), io.EOF
+	}
+	return len(p), nil
+}
+
+// Read implements io.Reader.
+func (r *overlayReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	return n, err
+}
+
+// Seek implements io.Seeker, end is the end of base or of the writes.
+func (r *overlayReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		end, err := r.base.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, err
+		}
+		for _, w := range r.writes {
+			if e := w.offset + int64(len(w.new)); e > end {
+				end = e
+			}
+		}
+		offset += end
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// Close closes base.
+func (r *overlayReader) Close() error {
+	return r.base.Close()
+}
@@ -0,0 +1,318 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	types "github.com/yottachain/YTFS/common"
+	"github.com/yottachain/YTFS/errors"
+	"github.com/yottachain/YTFS/opt"
+)
+
+func openTestIndexFile(t *testing.T) (*YTFSIndexFile, string, *opt.Options) {
+	dir, err := ioutil.TempDir("", "yotta-journal-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := opt.MemoryOptions()
+	config.IndexStorageType = types.FileStorageType
+	config.SyncPeriod = 1024 // keep journal records between checkpoints
+	indexPath := path.Join(dir, "index.db")
+	indexFile, err := OpenYTFSIndexFile(indexPath, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return indexFile, indexPath, config
+}
+
+// crash closes index file without syncing, the same as process is killed.
+func crash(indexFile *YTFSIndexFile) {
+	indexFile.journal.close()
+	indexFile.store.Close()
+}
+
+func testKey(i int) types.IndexTableKey {
+	return types.IndexTableKey(types.HexToHash(string([]byte{'0' + byte(i%10)})))
+}
+
+func TestJournalReplayCommittedTxn(t *testing.T) {
+	indexFile, indexPath, config := openTestIndexFile(t)
+	defer os.RemoveAll(path.Dir(indexPath))
+
+	err := indexFile.Put(testKey(1), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// committed txn is lost from index file, but kept in journal.
+	indexFile.begin()
+	err = indexFile.updateTable(testKey(2), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexFile.writeDataEndPoint()
+	txn := indexFile.txn
+	seq, err := indexFile.journal.prepare(txn.writes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexFile.journal.commit(seq)
+	crash(indexFile)
+
+	indexFile, err = OpenYTFSIndexFile(indexPath, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer indexFile.Close()
+
+	for i := 1; i <= 2; i++ {
+		value, err := indexFile.Get(testKey(i))
+		if err != nil || value != types.IndexTableValue(i) {
+			t.Fatalf("key %d: expect %d, got %d, %v", i, i, value, err)
+		}
+	}
+	if indexFile.meta.DataEndPoint != 3 {
+		t.Fatalf("expect DataEndPoint 3, got %d", indexFile.meta.DataEndPoint)
+	}
+}
+
+func TestJournalRollbackPreparedTxn(t *testing.T) {
+	indexFile, indexPath, config := openTestIndexFile(t)
+	defer os.RemoveAll(path.Dir(indexPath))
+
+	err := indexFile.Put(testKey(1), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// crash in the middle of applying a txn: all but its last write are done.
+	indexFile.begin()
+	err = indexFile.updateTable(testKey(2), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexFile.writeDataEndPoint()
+	txn := indexFile.txn
+	_, err = indexFile.journal.prepare(txn.writes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, _ := indexFile.store.Writer()
+	applyJournalWrites(writer, txn.writes[:len(txn.writes)-1], false)
+	crash(indexFile)
+
+	indexFile, err = OpenYTFSIndexFile(indexPath, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer indexFile.Close()
+
+	value, err := indexFile.Get(testKey(1))
+	if err != nil || value != 1 {
+		t.Fatalf("expect 1, got %d, %v", value, err)
+	}
+	_, err = indexFile.Get(testKey(2))
+	if err != errors.ErrDataNotFound {
+		t.Fatalf("expect ErrDataNotFound, got %v", err)
+	}
+	if indexFile.meta.DataEndPoint != 2 {
+		t.Fatalf("expect DataEndPoint 2, got %d", indexFile.meta.DataEndPoint)
+	}
+}
+
+func TestJournalTornRecordIgnored(t *testing.T) {
+	indexFile, indexPath, config := openTestIndexFile(t)
+	defer os.RemoveAll(path.Dir(indexPath))
+
+	err := indexFile.Put(testKey(1), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexFile.journal.file.WriteAt([]byte{journalPrepare, 0x1, 0x2}, indexFile.journal.end)
+	crash(indexFile)
+
+	indexFile, err = OpenYTFSIndexFile(indexPath, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer indexFile.Close()
+
+	value, err := indexFile.Get(testKey(1))
+	if err != nil || value != 1 {
+		t.Fatalf("expect 1, got %d, %v", value, err)
+	}
+}
+
+func TestJournalAppendAfterTornRecord(t *testing.T) {
+	indexFile, indexPath, config := openTestIndexFile(t)
+	defer os.RemoveAll(path.Dir(indexPath))
+
+	err := indexFile.Put(testKey(1), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a write of record which failed halfway, the records after it are
+	// still read.
+	torn := make([]byte, 64)
+	torn[0] = journalPrepare
+	indexFile.journal.file.WriteAt(torn, indexFile.journal.end)
+	err = indexFile.Put(testKey(2), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := indexFile.journal.readRecords()
+	if err != nil || len(records) != 4 {
+		t.Fatalf("expect 4 records, got %d, %v", len(records), err)
+	}
+	crash(indexFile)
+
+	indexFile, err = OpenYTFSIndexFile(indexPath, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer indexFile.Close()
+
+	for i := 1; i <= 2; i++ {
+		value, err := indexFile.Get(testKey(i))
+		if err != nil || value != types.IndexTableValue(i) {
+			t.Fatalf("expect %d, got %d, %v", i, value, err)
+		}
+	}
+}
+
+func TestBatchPutConflictWritesNothing(t *testing.T) {
+	indexFile, indexPath, _ := openTestIndexFile(t)
+	defer os.RemoveAll(path.Dir(indexPath))
+	defer indexFile.Close()
+
+	err := indexFile.Put(testKey(1), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conflicts, err := indexFile.BatchPut([]types.IndexItem{
+		{Hash: testKey(2), OffsetIdx: 2},
+		{Hash: testKey(1), OffsetIdx: 3},
+	})
+	if err != errors.ErrConflict || len(conflicts) != 1 {
+		t.Fatalf("expect 1 conflict, got %v, %v", conflicts, err)
+	}
+
+	_, err = indexFile.Get(testKey(2))
+	if err != errors.ErrDataNotFound {
+		t.Fatalf("expect ErrDataNotFound, got %v", err)
+	}
+	if indexFile.meta.DataEndPoint != 2 {
+		t.Fatalf("expect DataEndPoint 2, got %d", indexFile.meta.DataEndPoint)
+	}
+}
+
+func TestJournalReplayedInMemoryReadOnly(t *testing.T) {
+	indexFile, indexPath, config := openTestIndexFile(t)
+	defer os.RemoveAll(path.Dir(indexPath))
+
+	err := indexFile.Put(testKey(1), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a committed txn is lost from index file, a prepared one is half applied.
+	indexFile.begin()
+	indexFile.updateTable(testKey(2), 2)
+	indexFile.writeDataEndPoint()
+	seq, err := indexFile.journal.prepare(indexFile.txn.writes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexFile.journal.commit(seq)
+	indexFile.begin()
+	indexFile.updateTable(testKey(3), 3)
+	indexFile.writeDataEndPoint()
+	txn := indexFile.txn
+	_, err = indexFile.journal.prepare(txn.writes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, _ := indexFile.store.Writer()
+	applyJournalWrites(writer, txn.writes[:len(txn.writes)-1], false)
+	crash(indexFile)
+	journalInfo, _ := os.Stat(indexPath + ".journal")
+
+	readOnly := *config
+	readOnly.ReadOnly = true
+	indexFile, err = OpenYTFSIndexFile(indexPath, &readOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 2; i++ {
+		value, err := indexFile.Get(testKey(i))
+		if err != nil || value != types.IndexTableValue(i) {
+			t.Fatalf("key %d: expect %d, got %d, %v", i, i, value, err)
+		}
+	}
+	if _, err = indexFile.Get(testKey(3)); err != errors.ErrDataNotFound {
+		t.Fatalf("rolled back key: expect ErrDataNotFound, got %v", err)
+	}
+	dataEnd := indexFile.meta.DataEndPoint
+	indexFile.Close()
+
+	// journal is left for the next writer, which recovers the same index.
+	if info, err := os.Stat(indexPath + ".journal"); err != nil || info.Size() != journalInfo.Size() {
+		t.Fatal("journal is changed by read-only open:", err)
+	}
+	indexFile, err = OpenYTFSIndexFile(indexPath, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer indexFile.Close()
+	if indexFile.meta.DataEndPoint != dataEnd {
+		t.Fatalf("expect DataEndPoint %d as read-only, got %d", dataEnd, indexFile.meta.DataEndPoint)
+	}
+	if _, err = indexFile.Get(testKey(3)); err != errors.ErrDataNotFound {
+		t.Fatalf("rolled back key: expect ErrDataNotFound, got %v", err)
+	}
+}
+
+func BenchmarkIndexFilePut(b *testing.B) {
+	dir, err := ioutil.TempDir("", "yotta-journal-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// index in memory keeps no journal, the difference is the cost of it.
+	for _, inMemory := range []bool{false, true} {
+		name := "journal"
+		if inMemory {
+			name = "memory"
+		}
+		b.Run(name, func(b *testing.B) {
+			config := opt.MemoryOptions()
+			config.IndexTableRows = 1 << 10
+			config.TotalVolumn = 1 << 40
+			if !inMemory {
+				config.IndexStorageType = types.FileStorageType
+			}
+			indexPath := path.Join(dir, name+".db")
+			defer RemoveIndexFile(indexPath, config)
+			indexFile, err := OpenYTFSIndexFile(indexPath, config)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer indexFile.Close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				key := types.IndexTableKey(types.HexToHash(fmt.Sprintf("%032X", i)))
+				err := indexFile.Put(key, types.IndexTableValue(i))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
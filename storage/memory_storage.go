@@ -0,0 +1,287 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	types "github.com/yottachain/YTFS/common"
+	"github.com/yottachain/YTFS/errors"
+	"github.com/yottachain/YTFS/opt"
+)
+
+// memoryPageSize is the unit memory storage allocates in, pages never
+// written take no memory and read as 0.
+const memoryPageSize = 1 << 16
+
+// memoryData is the content of a memory storage, it lives as long as the
+// process unless it is deleted, so a storage opened again by name finds what
+// is written before.
+type memoryData struct {
+	mu    sync.RWMutex
+	pages map[int64][]byte
+	size  int64
+
+	// opened storages, one of them can be writable.
+	readers int
+	writers int
+}
+
+// memoryStorages are all memory storages of the process, by name.
+var memoryStorages = struct {
+	sync.Mutex
+	files map[string]*memoryData
+}{files: map[string]*memoryData{}}
+
+// MemoryStorage is a RAM-backed storage, for tests and nodes which keep
+// nothing on disk. Memory storages are named as files are, each name is a
+// storage of the process, which is created by the first writable open.
+type MemoryStorage struct {
+	readOnly bool
+	mu       sync.RWMutex
+	fd       *FileDesc
+	data     *memoryData
+	reader   *memoryFile
+	writer   *memoryFile
+}
+
+// OpenMemoryStorage opens the memory storage of opt.StorageName, it is
+// created if it does not exist and the storage is writable. As a file
+// storage, a writable storage fails with *errors.ErrLocked if it is opened
+// for write already, read-only ones are opened any time.
+//
+// The storage must be closed after use, by calling Close method.
+func OpenMemoryStorage(opt *opt.StorageOptions) (Storage, error) {
+	return openMemoryStorage(opt.StorageName, opt.ReadOnly)
+}
+
+func openMemoryStorage(name string, readOnly bool) (Storage, error) {
+	memoryStorages.Lock()
+	defer memoryStorages.Unlock()
+
+	data, ok := memoryStorages.files[name]
+	if !ok {
+		if readOnly {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		data = &memoryData{pages: map[int64][]byte{}}
+		memoryStorages.files[name] = data
+	}
+	if !readOnly && data.writers != 0 {
+		return nil, &errors.ErrLocked{Path: name, PID: os.Getpid()}
+	}
+
+	memStorage := &MemoryStorage{
+		readOnly: readOnly,
+		mu:       sync.RWMutex{},
+		fd: &FileDesc{
+			Type: types.DummyStorageType,
+			Cap:  0,
+			Path: name,
+		},
+		data:   data,
+		reader: &memoryFile{data: data},
+	}
+	if readOnly {
+		data.readers++
+	} else {
+		data.writers++
+		memStorage.writer = &memoryFile{data: data}
+	}
+	return memStorage, nil
+}
+
+// DeleteMemoryStorage frees the memory storage of name, it returns an error
+// if the storage is still opened.
+func DeleteMemoryStorage(name string) error {
+	memoryStorages.Lock()
+	defer memoryStorages.Unlock()
+
+	data, ok := memoryStorages.files[name]
+	if !ok {
+		return nil
+	}
+	if data.readers != 0 || data.writers != 0 {
+		return &errors.ErrLocked{Path: name, PID: os.Getpid()}
+	}
+	delete(memoryStorages.files, name)
+	return nil
+}
+
+// renameMemoryStorage moves the memory storage from to to, the one at to is
+// replaced. Neither can be opened.
+func renameMemoryStorage(from, to string) error {
+	memoryStorages.Lock()
+	defer memoryStorages.Unlock()
+
+	data, ok := memoryStorages.files[from]
+	if !ok {
+		return &os.PathError{Op: "rename", Path: from, Err: os.ErrNotExist}
+	}
+	for _, name := range []string{from, to} {
+		if old, ok := memoryStorages.files[name]; ok && (old.readers != 0 || old.writers != 0) {
+			return &errors.ErrLocked{Path: name, PID: os.Getpid()}
+		}
+	}
+	delete(memoryStorages.files, from)
+	memoryStorages.files[to] = data
+	return nil
+}
+
+func (file *MemoryStorage) Reader() (Reader, error) {
+	return file.reader, nil
+}
+
+func (file *MemoryStorage) Writer() (Writer, error) {
+	if file.readOnly {
+		return nil, errors.ErrReadOnly
+	}
+	return file.writer, nil
+}
+
+// Lock locks the storage. Any subsequent attempt to call Lock will fail
+// until the last lock released.
+// Caller should call Unlock method after use.
+func (file *MemoryStorage) Lock() (Locker, error) {
+	file.mu.Lock()
+	return &file.mu, nil
+}
+
+// Close closes the storage, what is written stays in memory.
+// It is valid to call Close multiple times. Other methods should not be
+// called after the storage has been closed.
+func (file *MemoryStorage) Close() error {
+	memoryStorages.Lock()
+	defer memoryStorages.Unlock()
+
+	data := file.data
+	if data == nil {
+		return nil
+	}
+	data.mu.Lock()
+	file.reader.closed = true
+	if file.readOnly {
+		data.readers--
+	} else {
+		file.writer.closed = true
+		data.writers--
+	}
+	data.mu.Unlock()
+	file.data = nil
+	return nil
+}
+
+// memoryFile is a Reader and Writer on the pages of a memory storage, it
+// returns ErrClosed after the storage is closed.
+type memoryFile struct {
+	data   *memoryData
+	pos    int64
+	closed bool
+}
+
+// ReadAt implements io.ReaderAt, bytes beyond what is written are not read.
+func (f *memoryFile) ReadAt(p []byte, off int64) (int, error) {
+	data := f.data
+	data.mu.RLock()
+	defer data.mu.RUnlock()
+
+	if f.closed {
+		return 0, errors.ErrClosed
+	}
+	if off >= data.size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p))
+	if end > data.size {
+		end = data.size
+	}
+	n := 0
+	for pos := off; pos < end; {
+		skip := pos % memoryPageSize
+		size := memoryPageSize - skip
+		if size > end-pos {
+			size = end - pos
+		}
+		chunk := p[n : n+int(size)]
+		if page, ok := data.pages[pos-skip]; ok {
+			copy(chunk, page[skip:])
+		} else {
+			for i := range chunk {
+				chunk[i] = 0
+			}
+		}
+		n += int(size)
+		pos += size
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt implements io.WriterAt.
+func (f *memoryFile) WriteAt(p []byte, off int64) (int, error) {
+	data := f.data
+	data.mu.Lock()
+	defer data.mu.Unlock()
+
+	if f.closed {
+		return 0, errors.ErrClosed
+	}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		skip := pos % memoryPageSize
+		page, ok := data.pages[pos-skip]
+		if !ok {
+			page = make([]byte, memoryPageSize)
+			data.pages[pos-skip] = page
+		}
+		n += copy(page[skip:], p[n:])
+	}
+	if end := off + int64(n); end > data.size {
+		data.size = end
+	}
+	return n, nil
+}
+
+// Read implements io.Reader.
+func (f *memoryFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+// Write implements io.Writer.
+func (f *memoryFile) Write(p []byte) (int, error) {
+	n, err := f.WriteAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+// Seek implements io.Seeker, end is the end of what is written.
+func (f *memoryFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		f.data.mu.RLock()
+		offset += f.data.size
+		f.data.mu.RUnlock()
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+// Sync does nothing, there is no stable storage to commit to.
+func (f *memoryFile) Sync() error {
+	return nil
+}
+
+// Close does nothing, the pages stay with the storage.
+func (f *memoryFile) Close() error {
+	return nil
+}
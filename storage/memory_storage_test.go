@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+
+	types "github.com/yottachain/YTFS/common"
+	"github.com/yottachain/YTFS/errors"
+	"github.com/yottachain/YTFS/opt"
+)
+
+func memoryTestOptions(name string) *opt.StorageOptions {
+	return &opt.StorageOptions{
+		StorageName:   name,
+		StorageType:   types.DummyStorageType,
+		StorageVolume: 1 << 20, // 1m
+		DataBlockSize: 1 << 15, // 32k
+	}
+}
+
+func TestMemoryStorageRW(t *testing.T) {
+	config := memoryTestOptions("memory-test-rw")
+	defer DeleteMemoryStorage(config.StorageName)
+
+	store, err := OpenMemoryStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenMemoryStorage(config); err == nil {
+		t.Fatal("writable storage is opened twice")
+	}
+
+	// a write across pages.
+	writer, _ := store.Writer()
+	reader, _ := store.Reader()
+	data := make([]byte, memoryPageSize+10)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	writer.Seek(memoryPageSize-5, io.SeekStart)
+	writer.Write(data)
+	buf := make([]byte, len(data))
+	if _, err := reader.ReadAt(buf, memoryPageSize-5); err != nil || !reflect.DeepEqual(buf, data) {
+		t.Fatal("read across pages:", err)
+	}
+	// bytes never written read as 0.
+	if _, err := reader.ReadAt(buf[:5], 0); err != nil || !reflect.DeepEqual(buf[:5], make([]byte, 5)) {
+		t.Fatalf("read %v, %v", buf[:5], err)
+	}
+	end, _ := reader.Seek(0, io.SeekEnd)
+	if n, err := reader.ReadAt(buf, end-1); n != 1 || err != io.EOF {
+		t.Fatalf("read beyond the end: %d, %v", n, err)
+	}
+	store.Close()
+	if _, err := reader.ReadAt(buf, 0); err != errors.ErrClosed {
+		t.Fatal("read after close:", err)
+	}
+
+	// data stays after close, read-only storages share it.
+	config.ReadOnly = true
+	store, err = OpenMemoryStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	other, err := OpenMemoryStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	reader, _ = other.Reader()
+	if _, err := reader.ReadAt(buf, memoryPageSize-5); err != nil || !reflect.DeepEqual(buf, data) {
+		t.Fatal("read after reopen:", err)
+	}
+	if _, err := store.Writer(); err != errors.ErrReadOnly {
+		t.Fatal("read-only storage is writable:", err)
+	}
+	if err := DeleteMemoryStorage(config.StorageName); err == nil {
+		t.Fatal("opened storage is deleted")
+	}
+
+	none := memoryTestOptions("memory-test-missing")
+	none.ReadOnly = true
+	if _, err := OpenMemoryStorage(none); !os.IsNotExist(err) {
+		t.Fatal("missing storage is opened:", err)
+	}
+}
+
+func TestYottaDiskWithMemoryStorage(t *testing.T) {
+	config := memoryTestOptions("memory-test-disk")
+	defer DeleteMemoryStorage(config.StorageName)
+
+	yd, err := OpenYottaDisk(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks, valueBlocks := SplitValues([][]byte{[]byte("short"), make([]byte, config.DataBlockSize+1)}, config.DataBlockSize)
+	err = yd.WriteBlocksContext(context.Background(), 0, blocks, valueBlocks, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	yd.Close()
+
+	config.ReadOnly = true
+	yd, err = OpenYottaDisk(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer yd.Close()
+	for i, block := range blocks {
+		data, err := yd.ReadData(types.IndexTableValue(i))
+		if err != nil || !reflect.DeepEqual(data, block) {
+			t.Fatalf("block %d: expect %d bytes, got %d, %v", i, len(block), len(data), err)
+		}
+	}
+}
@@ -1,9 +1,8 @@
 package storage
 
 import (
-	"fmt"
-
 	"github.com/yottachain/YTFS/common"
+	"github.com/yottachain/YTFS/errors"
 	"github.com/yottachain/YTFS/opt"
 )
 
@@ -15,22 +14,33 @@ type TableIterator struct {
 
 // GetTableIterator 返回Table遍历器
 func GetTableIterator(path string, opts *opt.Options) (*TableIterator, error) {
-	var ti TableIterator
 	ytfsIndexFile, err := OpenYTFSIndexFile(path, opts)
 	if err != nil {
 		return nil, err
 	}
-	ti.ytfsIndexFile = ytfsIndexFile
-	ti.options = opts
-	return &ti, nil
+	return NewTableIterator(ytfsIndexFile), nil
 }
 
-// GetTable 获取一个Table，指针后移一位
+// NewTableIterator 返回一个已打开的YTFSIndexFile的Table遍历器，遍历时不需要关闭index文件
+func NewTableIterator(indexFile *YTFSIndexFile) *TableIterator {
+	return &TableIterator{
+		ytfsIndexFile: indexFile,
+		tableIndex:    0,
+		options:       indexFile.config,
+	}
+}
+
+// GetTable 获取一个Table，指针后移一位。所有Table（含溢出区及溢出页）遍历完后返回ErrTableEnd
 func (ti *TableIterator) GetTable() (common.IndexTable, error) {
-	if ti.tableIndex > ti.options.IndexTableRows {
-		return nil, fmt.Errorf("table end")
+	indexFile := ti.ytfsIndexFile
+	locker, _ := indexFile.store.Lock()
+	if ti.tableIndex > indexFile.lastOverflowTable() {
+		locker.Unlock()
+		return nil, errors.ErrTableEnd
 	}
-	table, err := ti.ytfsIndexFile.loadTableFromStorage(ti.tableIndex)
+
+	table, err := indexFile.loadTableFromStorage(ti.tableIndex)
+	locker.Unlock()
 	if err != nil {
 		return nil, err
 	}
@@ -38,6 +48,7 @@ func (ti *TableIterator) GetTable() (common.IndexTable, error) {
 	return table, nil
 }
 
+// GetNoNilTable 获取下一个非空Table
 func (ti *TableIterator) GetNoNilTable() (common.IndexTable, error) {
 	for {
 		table, err := ti.GetTable()
@@ -45,7 +56,7 @@ func (ti *TableIterator) GetNoNilTable() (common.IndexTable, error) {
 			return nil, err
 		}
 		if table == nil {
-			panic(fmt.Errorf("index.db文件已损坏，无法恢复"))
+			return nil, errors.ErrIndexCorrupted
 		}
 		if len(table) > 0 {
 			return table, nil
@@ -53,6 +64,86 @@ func (ti *TableIterator) GetNoNilTable() (common.IndexTable, error) {
 	}
 }
 
+// TableIndex 返回下一个将要读取的Table序号
+func (ti *TableIterator) TableIndex() uint32 {
+	return ti.tableIndex
+}
+
+// Seek 将指针移动到指定Table，溢出区序号为RangeCapacity，其后为溢出页
+func (ti *TableIterator) Seek(tableIndex uint32) {
+	ti.tableIndex = tableIndex
+}
+
 func (ti *TableIterator) Reset() {
 	ti.tableIndex = 0
 }
+
+// RehashIndexFile 按config的布局(N, M)在path创建新的index文件，将indexFile的全部条目重新散列后写入，
+// 并复制数据结束点及回收列表。复制期间indexFile不能被写入，但可以继续读取。
+func RehashIndexFile(indexFile *YTFSIndexFile, path string, config *opt.Options) error {
+	err := RemoveIndexFile(path, config)
+	if err != nil {
+		return err
+	}
+
+	newIndex, err := OpenYTFSIndexFile(path, config)
+	if err != nil {
+		return err
+	}
+
+	err = rehashIndexFile(indexFile, newIndex)
+	if err == nil {
+		err = newIndex.Sync()
+	}
+	newIndex.Close()
+	return err
+}
+
+func rehashIndexFile(indexFile, newIndex *YTFSIndexFile) error {
+	ti := NewTableIterator(indexFile)
+	items := []common.IndexItem{}
+	for {
+		table, err := ti.GetNoNilTable()
+		if err == errors.ErrTableEnd {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		for key, value := range table {
+			items = append(items, common.IndexItem{Hash: key, OffsetIdx: value})
+		}
+		if len(items) >= 1000 {
+			_, err = newIndex.BatchPut(items)
+			if err != nil {
+				return err
+			}
+			items = items[:0]
+		}
+	}
+
+	locker, _ := indexFile.store.Lock()
+	dataEnd := indexFile.meta.DataEndPoint
+	recycled, err := indexFile.recycledSlots()
+	locker.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// 剩余条目与数据结束点一起提交
+	_, err = newIndex.BatchPutBlocks(items, dataEnd)
+	if err != nil {
+		return err
+	}
+
+	newIndex.begin()
+	for _, value := range recycled {
+		err = newIndex.pushRecycled(value)
+		if err != nil {
+			newIndex.abort()
+			return err
+		}
+	}
+	return newIndex.commit()
+}
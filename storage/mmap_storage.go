@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	types "github.com/yottachain/YTFS/common"
+	"github.com/yottachain/YTFS/errors"
+	"github.com/yottachain/YTFS/opt"
+)
+
+// MmapStorage is a storage which maps its file or device to memory, so that
+// reads and writes are copies from and to the mapping without syscalls.
+// Writes reach the disk when the kernel writes back dirty pages, or when
+// Sync calls msync.
+type MmapStorage struct {
+	readOnly bool
+	mu       sync.RWMutex
+	fd       *FileDesc
+	fp       *os.File
+	data     []byte
+	reader   Reader
+	writer   Writer
+	lock     *FileLock
+}
+
+// OpenMmapStorage maps the file or device of opt.StorageName. A writable
+// storage maps StorageVolume bytes, a file is preallocated to that as file
+// storage is, while a device shorter than that is refused, both with
+// *errors.ErrStorageCapacity. A read-only storage maps no more than the file
+// has, it takes no lock.
+//
+// The storage must be closed after use, by calling Close method.
+func OpenMmapStorage(opt *opt.StorageOptions) (Storage, error) {
+	mmapStorage := &MmapStorage{
+		readOnly: opt.ReadOnly,
+		mu:       sync.RWMutex{},
+		fd: &FileDesc{
+			Type: types.MmapStorageType,
+			Cap:  opt.StorageVolume,
+			Path: opt.StorageName,
+		},
+	}
+
+	flag := os.O_RDONLY
+	if !opt.ReadOnly {
+		flag = os.O_RDWR | os.O_CREATE
+	}
+	fp, err := os.OpenFile(opt.StorageName, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	mmapStorage.fp = fp
+
+	mmapStorage.lock, err = lockStorage(opt.StorageName, opt.ReadOnly)
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+
+	err = mmapStorage.mapFile(opt.StorageVolume)
+	if err != nil {
+		mmapStorage.Close()
+		return nil, err
+	}
+
+	mmapStorage.reader = &mmapFile{storage: mmapStorage}
+	if !opt.ReadOnly {
+		mmapStorage.writer = &mmapFile{storage: mmapStorage}
+	}
+	return mmapStorage, nil
+}
+
+// mapFile maps size bytes of the file, or the whole file if it is shorter
+// and the storage is read-only.
+func (file *MmapStorage) mapFile(size uint64) error {
+	if !file.readOnly {
+		// a sparse file maps as well, but a write to its hole on a full file
+		// system kills the process by SIGBUS instead of failing.
+		err := checkCapacity(file.fp, size, false)
+		if err != nil {
+			return err
+		}
+	}
+	end, err := file.fp.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if uint64(end) < size {
+		if !file.readOnly {
+			return &errors.ErrStorageCapacity{Path: file.fd.Path, Required: size, Available: uint64(end)}
+		}
+		size = uint64(end)
+	}
+	if size == 0 {
+		return nil
+	}
+
+	file.data, err = mmap(file.fp, int(size), !file.readOnly)
+	return err
+}
+
+func (file *MmapStorage) Reader() (Reader, error) {
+	return file.reader, nil
+}
+
+func (file *MmapStorage) Writer() (Writer, error) {
+	if file.readOnly {
+		return nil, errors.ErrReadOnly
+	}
+	return file.writer, nil
+}
+
+// Lock locks the storage. Any subsequent attempt to call Lock will fail
+// until the last lock released.
+// Caller should call Unlock method after use.
+func (file *MmapStorage) Lock() (Locker, error) {
+	file.mu.Lock()
+	return &file.mu, nil
+}
+
+// Close closes the storage, a writable storage is synced before it is
+// unmapped.
+// It is valid to call Close multiple times. Other methods should not be
+// called after the storage has been closed.
+func (file *MmapStorage) Close() error {
+	var err error
+	if file.data != nil {
+		if !file.readOnly {
+			err = msync(file.data)
+		}
+		munmap(file.data)
+		file.data = nil
+	}
+	if file.fp != nil {
+		file.fp.Close()
+		file.fp = nil
+	}
+	file.lock.Unlock()
+	return err
+}
+
+// mmapFile is a Reader and Writer on the mapping of MmapStorage.
+type mmapFile struct {
+	storage *MmapStorage
+	pos     int64
+}
+
+// ReadAt implements io.ReaderAt, bytes beyond the mapping are not read.
+func (f *mmapFile) ReadAt(p []byte, off int64) (int, error) {
+	data := f.storage.data
+	if off >= int64(len(data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt implements io.WriterAt, it returns ErrDataOverflow if p goes
+// beyond the mapping.
+func (f *mmapFile) WriteAt(p []byte, off int64) (int, error) {
+	data := f.storage.data
+	if off+int64(len(p)) > int64(len(data)) {
+		return 0, errors.ErrDataOverflow
+	}
+	return copy(data[off:], p), nil
+}
+
+// Read implements io.Reader.
+func (f *mmapFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+// Write implements io.Writer.
+func (f *mmapFile) Write(p []byte) (int, error) {
+	n, err := f.WriteAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+// Seek implements io.Seeker, end is the end of the mapping.
+func (f *mmapFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += int64(len(f.storage.data))
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+// Sync writes dirty pages of the mapping to disk by msync.
+func (f *mmapFile) Sync() error {
+	if f.storage.data == nil {
+		return nil
+	}
+	return msync(f.storage.data)
+}
+
+// Close does nothing, the mapping is released when the storage is closed.
+func (f *mmapFile) Close() error {
+	return nil
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+
+	types "github.com/yottachain/YTFS/common"
+	"github.com/yottachain/YTFS/errors"
+)
+
+func TestMmapStorageRW(t *testing.T) {
+	config := testOptions()
+	defer os.Remove(config.StorageName)
+	config.StorageType = types.MmapStorageType
+
+	store, err := OpenMmapStorage(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(config.StorageName)
+	if err != nil || uint64(info.Size()) != config.StorageVolume {
+		t.Fatalf("file is not extended to %d: %v, %v", config.StorageVolume, info, err)
+	}
+
+	writer, _ := store.Writer()
+	reader, _ := store.Reader()
+	writer.Seek(20, io.SeekStart)
+	writer.Write([]byte{1, 2, 3})
+	buf := make([]byte, 3)
+	reader.ReadAt(buf, 20)
+	if !reflect.DeepEqual(buf, []byte{1, 2, 3}) {
+		t.Fatalf("read %v", buf)
+	}
+
+	end, _ := writer.Seek(-1, io.SeekEnd)
+	if _, err := writer.Write(buf); err != errors.ErrDataOverflow || uint64(end) != config.StorageVolume-1 {
+		t.Fatalf("write beyond the mapping: %v", err)
+	}
+	if n, err := reader.ReadAt(buf, end); n != 1 || err != io.EOF {
+		t.Fatalf("read beyond the mapping: %d, %v", n, err)
+	}
+	store.Close()
+
+	// data reaches the file.
+	fp, err := os.Open(config.StorageName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	fp.ReadAt(buf, 20)
+	if !reflect.DeepEqual(buf, []byte{1, 2, 3}) {
+		t.Fatalf("file has %v", buf)
+	}
+
+	// file is preallocated as file storage, no file system holds it.
+	volume := config.StorageVolume
+	config.StorageVolume = 1 << 62
+	_, err = OpenMmapStorage(config)
+	capacityErr, ok := err.(*errors.ErrStorageCapacity)
+	if !ok || !capacityErr.Is(errors.ErrStorageSize) || capacityErr.Required != config.StorageVolume || capacityErr.Available < volume {
+		t.Fatalf("storage larger than file system is mapped: %v", err)
+	}
+}
+
+func TestYottaDiskWithMmapStorage(t *testing.T) {
+	config := testOptions()
+	defer os.Remove(config.StorageName)
+	config.StorageType = types.MmapStorageType
+	config.SyncPeriod = 2
+
+	yd, err := OpenYottaDisk(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks, valueBlocks := SplitValues([][]byte{[]byte("short"), make([]byte, config.DataBlockSize+1)}, config.DataBlockSize)
+	err = yd.WriteBlocksContext(context.Background(), 0, blocks, valueBlocks, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	yd.Close()
+
+	// storage is the same file as file storage, read-only or not.
+	for _, storageType := range []types.StorageType{types.FileStorageType, types.MmapStorageType} {
+		config.StorageType, config.ReadOnly = storageType, storageType == types.MmapStorageType
+		yd, err = OpenYottaDisk(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, block := range blocks {
+			data, err := yd.ReadData(types.IndexTableValue(i))
+			if err != nil || !reflect.DeepEqual(data, block) {
+				t.Fatalf("%d block %d: expect %d bytes, got %d, %v", storageType, i, len(block), len(data), err)
+			}
+		}
+		yd.Close()
+	}
+}
@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package storage
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// mmap maps size bytes from the beginning of fp, shared with the file.
+func mmap(fp *os.File, size int, writable bool) ([]byte, error) {
+	prot := syscall.PROT_READ
+	if writable {
+		prot |= syscall.PROT_WRITE
+	}
+	return syscall.Mmap(int(fp.Fd()), 0, size, prot, syscall.MAP_SHARED)
+}
+
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
+
+// msync writes dirty pages of data back to the file, and waits for it.
+func msync(data []byte) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)), syscall.MS_SYNC)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build windows
+// +build windows
+
+package storage
+
+import (
+	"os"
+
+	"github.com/yottachain/YTFS/errors"
+)
+
+// mmap returns ErrStorageType, mmap storage is not supported on windows.
+func mmap(fp *os.File, size int, writable bool) ([]byte, error) {
+	return nil, errors.ErrStorageType
+}
+
+func munmap(data []byte) error {
+	return nil
+}
+
+func msync(data []byte) error {
+	return nil
+}
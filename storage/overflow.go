@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"encoding/binary"
+	"unsafe"
+
+	ydcommon "github.com/yottachain/YTFS/common"
+	"github.com/yottachain/YTFS/errors"
+)
+
+// overflow chain
+//
+// Entries of full ranges spill to the overflow table at RangeCapacity, and
+// when it is full, to overflow pages which are allocated on demand after
+// the recycle list. Header.OverflowPages tells the number of pages in use,
+// page i is table RangeCapacity+i. All tables of the chain but the last one
+// are kept full, so Put always appends to the last one, and a page is freed
+// when it becomes empty.
+//
+// +---------+---------+-------------------------+--------+--------+-----+
+// | tables  | overflow|  recycle list (max)     | page 1 | page 2 | ... |
+// +---------+---------+-------------------------+--------+--------+-----+
+
+// noOverflowPages is OverflowPages of index created before overflow pages,
+// whose header has 0xCD filled in the reserved field.
+const noOverflowPages = 0xCDCDCDCD
+
+// lastOverflowTable reports table index of the last table in overflow chain.
+func (indexFile *YTFSIndexFile) lastOverflowTable() uint32 {
+	return indexFile.meta.RangeCapacity + indexFile.meta.OverflowPages
+}
+
+// maxOverflowPages reports the number of pages which hold entries of all
+// data slots, the chain never grows beyond.
+func (indexFile *YTFSIndexFile) maxOverflowPages() uint32 {
+	slots := indexFile.meta.YtfsCapability / uint64(indexFile.meta.DataBlockSize)
+	return uint32(slots/uint64(indexFile.meta.RangeCoverage)) + 1
+}
+
+// overflowPageOffset is where overflow pages begin, after the recycle list
+// which takes at most a slot for each data block.
+func (indexFile *YTFSIndexFile) overflowPageOffset() int64 {
+	slots := indexFile.meta.YtfsCapability / uint64(indexFile.meta.DataBlockSize)
+	return int64(indexFile.meta.RecycleOffset) + 4 + int64(slots)*int64(indexFile.valueSize())
+}
+
+func (indexFile *YTFSIndexFile) writeOverflowPages() error {
+	valueBuf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(valueBuf, indexFile.meta.OverflowPages)
+	header := indexFile.meta
+	return indexFile.writeAt(valueBuf, int64(unsafe.Offsetof(header.OverflowPages)))
+}
+
+// overflowTable finds the table for a new entry in overflow chain, a new
+// page is allocated if the last one is full.
+func (indexFile *YTFSIndexFile) overflowTable() (uint32, *rangeTable, error) {
+	idx := indexFile.lastOverflowTable()
+	table, err := indexFile.loadTable(idx)
+	if err != nil {
+		return 0, nil, err
+	}
+	if table.len() < indexFile.meta.RangeCoverage {
+		return idx, table, nil
+	}
+
+	if indexFile.meta.OverflowPages >= indexFile.maxOverflowPages() {
+		return 0, nil, errors.ErrRangeFull
+	}
+	indexFile.meta.OverflowPages++
+	err = indexFile.writeOverflowPages()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// page freed earlier is left with size 0.
+	table, err = indexFile.loadTable(idx + 1)
+	if err != nil {
+		return 0, nil, err
+	}
+	return idx + 1, table, nil
+}
+
+// findOverflowRow looks up the key in overflow chain, it reports the table
+// and row of the key, or -1 as row if not found.
+func (indexFile *YTFSIndexFile) findOverflowRow(key ydcommon.IndexTableKey) (*rangeTable, uint32, int, error) {
+	for idx := indexFile.meta.RangeCapacity; idx <= indexFile.lastOverflowTable(); idx++ {
+		table, err := indexFile.loadTable(idx)
+		if err != nil {
+			return nil, 0, -1, err
+		}
+		if row := table.find(key); row >= 0 {
+			return table, idx, row, nil
+		}
+	}
+	return nil, 0, -1, nil
+}
+
+// findOverflowRange looks up an entry of range idx in overflow chain, it
+// reports the table and row of the entry, or -1 as row if not found.
+func (indexFile *YTFSIndexFile) findOverflowRange(idx uint32) (*rangeTable, uint32, int, error) {
+	for ofIdx := indexFile.meta.RangeCapacity; ofIdx <= indexFile.lastOverflowTable(); ofIdx++ {
+		table, err := indexFile.loadTable(ofIdx)
+		if err != nil {
+			return nil, 0, -1, err
+		}
+		for row, item := range table.rows {
+			if indexFile.getTableEntryIndex(item.Hash) == idx {
+				return table, ofIdx, row, nil
+			}
+		}
+	}
+	return nil, 0, -1, nil
+}
+
+// removeOverflowRow removes a row from overflow chain. The hole is filled by
+// the last entry of the chain, so that tables before the last stay full.
+func (indexFile *YTFSIndexFile) removeOverflowRow(tbIndex uint32, table *rangeTable, row int) error {
+	last := indexFile.lastOverflowTable()
+	if tbIndex != last {
+		lastTable, err := indexFile.loadTable(last)
+		if err != nil {
+			return err
+		}
+		if lastTable.len() == 0 {
+			return errors.ErrIndexCorrupted
+		}
+
+		lastRow := int(lastTable.len() - 1)
+		err = indexFile.replaceTableRow(tbIndex, table, row, lastTable.rows[lastRow])
+		if err != nil {
+			return err
+		}
+		table, row = lastTable, lastRow
+	}
+
+	err := indexFile.removeTableRow(last, table, row)
+	if err != nil {
+		return err
+	}
+
+	// free the last page once it is empty.
+	if table.len() == 0 && indexFile.meta.OverflowPages > 0 {
+		indexFile.meta.OverflowPages--
+		return indexFile.writeOverflowPages()
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"os"
+	"path"
+	"testing"
+	"unsafe"
+
+	types "github.com/yottachain/YTFS/common"
+)
+
+func TestOverflowPagesOfOldIndex(t *testing.T) {
+	indexFile, indexPath, config := openTestIndexFile(t)
+	defer os.RemoveAll(path.Dir(indexPath))
+	indexFile.Close()
+
+	// index created before overflow pages has 0xCD in the field.
+	fp, err := os.OpenFile(indexPath, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := types.Header{}
+	fp.WriteAt([]byte{0xCD, 0xCD, 0xCD, 0xCD}, int64(unsafe.Offsetof(header.OverflowPages)))
+	fp.Close()
+
+	indexFile, err = OpenYTFSIndexFile(indexPath, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer indexFile.Close()
+	if indexFile.meta.OverflowPages != 0 {
+		t.Fatalf("expect no overflow page, got %x", indexFile.meta.OverflowPages)
+	}
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/yottachain/YTFS/errors"
+	"github.com/yottachain/YTFS/opt"
+)
+
+// Factory opens a storage by its options, it is what a backend provides.
+// opt.BackendOptions are passed as they are in config, the factory decodes
+// them as it likes.
+//
+// A data storage keeps blocks at offsets below opt.StorageVolume. The index
+// storage has no volume, it grows with its tables, and it is removed and
+// renamed by its opt.StorageName as a file when the index is rebuilt or
+// resized, so a backend of index should keep it at that path.
+type Factory func(opt *opt.StorageOptions) (Storage, error)
+
+var backends = struct {
+	sync.RWMutex
+	factories map[string]Factory
+}{factories: map[string]Factory{}}
+
+func init() {
+	Register(opt.FileBackend, OpenFileStorage)
+	Register(opt.BlockBackend, OpenBlockStorage)
+	Register(opt.MemoryBackend, OpenMemoryStorage)
+	Register(opt.MmapBackend, OpenMmapStorage)
+}
+
+// Register makes a backend available by name, which storages and the index
+// select by Backend and IndexBackend of config. It panics if name is empty
+// or registered already, so that built-in backends can not be replaced, a
+// backend wraps them instead, e.g. to inject faults or throttle I/O.
+func Register(name string, factory Factory) {
+	backends.Lock()
+	defer backends.Unlock()
+
+	if name == "" || factory == nil {
+		panic("storage: Register of empty name or nil factory")
+	}
+	if _, ok := backends.factories[name]; ok {
+		panic(fmt.Sprintf("storage: Register called twice for backend %q", name))
+	}
+	backends.factories[name] = factory
+}
+
+// Backends returns sorted names of the registered backends.
+func Backends() []string {
+	backends.RLock()
+	defer backends.RUnlock()
+
+	names := make([]string, 0, len(backends.factories))
+	for name := range backends.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupBackend(storageConfig *opt.StorageOptions) (Factory, error) {
+	name := storageConfig.BackendName()
+	if name == "" {
+		return nil, errors.ErrStorageType
+	}
+
+	backends.RLock()
+	defer backends.RUnlock()
+	factory, ok := backends.factories[name]
+	if !ok {
+		return nil, fmt.Errorf("%v: %q", errors.ErrStorageBackend, name)
+	}
+	return factory, nil
+}
@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+
+	types "github.com/yottachain/YTFS/common"
+	"github.com/yottachain/YTFS/errors"
+	"github.com/yottachain/YTFS/opt"
+)
+
+var errInjected = errors.New("injected fault")
+
+// faultyStorage is a memory storage whose writes fail as its backend options
+// tell.
+type faultyStorage struct {
+	Storage
+	options struct {
+		FailWrites bool `json:"failWrites"`
+	}
+}
+
+type faultyWriter struct {
+	Writer
+}
+
+func (w faultyWriter) Write(p []byte) (int, error) {
+	return 0, errInjected
+}
+
+func (w faultyWriter) WriteAt(p []byte, off int64) (int, error) {
+	return 0, errInjected
+}
+
+func (s *faultyStorage) Writer() (Writer, error) {
+	writer, err := s.Storage.Writer()
+	if err != nil || !s.options.FailWrites {
+		return writer, err
+	}
+	return faultyWriter{writer}, nil
+}
+
+func openFaultyStorage(config *opt.StorageOptions) (Storage, error) {
+	s := &faultyStorage{}
+	if len(config.BackendOptions) != 0 {
+		if err := json.Unmarshal(config.BackendOptions, &s.options); err != nil {
+			return nil, err
+		}
+	}
+	store, err := OpenMemoryStorage(config)
+	if err != nil {
+		return nil, err
+	}
+	s.Storage = store
+	return s, nil
+}
+
+func init() {
+	Register("test-faulty", openFaultyStorage)
+}
+
+func TestRegisterBackend(t *testing.T) {
+	names := Backends()
+	for _, name := range []string{opt.FileBackend, opt.BlockBackend, opt.MemoryBackend, opt.MmapBackend, "test-faulty"} {
+		found := false
+		for _, registered := range names {
+			found = found || registered == name
+		}
+		if !found {
+			t.Fatalf("backend %s is not registered: %v", name, names)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("built-in backend is replaced")
+		}
+	}()
+	Register(opt.MemoryBackend, openFaultyStorage)
+}
+
+func TestYottaDiskWithBackend(t *testing.T) {
+	config := memoryTestOptions("backend-test-disk")
+	defer DeleteMemoryStorage(config.StorageName)
+	config.StorageType = types.FileStorageType
+	config.Backend = "test-faulty"
+
+	// backend overrides the type, the storage is not created as a file.
+	config.BackendOptions = json.RawMessage(`{"failWrites": true}`)
+	if _, err := OpenYottaDisk(config); err != errInjected {
+		t.Fatal("backend options are not used:", err)
+	}
+	if _, err := os.Stat(config.StorageName); !os.IsNotExist(err) {
+		t.Fatal("storage of backend is opened as a file:", err)
+	}
+	DeleteMemoryStorage(config.StorageName)
+
+	config.BackendOptions = json.RawMessage(`{"failWrites": false}`)
+	yd, err := OpenYottaDisk(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("backend")
+	err = yd.WriteData(0, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := yd.ReadData(0); err != nil || !reflect.DeepEqual(buf[:len(data)], data) {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+	yd.Close()
+
+	config.Backend = "test-unknown"
+	if _, err := OpenYottaDisk(config); err == nil {
+		t.Fatal("storage of unknown backend is opened")
+	}
+	config.Backend, config.StorageType = "", types.StorageType(99)
+	if _, err := OpenYottaDisk(config); err != errors.ErrStorageType {
+		t.Fatal("storage of unknown type is opened:", err)
+	}
+}
@@ -2,6 +2,7 @@
 package storage
 
 import (
+	"context"
 	"io"
 
 	types "github.com/yottachain/YTFS/common"
@@ -63,3 +64,20 @@ type Storage interface {
 	// called after the storage has been closed.
 	Close() error
 }
+
+// lockStorageContext locks the storage, it gives up if ctx is done first.
+func lockStorageContext(ctx context.Context, store Storage) (Locker, error) {
+	var locker Locker
+	var err error
+	lockErr := types.LockContext(ctx, func() {
+		locker, err = store.Lock()
+	}, func() {
+		if err == nil {
+			locker.Unlock()
+		}
+	})
+	if lockErr != nil {
+		return nil, lockErr
+	}
+	return locker, err
+}
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"bytes"
+	"sort"
+	"unsafe"
+
+	"github.com/yottachain/YTFS/cache"
+	ydcommon "github.com/yottachain/YTFS/common"
+)
+
+// rangeTableRowMemSize is the memory taken by a decoded row, and its slot.
+const rangeTableRowMemSize = uint32(unsafe.Sizeof(ydcommon.IndexItem{})) + 4
+
+// rangeTable is a decoded range table, rows are sorted by key.
+type rangeTable struct {
+	rows []ydcommon.IndexItem
+	// slots of rows of a hashed table, nil if the table is not hashed.
+	slots []uint32
+}
+
+func newRangeTable(rows []ydcommon.IndexItem) *rangeTable {
+	return &rangeTable{rows: rows}
+}
+
+func compareKey(a, b ydcommon.IndexTableKey) int {
+	return bytes.Compare(a[:], b[:])
+}
+
+func sortTableRows(rows []ydcommon.IndexItem) {
+	sort.Slice(rows, func(i, j int) bool {
+		return compareKey(rows[i].Hash, rows[j].Hash) < 0
+	})
+}
+
+// search reports the first row whose key is not less than key.
+func (table *rangeTable) search(key ydcommon.IndexTableKey) int {
+	return sort.Search(len(table.rows), func(i int) bool {
+		return compareKey(table.rows[i].Hash, key) >= 0
+	})
+}
+
+func (table *rangeTable) find(key ydcommon.IndexTableKey) int {
+	if row := table.search(key); row < len(table.rows) && table.rows[row].Hash == key {
+		return row
+	}
+	return -1
+}
+
+func (table *rangeTable) get(key ydcommon.IndexTableKey) (ydcommon.IndexTableValue, bool) {
+	row := table.find(key)
+	if row < 0 {
+		return 0, false
+	}
+	return table.rows[row].OffsetIdx, true
+}
+
+func (table *rangeTable) len() uint32 {
+	return uint32(len(table.rows))
+}
+
+// newTableCache creates the cache of decoded range tables, which takes at
+// most cacheSize bytes. It returns nil if cacheSize is 0.
+func newTableCache(rangeCoverage uint32, cacheSize uint64) (*cache.Manager, error) {
+	if cacheSize == 0 {
+		return nil, nil
+	}
+	return cache.NewCacheManager(rangeCoverage*rangeTableRowMemSize, cacheSize, func(key, value interface{}) {})
+}
+
+// loadTable loads a range table through the table cache. The cached table
+// is changed in place by writes of txn, touched tables are evicted if the
+// txn aborts, as the writes never reach the index file.
+func (indexFile *YTFSIndexFile) loadTable(tbIndex uint32) (*rangeTable, error) {
+	if indexFile.tables != nil {
+		if table, ok := indexFile.tables.Get(tbIndex); ok {
+			return table.(*rangeTable), nil
+		}
+	}
+
+	var rows []ydcommon.IndexItem
+	var slots []uint32
+	var err error
+	if indexFile.hashedTables() {
+		rows, slots, err = indexFile.loadTableSlots(tbIndex)
+	} else {
+		rows, err = indexFile.loadTableRows(tbIndex)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if indexFile.meta.Version == indexVersionUnsorted {
+		// index opened read-only before upgrade.
+		sortTableRows(rows)
+	}
+
+	table := newRangeTable(rows)
+	table.slots = slots
+	if indexFile.tables != nil {
+		indexFile.tables.Add(tbIndex, table)
+	}
+	return table, nil
+}
+
+// cachedTable reports the cached table of tbIndex, or nil if it is not in
+// cache. The cache statistics is not affected.
+func (indexFile *YTFSIndexFile) cachedTable(tbIndex uint32) *rangeTable {
+	if indexFile.tables == nil {
+		return nil
+	}
+	if table, ok := indexFile.tables.Peek(tbIndex); ok {
+		return table.(*rangeTable)
+	}
+	return nil
+}
+
+// cacheTableRows writes through rows and their slots to the table. A
+// different copy of the table may be cached since the table is loaded, it is
+// evicted.
+func (indexFile *YTFSIndexFile) cacheTableRows(tbIndex uint32, table *rangeTable, rows []ydcommon.IndexItem, slots []uint32) {
+	table.rows, table.slots = rows, slots
+	if cached := indexFile.cachedTable(tbIndex); cached != nil && cached != table {
+		indexFile.tables.Remove(tbIndex)
+	}
+	if txn := indexFile.txn; txn != nil {
+		txn.tables[tbIndex] = true
+	}
+}
+
+// CacheStat reports usage of the range table cache, it is all zero if
+// the cache is disabled.
+func (indexFile *YTFSIndexFile) CacheStat() cache.Stat {
+	if indexFile.tables == nil {
+		return cache.Stat{}
+	}
+	return indexFile.tables.Stat()
+}
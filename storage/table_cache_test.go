@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	types "github.com/yottachain/YTFS/common"
+	"github.com/yottachain/YTFS/errors"
+)
+
+func TestIndexTableCache(t *testing.T) {
+	indexFile, indexPath, config := openTestIndexFile(t)
+	defer os.RemoveAll(path.Dir(indexPath))
+
+	for i := 1; i <= 3; i++ {
+		err := indexFile.Put(testKey(i), types.IndexTableValue(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before := indexFile.CacheStat()
+	for i := 1; i <= 3; i++ {
+		value, err := indexFile.Get(testKey(i))
+		if err != nil || value != types.IndexTableValue(i) {
+			t.Fatalf("get %d: %v, %v", i, value, err)
+		}
+	}
+	after := indexFile.CacheStat()
+	if after.Hits-before.Hits != 3 || after.Misses != before.Misses {
+		t.Fatalf("expect 3 hits, got %+v -> %+v", before, after)
+	}
+
+	// aborted txn leaves nothing in cache.
+	_, err := indexFile.BatchPut([]types.IndexItem{
+		{Hash: testKey(4), OffsetIdx: 4},
+		{Hash: testKey(1), OffsetIdx: 5},
+	})
+	if err != errors.ErrConflict {
+		t.Fatal(err)
+	}
+	if _, err = indexFile.Get(testKey(4)); err != errors.ErrDataNotFound {
+		t.Fatal(err)
+	}
+
+	_, err = indexFile.Delete(testKey(2), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = indexFile.Get(testKey(2)); err != errors.ErrDataNotFound {
+		t.Fatal(err)
+	}
+	indexFile.Close()
+
+	// cached tables agree with the index file.
+	config.IndexCacheSize = 0
+	indexFile, err = OpenYTFSIndexFile(indexPath, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer indexFile.Close()
+	for _, i := range []int{1, 3} {
+		value, err := indexFile.Get(testKey(i))
+		if err != nil || value != types.IndexTableValue(i) {
+			t.Fatalf("get %d: %v, %v", i, value, err)
+		}
+	}
+	if _, err = indexFile.Get(testKey(2)); err != errors.ErrDataNotFound {
+		t.Fatal(err)
+	}
+	if stat := indexFile.CacheStat(); stat.Hits != 0 || stat.Slots != 0 {
+		t.Fatalf("cache is disabled, got %+v", stat)
+	}
+}
@@ -2,9 +2,11 @@ package storage
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 	"sync"
 	"unsafe"
 
@@ -30,22 +32,53 @@ type diskStatistics struct {
 }
 
 // Capability reports the YottaDisk's capability of datablocks.
-func (disk *YottaDisk) Capability() uint32 {
+func (disk *YottaDisk) Capability() uint64 {
 	return disk.meta.DataCapacity
 }
 
+// Seq reports the seq which seq of writes saved with block keys is not
+// beyond. It reports false if the storage saves keys but not seq, as it is
+// created before version 0.4, seq of its blocks has to be read instead.
+func (disk *YottaDisk) Seq() (uint64, bool) {
+	return disk.meta.Seq, disk.meta.Version == storageVersionCurrent || !disk.hasBlockKey()
+}
+
+// SaveSeq saves seq to header and syncs it, seq of later writes must not be
+// beyond it. Header of older storage is upgraded to the current version.
+// Storage which does not save keys has no seq to save.
+func (disk *YottaDisk) SaveSeq(seq uint64) error {
+	if disk.config.ReadOnly {
+		return errors.ErrReadOnly
+	}
+	if !disk.hasBlockKey() {
+		return nil
+	}
+	locker, _ := disk.store.Lock()
+	disk.meta.Seq = seq
+	disk.meta.Version = storageVersionCurrent
+	locker.Unlock()
+	return disk.Sync()
+}
+
 // Format formats the YottaDisk and reset header.
 func (disk *YottaDisk) Format() error {
+	if disk.config.ReadOnly {
+		return errors.ErrReadOnly
+	}
 	disk.meta.Tag = [4]byte{0, 0, 0, 0}
 	return disk.Sync()
 }
 
-// Sync syncs all pending meta and unflushed writes
+// Sync syncs all pending meta and unflushed writes. It returns ErrReadOnly
+// if the YottaDisk is opened read-only.
 func (disk *YottaDisk) Sync() error {
 	locker, _ := disk.store.Lock()
 	defer locker.Unlock()
 
 	writer, err := disk.store.Writer()
+	if err != nil {
+		return err
+	}
 	writer.Seek(0, io.SeekStart)
 	err = binary.Write(writer, binary.LittleEndian, &disk.meta)
 	if err != nil {
@@ -56,16 +89,29 @@ func (disk *YottaDisk) Sync() error {
 	return nil
 }
 
-// Close closes the YottaDisk.
+// Close closes the YottaDisk, a read-only YottaDisk is closed without sync.
 func (disk *YottaDisk) Close() error {
-	disk.Sync()
+	if !disk.config.ReadOnly {
+		disk.Sync()
+	}
 	disk.store.Close()
 	return nil
 }
 
-// ReadData reads data from low level storage
+// ReadData reads data from low level storage, it returns exactly the bytes
+// written. Storage of version 0.1 does not save the length of data, the
+// whole data block is returned.
 func (disk *YottaDisk) ReadData(dataIndex ydcommon.IndexTableValue) ([]byte, error) {
-	locker, _ := disk.store.Lock()
+	return disk.ReadDataContext(context.Background(), dataIndex)
+}
+
+// ReadDataContext reads data from low level storage, it gives up if ctx is
+// done before the storage is available.
+func (disk *YottaDisk) ReadDataContext(ctx context.Context, dataIndex ydcommon.IndexTableValue) ([]byte, error) {
+	locker, err := lockStorageContext(ctx, disk.store)
+	if err != nil {
+		return nil, err
+	}
 	defer locker.Unlock()
 
 	reader, err := disk.store.Reader()
@@ -76,35 +122,196 @@ func (disk *YottaDisk) ReadData(dataIndex ydcommon.IndexTableValue) ([]byte, err
 		return nil, err
 	}
 
+	if !disk.hasBlockMeta() {
+		return dataBlock, nil
+	}
+
+	metaBuf := make([]byte, disk.meta.MetaSize)
+	reader.Seek(disk.blockMetaPos(dataIndex), io.SeekStart)
+	_, err = io.ReadFull(reader, metaBuf)
+	if err != nil {
+		return nil, err
+	}
+
+	length := binary.LittleEndian.Uint32(metaBuf[8:])
+	if length > disk.meta.DataBlockSize {
+		return nil, errors.ErrDataCorrupted
+	}
+	dataBlock = dataBlock[:length]
+
+	checksumType := ydcommon.ChecksumType(disk.meta.ChecksumType)
+	if checksumType != ydcommon.NoChecksumType && binary.LittleEndian.Uint64(metaBuf) != blockChecksum(checksumType, dataBlock) {
+		return nil, errors.ErrDataCorrupted
+	}
+
 	return dataBlock, nil
 }
 
-// WriteData writes data to low level storage
+// ValueBlocksContext reports the number of consecutive blocks taken by the
+// value which begins from dataIndex. It gives up if ctx is done before the
+// storage is available.
+func (disk *YottaDisk) ValueBlocksContext(ctx context.Context, dataIndex ydcommon.IndexTableValue) (uint32, error) {
+	blocks, _, _, err := disk.ValueKeyContext(ctx, dataIndex)
+	return blocks, err
+}
+
+// ValueKeyContext reports the number of blocks taken by the value which
+// begins from dataIndex as ValueBlocksContext does, with the key saved with
+// it. ok is false if the storage does not save keys.
+func (disk *YottaDisk) ValueKeyContext(ctx context.Context, dataIndex ydcommon.IndexTableValue) (blocks uint32, key BlockKey, ok bool, err error) {
+	if !disk.hasBlockMeta() {
+		return 1, key, false, nil
+	}
+
+	record, err := disk.readBlockRecord(ctx, dataIndex)
+	if err != nil {
+		return 0, key, false, err
+	}
+	blocks = record.Blocks
+	if blocks == 0 {
+		// value of one block written before block count is saved.
+		blocks = 1
+	}
+	return blocks, record.BlockKey, disk.hasBlockKey(), nil
+}
+
+// ContinuesValueContext reports whether the block at dataIndex continues a
+// value which begins from a block before, i.e. its meta record counts no
+// blocks. It is false if the storage has no block meta, which keeps values
+// of one block only.
+func (disk *YottaDisk) ContinuesValueContext(ctx context.Context, dataIndex ydcommon.IndexTableValue) (bool, error) {
+	if !disk.hasBlockMeta() {
+		return false, nil
+	}
+
+	record, err := disk.readBlockRecord(ctx, dataIndex)
+	if err != nil {
+		return false, err
+	}
+	return record.Blocks == 0 && record.Length != 0, nil
+}
+
+// MultiBlockValues reports whether values larger than a data block can be saved
+// to the storage, which needs block meta to tell the blocks of a value.
+func (disk *YottaDisk) MultiBlockValues() bool {
+	return disk.hasBlockMeta()
+}
+
+// readBlockRecord reads the meta record of the block at dataIndex as it is,
+// key is 0 if the storage does not save keys.
+func (disk *YottaDisk) readBlockRecord(ctx context.Context, dataIndex ydcommon.IndexTableValue) (BlockRecord, error) {
+	record := BlockRecord{}
+	locker, err := lockStorageContext(ctx, disk.store)
+	if err != nil {
+		return record, err
+	}
+	defer locker.Unlock()
+
+	reader, err := disk.store.Reader()
+	if err != nil {
+		return record, err
+	}
+	metaBuf := make([]byte, disk.meta.MetaSize)
+	reader.Seek(disk.blockMetaPos(dataIndex), io.SeekStart)
+	_, err = io.ReadFull(reader, metaBuf)
+	if err != nil {
+		return record, err
+	}
+
+	record.Length = binary.LittleEndian.Uint32(metaBuf[8:])
+	record.Blocks = binary.LittleEndian.Uint32(metaBuf[12:])
+	if disk.hasBlockKey() {
+		copy(record.Key[:], metaBuf[blockKeyOffset:])
+		record.Seq = binary.LittleEndian.Uint64(metaBuf[blockKeyOffset+16:])
+	}
+	return record, nil
+}
+
+// WriteData writes data to low level storage. Data larger than a data block
+// takes the following blocks as one value, only its last block can be
+// partial.
 func (disk *YottaDisk) WriteData(dataOffsetIndex ydcommon.IndexTableValue, data []byte) error {
-	if uint32(dataOffsetIndex) >= disk.meta.DataCapacity {
+	return disk.WriteDataContext(context.Background(), dataOffsetIndex, data)
+}
+
+// WriteDataContext writes data to low level storage, it gives up if ctx is
+// done before the storage is available.
+func (disk *YottaDisk) WriteDataContext(ctx context.Context, dataOffsetIndex ydcommon.IndexTableValue, data []byte) error {
+	blocks, valueBlocks := SplitValues([][]byte{data}, disk.meta.DataBlockSize)
+	return disk.WriteBlocksContext(ctx, dataOffsetIndex, blocks, valueBlocks, nil)
+}
+
+// SplitValues splits values to data blocks, and reports the number of blocks
+// of the value which begins from each block, or 0 if the block does not
+// begin a value. A value takes at least one block, only its last block can
+// be partial.
+func SplitValues(values [][]byte, blockSize uint32) ([][]byte, []uint32) {
+	blocks := [][]byte{}
+	valueBlocks := []uint32{}
+	size := int(blockSize)
+	for _, value := range values {
+		n := (len(value) + size - 1) / size
+		if n == 0 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			end := (i + 1) * size
+			if end > len(value) {
+				end = len(value)
+			}
+			blocks = append(blocks, value[i*size:end])
+			valueBlocks = append(valueBlocks, 0)
+		}
+		valueBlocks[len(valueBlocks)-n] = uint32(n)
+	}
+	return blocks, valueBlocks
+}
+
+// WriteBlocksContext writes blocks to consecutive data blocks which begin
+// from dataOffsetIndex, each block can be shorter than DataBlockSize but
+// not larger. valueBlocks tells the number of blocks of the value which
+// begins from each block, as SplitValues reports. keys tells the key of the
+// value which begins from each block, it is saved with the block if the
+// storage supports, and can be nil. It gives up if ctx is done before the
+// storage is available.
+func (disk *YottaDisk) WriteBlocksContext(ctx context.Context, dataOffsetIndex ydcommon.IndexTableValue, blocks [][]byte, valueBlocks []uint32, keys []BlockKey) error {
+	if uint64(dataOffsetIndex)+uint64(len(blocks)) > disk.meta.DataCapacity {
 		return errors.ErrDataOverflow
 	}
 
-	locker, _ := disk.store.Lock()
+	blockSize := int(disk.meta.DataBlockSize)
+	dataBlock := make([]byte, len(blocks)*blockSize, len(blocks)*blockSize)
+	for i, block := range blocks {
+		if len(block) > blockSize {
+			return errors.ErrDataTooLarge
+		}
+		copy(dataBlock[i*blockSize:], block)
+	}
+
+	locker, err := lockStorageContext(ctx, disk.store)
+	if err != nil {
+		return err
+	}
 	defer locker.Unlock()
 
 	writer, err := disk.store.Writer()
-	ydcommon.YottaAssert(len(data) % (int)(disk.meta.DataBlockSize) == 0)
-	dataBlock := make([]byte, len(data), len(data))
-	copy(dataBlock, data)
+	if err != nil {
+		return err
+	}
 	writer.Seek(int64(disk.meta.DataOffset)+int64(disk.meta.DataBlockSize)*int64(dataOffsetIndex), io.SeekStart)
-	//
-	//block := dio.AlignedBlock(dio.BlockSize)
-	//_, err = io.ReadFull(bytes.NewReader(dataBlock), block)
-	//if err != nil {
-	//	return err
-	//}
 	_, err = writer.Write(dataBlock)
 
 	if err != nil {
 		return err
 	}
 
+	if disk.hasBlockMeta() {
+		err = disk.writeBlockMeta(writer, dataOffsetIndex, blocks, valueBlocks, keys)
+		if err != nil {
+			return err
+		}
+	}
+
 	disk.stat.writeOps++
 
 	if disk.stat.writeOps&(disk.config.SyncPeriod-1) == 0 {
@@ -114,11 +321,136 @@ func (disk *YottaDisk) WriteData(dataOffsetIndex ydcommon.IndexTableValue, data
 	return nil
 }
 
+// block meta area layout, one record for each data block, checksum covers
+// the data of length bytes, blocks is the number of blocks of the value
+// which begins from the block. Since version 0.3, key of the value and seq
+// of the write follow, seq is 0 if the block holds no live value.
+// +----------+--------+--------+-----+-----+
+// | checksum | length | blocks | key | seq |
+// +----------+--------+--------+-----+-----+
+const (
+	blockMetaSize  = 40
+	blockKeyOffset = 16
+)
+
+// BlockKey is the key of the value which begins from a data block, with the
+// sequence number of the write. Seq tells which write is the latest if
+// several blocks claim the same key, 0 means no live value.
+type BlockKey struct {
+	Key ydcommon.IndexTableKey
+	Seq uint64
+}
+
+// BlockRecord is the meta record of a data block.
+type BlockRecord struct {
+	Length uint32 // bytes of data in the block
+	Blocks uint32 // blocks of the value which begins from the block, or 0
+	BlockKey
+}
+
+func (disk *YottaDisk) hasBlockMeta() bool {
+	return disk.meta.MetaSize != 0
+}
+
+// hasBlockKey reports whether block meta records save keys.
+func (disk *YottaDisk) hasBlockKey() bool {
+	return disk.meta.MetaSize >= blockMetaSize
+}
+
+func (disk *YottaDisk) blockMetaPos(dataIndex ydcommon.IndexTableValue) int64 {
+	return int64(disk.meta.MetaOffset) + int64(disk.meta.MetaSize)*int64(dataIndex)
+}
+
+// writeBlockMeta writes meta records of blocks, which begin from dataIndex.
+func (disk *YottaDisk) writeBlockMeta(writer Writer, dataIndex ydcommon.IndexTableValue, blocks [][]byte, valueBlocks []uint32, keys []BlockKey) error {
+	metaSize := int(disk.meta.MetaSize)
+	metaBuf := make([]byte, len(blocks)*metaSize)
+	for i, block := range blocks {
+		checksum := blockChecksum(ydcommon.ChecksumType(disk.meta.ChecksumType), block)
+		binary.LittleEndian.PutUint64(metaBuf[i*metaSize:], checksum)
+		binary.LittleEndian.PutUint32(metaBuf[i*metaSize+8:], uint32(len(block)))
+		binary.LittleEndian.PutUint32(metaBuf[i*metaSize+12:], valueBlocks[i])
+		if disk.hasBlockKey() && keys != nil {
+			copy(metaBuf[i*metaSize+blockKeyOffset:], keys[i].Key[:])
+			binary.LittleEndian.PutUint64(metaBuf[i*metaSize+blockKeyOffset+16:], keys[i].Seq)
+		}
+	}
+
+	_, err := writer.Seek(disk.blockMetaPos(dataIndex), io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(metaBuf)
+	return err
+}
+
+// ClearBlockKey marks the value which begins from dataIndex as deleted, so
+// it is not brought back when the index is rebuilt. It does nothing if the
+// storage does not save keys.
+func (disk *YottaDisk) ClearBlockKey(dataIndex ydcommon.IndexTableValue) error {
+	if !disk.hasBlockKey() {
+		return nil
+	}
+
+	locker, _ := disk.store.Lock()
+	defer locker.Unlock()
+
+	writer, err := disk.store.Writer()
+	if err != nil {
+		return err
+	}
+	_, err = writer.Seek(disk.blockMetaPos(dataIndex)+blockKeyOffset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(make([]byte, blockMetaSize-blockKeyOffset))
+	return err
+}
+
+// ReadBlockRecords reads meta records of count blocks which begin from
+// dataIndex. It returns ErrNoBlockKey if the storage does not save keys.
+func (disk *YottaDisk) ReadBlockRecords(dataIndex ydcommon.IndexTableValue, count uint32) ([]BlockRecord, error) {
+	if !disk.hasBlockKey() {
+		return nil, errors.ErrNoBlockKey
+	}
+	if uint64(dataIndex)+uint64(count) > disk.meta.DataCapacity {
+		return nil, errors.ErrDataOverflow
+	}
+
+	locker, _ := disk.store.Lock()
+	defer locker.Unlock()
+
+	reader, err := disk.store.Reader()
+	if err != nil {
+		return nil, err
+	}
+	metaSize := int(disk.meta.MetaSize)
+	metaBuf := make([]byte, int(count)*metaSize)
+	// records beyond end of file storage are never written, they read as 0.
+	_, err = reader.ReadAt(metaBuf, disk.blockMetaPos(dataIndex))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	records := make([]BlockRecord, count)
+	for i := range records {
+		record := metaBuf[i*metaSize:]
+		records[i].Length = binary.LittleEndian.Uint32(record[8:])
+		records[i].Blocks = binary.LittleEndian.Uint32(record[12:])
+		copy(records[i].Key[:], record[blockKeyOffset:])
+		records[i].Seq = binary.LittleEndian.Uint64(record[blockKeyOffset+16:])
+	}
+	return records, nil
+}
+
 // OpenYottaDisk opens or creates a YottaDisk for the given storage.
 // The DB will be created if not exist, unless Error happens.
 //
 // OpenYottaDisk will return ErrConfigXXX if config is incorrect.
 //
+// A read-only YottaDisk is opened only if it has a valid header, which is
+// never modified.
+//
 // The returned YottaDisk instance is safe for concurrent use.
 // The YottaDisk must be closed after use, by calling Close method.
 //
@@ -129,20 +461,27 @@ func OpenYottaDisk(yottaConfig *opt.StorageOptions) (*YottaDisk, error) {
 	}
 
 	header, err := readHeader(storage)
+	if err != nil && yottaConfig.ReadOnly {
+		storage.Close()
+		return nil, err
+	}
 	if err != nil {
 		header, err = initializeStorage(storage, yottaConfig)
 		if err != nil {
+			storage.Close()
 			return nil, err
 		}
 	}
 
 	if !validateHeader(header, yottaConfig) {
-		if opt.IgnoreStorageHeaderErr {
+		if opt.IgnoreStorageHeaderErr && !yottaConfig.ReadOnly {
 			header, err = initializeStorage(storage, yottaConfig)
 			if err != nil {
+				storage.Close()
 				return nil, err
 			}
 		} else {
+			storage.Close()
 			return nil, errors.ErrStorageHeader
 		}
 	}
@@ -160,17 +499,12 @@ func OpenYottaDisk(yottaConfig *opt.StorageOptions) (*YottaDisk, error) {
 }
 
 func openStorage(storageConfig *opt.StorageOptions) (Storage, error) {
-	var storage Storage
-	var err error
-	switch storageConfig.StorageType {
-	case ydcommon.FileStorageType:
-		storage, err = OpenFileStorage(storageConfig)
-	case ydcommon.BlockStorageType:
-		storage, err = OpenBlockStorage(storageConfig)
-	default:
-		err = errors.ErrStorageType
+	factory, err := lookupBackend(storageConfig)
+	if err != nil {
+		return nil, err
 	}
 
+	storage, err := factory(storageConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -193,15 +527,31 @@ func initializeStorage(store Storage, config *opt.StorageOptions) (*ydcommon.Sto
 	ydcommon.YottaAssertMsg(t > h+d, "t should > h + d")
 
 	// write header.
-	dataOffset := uint32(h)
+	// +--------+-------------+-----------------+
+	// | header | data blocks | block meta area |
+	// +--------+-------------+-----------------+
+	// with direct I/O, data blocks and block meta area begin from sectors,
+	// a sector at most is left for the padding.
+	align := uint64(1)
+	if sizer, ok := store.(sectorSizer); ok && sizer.SectorSize() != 0 {
+		align = uint64(sizer.SectorSize())
+	}
+	dataOffset := alignOffset(h, align)
+	if t < dataOffset+align-1 {
+		return nil, errors.ErrStorageSize
+	}
+	dataCapacity := (t - dataOffset - (align - 1)) / (d + blockMetaSize)
+	metaOffset := alignOffset(dataOffset+dataCapacity*d, align)
 	header := ydcommon.StorageHeader{
 		Tag:           [4]byte{'S', 'T', 'O', 'R'},
-		Version:       [4]byte{0x0, '.', 0x0, 0x1},
+		Version:       storageVersionCurrent,
 		DiskCapacity:  t,
 		DataBlockSize: uint32(d),
-		DataOffset:    dataOffset,
-		DataCapacity:  uint32((t - h) / d),
-		Reserved:      uint32((t - h) % d), // left-overs
+		DataOffset:    uint32(dataOffset),
+		DataCapacity:  dataCapacity,
+		MetaOffset:    metaOffset,
+		MetaSize:      blockMetaSize,
+		ChecksumType:  uint32(config.ChecksumType),
 	}
 
 	writer.Seek(0, io.SeekStart)
@@ -214,6 +564,30 @@ func initializeStorage(store Storage, config *opt.StorageOptions) (*ydcommon.Sto
 	return &header, nil
 }
 
+// sectorSizer is implemented by storages whose I/O is aligned to sectors.
+type sectorSizer interface {
+	// SectorSize reports the sector size, or 0 if I/O is not aligned.
+	SectorSize() uint32
+}
+
+// alignOffset rounds off up to a multiple of align.
+func alignOffset(off uint64, align uint64) uint64 {
+	return (off + align - 1) / align * align
+}
+
+// storage versions
+//
+// Storage of 0.1 has no block meta area, block meta records save keys since
+// 0.3. DataCapacity is 64-bit since 0.4, so a storage holds more than
+// MaxUint32 data blocks, it takes the place of the 32-bit DataCapacity and
+// the Reserved word after it, in which left-over bytes were recorded. Seq
+// follows the header since 0.4 too, header of older storage is upgraded
+// when seq is saved to it.
+var (
+	storageVersionNoMeta  = [4]byte{0x0, '.', 0x0, 0x1}
+	storageVersionCurrent = [4]byte{0x0, '.', 0x0, 0x4}
+)
+
 func readHeader(store Storage) (*ydcommon.StorageHeader, error) {
 	reader, err := store.Reader()
 	if err != nil {
@@ -238,5 +612,16 @@ func readHeader(store Storage) (*ydcommon.StorageHeader, error) {
 		return nil, errors.ErrHeadNotFound
 	}
 
+	if header.Version == storageVersionNoMeta {
+		// storage of version 0.1 has no block meta area.
+		header.MetaOffset, header.MetaSize = 0, 0
+		header.ChecksumType = uint32(ydcommon.NoChecksumType)
+	}
+	if header.Version != storageVersionCurrent {
+		// DataCapacity is 32-bit before 0.4, left-over bytes are after it.
+		header.DataCapacity &= math.MaxUint32
+		header.Seq = 0
+	}
+
 	return &header, nil
 }
@@ -1,10 +1,14 @@
 package storage
 
 import (
+	"context"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"reflect"
 	"testing"
+	"unsafe"
 
 	types "github.com/yottachain/YTFS/common"
 	"github.com/yottachain/YTFS/opt"
@@ -50,16 +54,11 @@ func TestValidateYottaDiskWithFileStorage(t *testing.T) {
 	yd.WriteData(0, []byte{0})
 	yd.WriteData(1, []byte{1})
 
-	// header not sync
-	ydRef1, err := OpenYottaDisk(config)
-	if err != nil {
+	// storage is locked until closed
+	_, err = OpenYottaDisk(config)
+	if _, ok := err.(*errors.ErrLocked); !ok {
 		t.Fatal(err)
 	}
-	defer ydRef1.Close()
-
-	if !reflect.DeepEqual(yd.meta, ydRef1.meta) {
-		t.Fatal()
-	}
 
 	yd.Close()
 	// header synx
@@ -98,4 +97,280 @@ func TestOpenYottaDiskWithAnotherConfig(t *testing.T) {
 	if err != errors.ErrStorageHeader {
 		t.Fatal(err)
 	}
-}
\ No newline at end of file
+}
+func TestYottaDiskChecksum(t *testing.T) {
+	for _, checksumType := range []types.ChecksumType{types.CRC32CChecksumType, types.XXHash64ChecksumType} {
+		config := testOptions()
+		config.ChecksumType = checksumType
+		defer os.Remove(config.StorageName)
+
+		yd, err := OpenYottaDisk(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data := make([]byte, 2*config.DataBlockSize)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		err = yd.WriteData(1, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 1; i <= 2; i++ {
+			block, err := yd.ReadData(types.IndexTableValue(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(block, data[(i-1)*int(config.DataBlockSize):i*int(config.DataBlockSize)]) {
+				t.Fatalf("block %d mismatch", i)
+			}
+		}
+
+		// flip one bit of block 2 behind YottaDisk.
+		writer, _ := yd.store.Writer()
+		writer.Seek(int64(yd.meta.DataOffset)+2*int64(config.DataBlockSize)+7, io.SeekStart)
+		writer.Write([]byte{data[config.DataBlockSize+7] ^ 0x10})
+
+		_, err = yd.ReadData(2)
+		if err != errors.ErrDataCorrupted {
+			t.Fatalf("checksum type %d: expect ErrDataCorrupted, got %v", checksumType, err)
+		}
+		_, err = yd.ReadData(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		yd.Close()
+	}
+}
+
+func TestYottaDiskVariableLength(t *testing.T) {
+	config := testOptions()
+	defer os.Remove(config.StorageName)
+
+	yd, err := OpenYottaDisk(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer yd.Close()
+
+	blocks, valueBlocks := SplitValues([][]byte{[]byte("short"), {}, make([]byte, config.DataBlockSize)}, config.DataBlockSize)
+	err = yd.WriteBlocksContext(context.Background(), 3, blocks, valueBlocks, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, block := range blocks {
+		data, err := yd.ReadData(types.IndexTableValue(3 + i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(data, block) {
+			t.Fatalf("block %d: expect %d bytes, got %d", i, len(block), len(data))
+		}
+	}
+
+	err = yd.WriteData(0, make([]byte, config.DataBlockSize+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := yd.ReadData(1)
+	if err != nil || len(data) != 1 {
+		t.Fatalf("expect 1 byte in last block, got %d, %v", len(data), err)
+	}
+	for i, expected := range []uint32{2, 1} {
+		blocks, err := yd.ValueBlocksContext(context.Background(), types.IndexTableValue(i*3))
+		if err != nil || blocks != expected {
+			t.Fatalf("value @%d: expect %d blocks, got %d, %v", i*3, expected, blocks, err)
+		}
+	}
+
+	err = yd.WriteBlocksContext(context.Background(), 0, [][]byte{make([]byte, config.DataBlockSize+1)}, []uint32{1}, nil)
+	if err != errors.ErrDataTooLarge {
+		t.Fatalf("expect ErrDataTooLarge, got %v", err)
+	}
+
+	err = yd.WriteData(types.IndexTableValue(yd.Capability()-1), make([]byte, 2*config.DataBlockSize))
+	if err != errors.ErrDataOverflow {
+		t.Fatalf("expect ErrDataOverflow, got %v", err)
+	}
+}
+
+func TestYottaDiskReadOnly(t *testing.T) {
+	config := testOptions()
+	defer os.Remove(config.StorageName)
+
+	roConfig := *config
+	roConfig.ReadOnly = true
+
+	// no header to read, and read-only disk does not create one.
+	_, err := OpenYottaDisk(&roConfig)
+	if err == nil {
+		t.Fatal("read-only disk is initialized")
+	}
+
+	yd, err := OpenYottaDisk(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = yd.WriteData(0, []byte("yotta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	yd.Close()
+
+	ro1, err := OpenYottaDisk(&roConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro1.Close()
+	ro2, err := OpenYottaDisk(&roConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro2.Close()
+
+	// read-only disks do not keep a writer out, writers exclude each other.
+	writer, err := OpenYottaDisk(config)
+	if err != nil {
+		t.Fatal("disk is not opened for write while it is opened read-only:", err)
+	}
+	defer writer.Close()
+	if _, err = OpenYottaDisk(config); err == nil {
+		t.Fatal("disk is opened for write twice")
+	}
+
+	data, err := ro1.ReadData(0)
+	if err != nil || string(data) != "yotta" {
+		t.Fatal(err)
+	}
+	if err = ro1.WriteData(1, []byte("yotta")); err != errors.ErrReadOnly {
+		t.Fatal(err)
+	}
+	if err = ro1.Format(); err != errors.ErrReadOnly {
+		t.Fatal(err)
+	}
+}
+
+func TestYottaDiskBlockKeys(t *testing.T) {
+	config := testOptions()
+	defer os.Remove(config.StorageName)
+
+	yd, err := OpenYottaDisk(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer yd.Close()
+
+	key := types.IndexTableKey(types.HexToHash("0123456789abcdef"))
+	blocks, valueBlocks := SplitValues([][]byte{make([]byte, config.DataBlockSize+1)}, config.DataBlockSize)
+	err = yd.WriteBlocksContext(context.Background(), 1, blocks, valueBlocks, []BlockKey{{key, 7}, {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := yd.ReadBlockRecords(0, uint32(yd.Capability()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []BlockRecord{{}, {config.DataBlockSize, 2, BlockKey{key, 7}}, {1, 0, BlockKey{}}, {}}
+	if !reflect.DeepEqual(records[:4], expected) {
+		t.Fatalf("expect %v, got %v", expected, records[:4])
+	}
+
+	err = yd.ClearBlockKey(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err = yd.ReadBlockRecords(1, 1)
+	if err != nil || records[0].Seq != 0 || records[0].Blocks != 2 {
+		t.Fatalf("key is not cleared, got %v, %v", records, err)
+	}
+}
+
+func TestYottaDiskDirectIO(t *testing.T) {
+	config := testOptions()
+	defer os.Remove(config.StorageName)
+	config.StorageType = types.BlockStorageType
+	config.StorageVolume = 4 << 20
+	config.DirectIO = true
+
+	yd, err := OpenYottaDisk(config)
+	if err == errors.ErrDirectIO {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	sector := uint64(yd.store.(*BlockStorage).SectorSize())
+	if sector == 0 || uint64(yd.meta.DataOffset)%sector != 0 || yd.meta.MetaOffset%sector != 0 {
+		t.Fatalf("layout is not aligned to %d: %+v", sector, yd.meta)
+	}
+
+	// a value larger than a buffer of the pool, and values of partial blocks.
+	values := [][]byte{make([]byte, directChunkSize+100), []byte("short"), make([]byte, config.DataBlockSize-1)}
+	for _, value := range values {
+		rand.Read(value)
+	}
+	blocks, valueBlocks := SplitValues(values, config.DataBlockSize)
+	err = yd.WriteBlocksContext(context.Background(), 1, blocks, valueBlocks, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBlocks := func(yd *YottaDisk) {
+		for i, block := range blocks {
+			data, err := yd.ReadData(types.IndexTableValue(1 + i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(data, block) {
+				t.Fatalf("block %d: expect %d bytes, got %d", i, len(block), len(data))
+			}
+		}
+	}
+	checkBlocks(yd)
+	yd.Close()
+
+	// the same storage is opened through page cache.
+	config.DirectIO = false
+	yd, err = OpenYottaDisk(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBlocks(yd)
+	yd.Close()
+}
+
+func TestYottaDiskOldDataCapacity(t *testing.T) {
+	config := testOptions()
+	defer os.Remove(config.StorageName)
+
+	yd, err := OpenYottaDisk(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	capacity := yd.Capability()
+	yd.Close()
+
+	// storage of 0.3 keeps left-over bytes in the high 32 bits.
+	file, err := os.OpenFile(config.StorageName, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte{0x0, '.', 0x0, 0x3}, int64(unsafe.Offsetof(types.StorageHeader{}.Version)))
+	file.WriteAt([]byte{0x12, 0x34, 0x56, 0x78}, int64(unsafe.Offsetof(types.StorageHeader{}.DataCapacity))+4)
+	file.Close()
+
+	yd, err = OpenYottaDisk(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer yd.Close()
+	if yd.Capability() != capacity {
+		t.Fatalf("capability of 0.3 storage is %d, want %d", yd.Capability(), capacity)
+	}
+	if !yd.hasBlockKey() {
+		t.Fatal("block keys of 0.3 storage are lost")
+	}
+}
@@ -1,14 +1,18 @@
 package ytfs
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path"
 	"sync"
 
+	"github.com/yottachain/YTFS/cache"
 	ydcommon "github.com/yottachain/YTFS/common"
+	"github.com/yottachain/YTFS/errors"
 	"github.com/yottachain/YTFS/opt"
+	"github.com/yottachain/YTFS/storage"
 	_ "net/http/pprof"
 )
 
@@ -19,6 +23,8 @@ type ytfsStatus struct {
 
 // YTFS is a data block save/load lib based on key-value styled db APIs.
 type YTFS struct {
+	// home dir of this YTFS
+	dir string
 	// config of this YTFS
 	config *opt.Options
 	// key-value db which saves hash <-> position
@@ -27,13 +33,23 @@ type YTFS struct {
 	context *Context
 	// lock of YTFS
 	mutex *sync.Mutex
+	// held by Get from the index lookup to the data read, and by Delete
+	// exclusively, so that a slot is not freed and reused in between, which
+	// storages that do not save keys can not tell.
+	slots sync.RWMutex
 	// saved status
 	savedStatus []ytfsStatus
+	// lock of home dir, against other processes
+	lock *storage.FileLock
 }
 
 // Open opens or creates a YTFS for the given storage.
 // The YTFS will be created if not exist.
 //
+// If config.ReadOnly is set, the YTFS must exist and it is never modified,
+// no lock is taken so that read-only YTFS can be opened together, and while
+// a node writes the YTFS. Put, Delete and Reset return ErrReadOnly then.
+//
 // The returned YTFS instance is safe for concurrent use.
 // The YTFS must be closed after use, by calling Close method.
 // Usage Sample, ref to playground.go:
@@ -65,33 +81,56 @@ func Open(dir string, config *opt.Options) (ytfs *YTFS, err error) {
 
 // NewYTFS create a YTFS by config
 func NewYTFS(dir string, config *opt.Options) (*YTFS, error) {
+	var lock *storage.FileLock
+	var err error
+	if !config.InMemory() {
+		lock, err = lockYTFSDir(dir, config.ReadOnly)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	ytfs := new(YTFS)
 	indexDB, err := NewIndexDB(dir, config)
 	if err != nil {
+		lock.Unlock()
 		return nil, err
 	}
 	context, err := NewContext(dir, config, indexDB.schema.DataEndPoint)
 	if err != nil {
+		indexDB.Close()
+		lock.Unlock()
 		return nil, err
 	}
+	context.recycler = indexDB
+	ytfs.dir = dir
+	ytfs.config = config
 	ytfs.db = indexDB
 	ytfs.context = context
 	ytfs.mutex = new(sync.Mutex)
+	ytfs.lock = lock
 	return ytfs, nil
 }
 
 func openYTFS(dir string, config *opt.Options) (*YTFS, error) {
-	//TODO: file lock to avoid re-open.
+	// YTFS in memory has nothing in dir, the index is locked instead.
+	if config.InMemory() {
+		ytfs, err := openLockedYTFS(dir, config)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println("Open YTFS success @" + dir + " in memory")
+		return ytfs, nil
+	}
+
 	//1. open system dir for YTFS
 	if fi, err := os.Stat(dir); err == nil {
 		// dir/file exists, check if it can be reloaded.
 		if !fi.IsDir() {
 			return nil, ErrDirNameConflict
 		}
-		err := openYTFSDir(dir, config)
-		if err != nil && err != ErrEmptyYTFSDir {
-			return nil, err
-		}
+	} else if config.ReadOnly {
+		return nil, err
 	} else {
 		// create new dir
 		if err := os.MkdirAll(dir, os.ModeDir|os.ModePerm); err != nil {
@@ -99,14 +138,39 @@ func openYTFS(dir string, config *opt.Options) (*YTFS, error) {
 		}
 	}
 
-	// initial a new ytfs.
-	// save config
-	configName := path.Join(dir, "config.json")
-	err := opt.SaveConfig(config, configName)
+	// lock dir before touching anything in it.
+	lock, err := lockYTFSDir(dir, config.ReadOnly)
 	if err != nil {
 		return nil, err
 	}
 
+	ytfs, err := openLockedYTFS(dir, config)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	ytfs.lock = lock
+
+	fmt.Println("Open YTFS success @" + dir)
+	return ytfs, nil
+}
+
+func openLockedYTFS(dir string, config *opt.Options) (*YTFS, error) {
+	err := openYTFSDir(dir, config)
+	if err != nil && (err != ErrEmptyYTFSDir || config.ReadOnly) && !config.InMemory() {
+		return nil, err
+	}
+
+	// initial a new ytfs.
+	// save config
+	if !config.ReadOnly && !config.InMemory() {
+		configName := path.Join(dir, "config.json")
+		err = opt.SaveConfig(config, configName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// open index db
 	indexDB, err := NewIndexDB(dir, config)
 	if err != nil {
@@ -116,19 +180,31 @@ func openYTFS(dir string, config *opt.Options) (*YTFS, error) {
 	//3. open storages
 	context, err := NewContext(dir, config, indexDB.schema.DataEndPoint)
 	if err != nil {
+		indexDB.Close()
 		return nil, err
 	}
+	context.recycler = indexDB
 
 	ytfs := &YTFS{
+		dir:     dir,
+		config:  config,
 		db:      indexDB,
 		context: context,
 		mutex:   new(sync.Mutex),
 	}
-
-	fmt.Println("Open YTFS success @" + dir)
 	return ytfs, nil
 }
 
+// lockYTFSDir takes the lock file of dir, so only one process can open it
+// for write. A read-only YTFS takes no lock, so that inspection tools can
+// attach to a running node, they read what the writer has written so far.
+func lockYTFSDir(dir string, readOnly bool) (*storage.FileLock, error) {
+	if readOnly {
+		return nil, nil
+	}
+	return storage.LockFile(path.Join(dir, "ytfs.lock"), true)
+}
+
 func openYTFSDir(dir string, config *opt.Options) error {
 	configPath := path.Join(dir, "config.json")
 	if _, err := os.Stat(configPath); err == nil {
@@ -156,45 +232,176 @@ func validateYTFSSchema(meta *ydcommon.Header, opt *opt.Options) (*ydcommon.Head
 }
 
 // Get gets the value for the given key. It returns ErrNotFound if the
-// DB does not contains the key.
+// DB does not contains the key, or ErrDataCorrupted if the data does not
+// match its checksum.
 //
 // The returned slice is its own copy, it is safe to modify the contents
 // of the returned slice.
 // It is safe to modify the contents of the argument after Get returns.
 func (ytfs *YTFS) Get(key ydcommon.IndexTableKey) ([]byte, error) {
-	pos, err := ytfs.db.Get(key)
+	return ytfs.GetContext(context.Background(), key)
+}
+
+// GetContext is Get which honours cancellation and deadline of ctx, it
+// returns ctx.Err() if ctx is done while waiting on locks or between I/O
+// steps.
+func (ytfs *YTFS) GetContext(ctx context.Context, key ydcommon.IndexTableKey) ([]byte, error) {
+	err := ydcommon.LockContext(ctx, ytfs.slots.RLock, ytfs.slots.RUnlock)
 	if err != nil {
 		return nil, err
 	}
+	defer ytfs.slots.RUnlock()
 
-	return ytfs.context.Get(pos)
+	pos, err := ytfs.db.GetContext(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// a read-only YTFS shares storages with a writer in another process,
+	// the key saved with the data tells if the slot is reused.
+	return ytfs.context.GetKeyContext(ctx, key, pos)
 }
 
 // Put sets the value for the given key. It panic if there exists any previous value
 // for that key; YottaDisk is not a multi-map.
+// The value can be of any size, Get returns exactly the bytes put. Value
+// larger than DataBlockSize takes consecutive data slots, unless a storage
+// is of version 0.1, which returns ErrDataTooLarge for it.
 // It is safe to modify the contents of the arguments after Put returns but not
 // before.
 func (ytfs *YTFS) Put(key ydcommon.IndexTableKey, buf []byte) error {
-	ytfs.mutex.Lock()
+	return ytfs.PutContext(context.Background(), key, buf)
+}
+
+// PutContext is Put which honours cancellation and deadline of ctx. It
+// returns ctx.Err() if ctx is done while waiting on locks or between I/O
+// steps, and nothing is saved then. Once the index is updated the Put is
+// done, whatever ctx is.
+func (ytfs *YTFS) PutContext(ctx context.Context, key ydcommon.IndexTableKey, buf []byte) error {
+	if ytfs.config.ReadOnly {
+		return errors.ErrReadOnly
+	}
+
+	err := ydcommon.LockContext(ctx, ytfs.mutex.Lock, ytfs.mutex.Unlock)
+	if err != nil {
+		return err
+	}
 	defer ytfs.mutex.Unlock()
-	_, err := ytfs.db.Get(key)
+	_, err = ytfs.db.GetContext(ctx, key)
 	if err == nil {
 		return ErrDataConflict
 	}
+	if err != errors.ErrDataNotFound {
+		// key may exist, an index which can not be read is not written.
+		return err
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	ytfs.saveCurrentYTFS()
+	pos, err := ytfs.context.PutContext(ctx, key, buf)
+	if err != nil {
+		ytfs.restoreYTFS()
+		return err
+	}
+
+	err = ctx.Err()
+	if err == nil {
+		err = ytfs.db.Put(key, ydcommon.IndexTableValue(pos), ytfs.valueBlocks(buf))
+	}
+	if err != nil {
+		// index is not changed, so the storage pointer goes back to agree with it.
+		ytfs.restoreYTFS()
+		if uint64(pos) < ytfs.db.schema.DataEndPoint {
+			// pos is a recycled slot, give it back.
+			ytfs.db.pushRecycled(ydcommon.IndexTableValue(pos))
+		}
+		return err
+	}
+	ytfs.dropSavedYTFS()
+	return nil
+}
 
-	pos, err := ytfs.context.Put(buf)
+// Delete deletes the value for the given key. It returns ErrDataNotFound if
+// the DB does not contains the key.
+// The data slot of deleted value is kept in recycle list and reused by
+// later Put.
+func (ytfs *YTFS) Delete(key ydcommon.IndexTableKey) error {
+	if ytfs.config.ReadOnly {
+		return errors.ErrReadOnly
+	}
+
+	ytfs.mutex.Lock()
+	defer ytfs.mutex.Unlock()
+	return ytfs.delete(key)
+}
+
+func (ytfs *YTFS) delete(key ydcommon.IndexTableKey) error {
+	ytfs.slots.Lock()
+	defer ytfs.slots.Unlock()
+
+	pos, err := ytfs.db.Get(key)
 	if err != nil {
 		return err
 	}
 
-	return ytfs.db.Put(key, ydcommon.IndexTableValue(pos))
+	blocks, err := ytfs.context.ValueBlocks(pos)
+	if err == errors.ErrDataCorrupted {
+		// a wrong block count would recycle slots of live values, the key
+		// is deleted and the slots are left to RebuildIndex.
+		blocks, err = 0, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = ytfs.db.Delete(key, blocks)
+	if err != nil {
+		return err
+	}
+
+	// a crash before the key is cleared brings the value back on rebuild,
+	// which is better than losing a live one.
+	return ytfs.context.ClearKey(pos)
+}
+
+// BatchDelete deletes the values for the given key array. Keys which do not
+// exist are reported in the returned map with ErrDataNotFound, the others are
+// deleted anyway.
+func (ytfs *YTFS) BatchDelete(keys []ydcommon.IndexTableKey) (map[ydcommon.IndexTableKey]byte, error) {
+	if ytfs.config.ReadOnly {
+		return nil, errors.ErrReadOnly
+	}
+
+	ytfs.mutex.Lock()
+	defer ytfs.mutex.Unlock()
+
+	if len(keys) > 1000 {
+		return nil, fmt.Errorf("Batch Size is too big")
+	}
+
+	missing := map[ydcommon.IndexTableKey]byte{}
+	for _, key := range keys {
+		err := ytfs.delete(key)
+		if err == errors.ErrDataNotFound {
+			missing[key] = 1
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(missing) != 0 {
+		return missing, errors.ErrDataNotFound
+	}
+	return nil, nil
 }
 
 /*
  * Batch mode func list
  */
 func (ytfs *YTFS) restoreYTFS() {
-	//TODO: save index
+	// index needs no restore, a failed index update changes nothing.
 	id := len(ytfs.savedStatus) - 1
 	ydcommon.YottaAssert(id >= 0)
 	ytfs.context.restore(ytfs.savedStatus[id].ctxSP)
@@ -202,18 +409,37 @@ func (ytfs *YTFS) restoreYTFS() {
 }
 
 func (ytfs *YTFS) saveCurrentYTFS() {
-	//TODO: restore index
 	ytfs.savedStatus = append(ytfs.savedStatus, ytfsStatus{
 		ctxSP: ytfs.context.save(),
 	})
 }
 
+func (ytfs *YTFS) dropSavedYTFS() {
+	id := len(ytfs.savedStatus) - 1
+	ydcommon.YottaAssert(id >= 0)
+	ytfs.savedStatus = ytfs.savedStatus[:id]
+}
+
 // BatchPut sets the value array for the given key array.
 // It panics if there exists any previous value for that key as YottaDisk is not a multi-map.
 // It is safe to modify the contents of the arguments after Put returns but not
 // before.
 func (ytfs *YTFS) BatchPut(batch map[ydcommon.IndexTableKey][]byte) (map[ydcommon.IndexTableKey]byte, error) {
-	ytfs.mutex.Lock()
+	return ytfs.BatchPutContext(context.Background(), batch)
+}
+
+// BatchPutContext is BatchPut which honours cancellation and deadline of
+// ctx. It returns ctx.Err() if ctx is done while waiting on locks or between
+// I/O steps, and nothing is saved then.
+func (ytfs *YTFS) BatchPutContext(ctx context.Context, batch map[ydcommon.IndexTableKey][]byte) (map[ydcommon.IndexTableKey]byte, error) {
+	if ytfs.config.ReadOnly {
+		return nil, errors.ErrReadOnly
+	}
+
+	err := ydcommon.LockContext(ctx, ytfs.mutex.Lock, ytfs.mutex.Unlock)
+	if err != nil {
+		return nil, err
+	}
 	defer ytfs.mutex.Unlock()
 
 	if len(batch) > 1000 {
@@ -224,37 +450,62 @@ func (ytfs *YTFS) BatchPut(batch map[ydcommon.IndexTableKey][]byte) (map[ydcommo
 	ytfs.saveCurrentYTFS()
 
 	batchIndexes := make([]ydcommon.IndexItem, len(batch))
-	batchBuffer := []byte{}
+	batchKeys := make([]ydcommon.IndexTableKey, len(batch))
+	batchValues := make([][]byte, len(batch))
 	bufCnt := len(batch)
 	i := 0
 	for k, v := range batch {
-		batchBuffer = append(batchBuffer, v...)
+		batchKeys[i] = k
+		batchValues[i] = v
 		batchIndexes[i] = ydcommon.IndexItem{
 			Hash:      k,
 			OffsetIdx: ydcommon.IndexTableValue(0)}
 		i++
 	}
 
-	startPos, err := ytfs.context.BatchPut(bufCnt, batchBuffer)
+	positions, err := ytfs.context.BatchPutContext(ctx, batchKeys, batchValues)
+	if err == nil {
+		err = ctx.Err()
+	}
 	if err != nil {
 		ytfs.restoreYTFS()
 		return nil, err
 	}
 
-	for i := uint32(0); i < uint32(bufCnt); i++ {
+	dataEnd := uint64(0)
+	for i := 0; i < bufCnt; i++ {
 		batchIndexes[i] = ydcommon.IndexItem{
 			Hash:      batchIndexes[i].Hash,
-			OffsetIdx: ydcommon.IndexTableValue(startPos + i)}
+			OffsetIdx: ydcommon.IndexTableValue(positions[i])}
+		if end := uint64(positions[i]) + uint64(ytfs.valueBlocks(batchValues[i])); end > dataEnd {
+			dataEnd = end
+		}
 	}
 
-	conflicts, err := ytfs.db.BatchPut(batchIndexes)
+	conflicts, err := ytfs.db.BatchPut(batchIndexes, dataEnd)
 	if err != nil {
 		ytfs.restoreYTFS()
 		return conflicts, err
 	}
+	ytfs.dropSavedYTFS()
 	return nil, nil
 }
 
+// valueBlocks reports the number of data slots the value takes.
+func (ytfs *YTFS) valueBlocks(value []byte) uint32 {
+	blockSize := int(ytfs.db.schema.DataBlockSize)
+	if len(value) <= blockSize {
+		return 1
+	}
+	return uint32((len(value) + blockSize - 1) / blockSize)
+}
+
+// IndexCacheStat reports usage and hit/miss statistics of the index table
+// cache, which is sized by config.IndexCacheSize.
+func (ytfs *YTFS) IndexCacheStat() cache.Stat {
+	return ytfs.db.CacheStat()
+}
+
 // Meta reports current meta information.
 func (ytfs *YTFS) Meta() *ydcommon.Header {
 	return ytfs.db.schema
@@ -267,12 +518,17 @@ func (ytfs *YTFS) Meta() *ydcommon.Header {
 func (ytfs *YTFS) Close() {
 	ytfs.db.Close()
 	ytfs.context.Close()
+	ytfs.lock.Unlock()
 }
 
 // Reset resets an existed YottaDisk, and make it ready
 // for next put/get operation. so far we do quick format which just
 // erases the header.
 func (ytfs *YTFS) Reset() error {
+	if ytfs.config.ReadOnly {
+		return errors.ErrReadOnly
+	}
+
 	ytfs.db.Reset()
 	ytfs.context.Reset()
 	return nil
@@ -282,26 +538,29 @@ func (ytfs *YTFS) Reset() error {
 func (ytfs *YTFS) Cap() uint64 {
 	cap := uint64(0)
 	for _, stroageCtx := range ytfs.context.storages {
-		cap += uint64(stroageCtx.Cap)
+		cap += stroageCtx.Cap
 	}
 	return cap
 }
 
 // Len report len of YTFS, just like len() of a slice
 func (ytfs *YTFS) Len() uint64 {
-	return ytfs.db.schema.DataEndPoint
+	return ytfs.db.schema.DataEndPoint - uint64(ytfs.db.indexFile.RecycledCount())
 }
 
 // String reports current YTFS status.
 func (ytfs *YTFS) String() string {
 	meta, _ := json.MarshalIndent(ytfs.db.schema, "", "	")
-	// min := (int64)(math.MaxInt64)
-	// max := (int64)(math.MinInt64)
-	// sum := (int64)(0)
-	// table := fmt.Sprintf("Total table Count: %d\n"+
-	// 	"Total saved items: %d\n"+
-	// 	"Maximum table size: %d\n"+
-	// 	"Minimum table size: %d\n"+
-	// 	"Average table size: %d\n", len(disk.index.sizes), sum, max, min, avg)
-	return string(meta) + "\n"
+	stats, err := ytfs.Stats()
+	if err != nil {
+		return string(meta) + "\n"
+	}
+	index := stats.Index
+	table := fmt.Sprintf("Total table Count: %d\n"+
+		"Total saved items: %d\n"+
+		"Maximum table size: %d\n"+
+		"Minimum table size: %d\n"+
+		"Average table size: %.2f\n"+
+		"Overflow items: %d/%d\n", index.Ranges, index.Entries, index.MaxTableSize, index.MinTableSize, index.AvgTableSize, index.OverflowRows, index.OverflowCapacity)
+	return string(meta) + "\n" + table
 }
@@ -2,16 +2,24 @@ package ytfs
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
+	"os"
+	"path"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unsafe"
 
-	"github.com/ethereum/go-ethereum/common"
 	types "github.com/yottachain/YTFS/common"
 	"github.com/yottachain/YTFS/errors"
 	"github.com/yottachain/YTFS/opt"
+	"github.com/yottachain/YTFS/storage"
 )
 
 const (
@@ -24,9 +32,32 @@ func makeData(size int) []byte {
 	return buf
 }
 
+// removeStorages removes files of storages in config.
+func removeStorages(config *opt.Options) {
+	for _, storageOpt := range config.Storages {
+		if storageOpt.StorageType == types.FileStorageType {
+			os.Remove(storageOpt.StorageName)
+		}
+	}
+}
+
+// sameRangeKeys makes n keys which are routed to range 0 of ytfs.
+func sameRangeKeys(ytfs *YTFS, n uint64) []types.IndexTableKey {
+	keys := []types.IndexTableKey{}
+	for i := uint64(0); uint64(len(keys)) < n; i++ {
+		key := types.IndexTableKey{}
+		binary.BigEndian.PutUint64(key[:], i)
+		if ytfs.db.indexFile.GetTableEntryIndex(key) == 0 {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
 func TestNewYTFS(t *testing.T) {
 	rootDir, err := ioutil.TempDir("/tmp", "ytfsTest")
-	config := opt.DefaultOptions()
+	defer os.RemoveAll(rootDir)
+	config := opt.MemoryOptions()
 	// defer os.Remove(config.StorageName)
 
 	yd, err := Open(rootDir, config)
@@ -38,7 +69,8 @@ func TestNewYTFS(t *testing.T) {
 
 func TestErrorOnReadClosedYTFS(t *testing.T) {
 	rootDir, err := ioutil.TempDir("/tmp", "ytfsTest")
-	config := opt.DefaultOptions()
+	defer os.RemoveAll(rootDir)
+	config := opt.MemoryOptions()
 	// defer os.Remove(config.StorageName)
 
 	ytfs, err := Open(rootDir, config)
@@ -46,7 +78,7 @@ func TestErrorOnReadClosedYTFS(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	testKey := (types.IndexTableKey)(common.HexToHash(fmt.Sprintf("%032X", 1)))
+	testKey := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", 1)))
 	bufIn := makeData(dataBlockSize)
 	ytfs.Put(testKey, bufIn)
 	ytfs.Close()
@@ -60,7 +92,8 @@ func TestErrorOnReadClosedYTFS(t *testing.T) {
 
 func TestYTFSBasic(t *testing.T) {
 	rootDir, err := ioutil.TempDir("/tmp", "ytfsTest")
-	config := opt.DefaultOptions()
+	defer os.RemoveAll(rootDir)
+	config := opt.MemoryOptions()
 	// defer os.Remove(config.StorageName)
 
 	ytfs, err := Open(rootDir, config)
@@ -69,7 +102,7 @@ func TestYTFSBasic(t *testing.T) {
 	}
 	defer ytfs.Close()
 
-	testKey := (types.IndexTableKey)(common.HexToHash(fmt.Sprintf("%032X", 1)))
+	testKey := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", 1)))
 	bufIn := makeData(dataBlockSize)
 	ytfs.Put(testKey, bufIn)
 
@@ -85,7 +118,8 @@ func TestYTFSBasic(t *testing.T) {
 
 func TestYTFSRangeOverflow(t *testing.T) {
 	rootDir, err := ioutil.TempDir("/tmp", "ytfsTest")
-	config := opt.DefaultOptions()
+	defer os.RemoveAll(rootDir)
+	config := opt.MemoryOptions()
 
 	ytfs, err := Open(rootDir, config)
 	if err != nil {
@@ -94,9 +128,10 @@ func TestYTFSRangeOverflow(t *testing.T) {
 	defer ytfs.Close()
 
 	dataCaps := uint64(ytfs.Meta().RangeCoverage * 2)
+	keys := sameRangeKeys(ytfs, dataCaps*2)
 	fmt.Printf("Starting insert %d data blocks\n", dataCaps)
 	for i := (uint64)(0); i < dataCaps; i++ {
-		testHash := (types.IndexTableKey)(common.HexToHash(fmt.Sprintf("%X0000000", i)))
+		testHash := keys[i]
 		err := ytfs.Put(testHash, testHash[:])
 		if err != nil {
 			panic(fmt.Sprintf("Error: %v in %d insert", err, i))
@@ -105,7 +140,7 @@ func TestYTFSRangeOverflow(t *testing.T) {
 
 	fmt.Printf("Starting validata %d data blocks\n", dataCaps)
 	for i := (uint64)(0); i < dataCaps; i++ {
-		testHash := (types.IndexTableKey)(common.HexToHash(fmt.Sprintf("%X0000000", i)))
+		testHash := keys[i]
 		buf, err := ytfs.Get(testHash)
 		if err != nil {
 			t.Fatal(fmt.Sprintf("Error: %v in %d check", err, i))
@@ -116,16 +151,61 @@ func TestYTFSRangeOverflow(t *testing.T) {
 		}
 	}
 
-	testHash := (types.IndexTableKey)(common.HexToHash(fmt.Sprintf("%X0000000", dataCaps+1)))
-	err = ytfs.Put(testHash, testHash[:])
-	if err != errors.ErrRangeFull {
-		t.Fatal(fmt.Sprintf("Error: unmeet expected error RangeFull, but meet %v", err))
+	// overflow table is full, the overflow chain grows.
+	for i := dataCaps; i < dataCaps*2; i++ {
+		testHash := keys[i]
+		err := ytfs.Put(testHash, testHash[:])
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Error: %v in %d insert", err, i))
+		}
+	}
+	if ytfs.Meta().OverflowPages != 2 {
+		t.Fatal(fmt.Sprintf("Error: expected 2 overflow pages but get %d", ytfs.Meta().OverflowPages))
+	}
+
+	// delete from range table, overflow table and pages.
+	deleted := map[uint64]bool{}
+	for i := (uint64)(0); i < dataCaps*2; i += 3 {
+		testHash := keys[i]
+		err := ytfs.Delete(testHash)
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Error: %v in %d delete", err, i))
+		}
+		deleted[i] = true
+	}
+	if ytfs.Meta().OverflowPages != 1 {
+		t.Fatal(fmt.Sprintf("Error: expected 1 overflow page but get %d", ytfs.Meta().OverflowPages))
+	}
+
+	for i := (uint64)(0); i < dataCaps*2; i++ {
+		testHash := keys[i]
+		buf, err := ytfs.Get(testHash)
+		if deleted[i] {
+			if err != errors.ErrDataNotFound {
+				t.Fatal(fmt.Sprintf("Error: expected ErrDataNotFound but get %v in %d check", err, i))
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Error: %v in %d check", err, i))
+		}
+		if bytes.Compare(buf[:len(testHash)], testHash[:]) != 0 {
+			t.Fatal(fmt.Sprintf("Fatal: %d test fail, want:\n%x\n, get:\n%x\n", i, testHash, buf[:len(testHash)]))
+		}
+	}
+	count := 0
+	for it := ytfs.NewIterator(); it.Next(); {
+		count++
+	}
+	if uint64(count) != dataCaps*2-uint64(len(deleted)) {
+		t.Fatal(fmt.Sprintf("Error: expected %d items but iterate %d", dataCaps*2-uint64(len(deleted)), count))
 	}
 }
 
 func TestYTFSFullWriteRead(t *testing.T) {
 	rootDir, err := ioutil.TempDir("/tmp", "ytfsTest")
-	config := opt.DefaultOptions()
+	defer os.RemoveAll(rootDir)
+	config := opt.MemoryOptions()
 
 	ytfs, err := Open(rootDir, config)
 	if err != nil {
@@ -136,7 +216,7 @@ func TestYTFSFullWriteRead(t *testing.T) {
 	dataCaps := ytfs.Cap()
 	fmt.Printf("Starting insert %d data blocks\n", dataCaps)
 	for i := (uint64)(0); i < dataCaps; i++ {
-		testHash := (types.IndexTableKey)(common.HexToHash(fmt.Sprintf("%032X", i)))
+		testHash := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", i)))
 		err := ytfs.Put(testHash, testHash[:])
 		if err != nil {
 			panic(fmt.Sprintf("Error: %v in %d insert", err, i))
@@ -145,7 +225,7 @@ func TestYTFSFullWriteRead(t *testing.T) {
 
 	fmt.Printf("Starting validata %d data blocks\n", dataCaps)
 	for i := (uint64)(0); i < dataCaps; i++ {
-		testHash := (types.IndexTableKey)(common.HexToHash(fmt.Sprintf("%032X", i)))
+		testHash := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", i)))
 		buf, err := ytfs.Get(testHash)
 		if err != nil {
 			t.Fatal(fmt.Sprintf("Error: %v in %d check", err, i))
@@ -159,7 +239,8 @@ func TestYTFSFullWriteRead(t *testing.T) {
 
 func TestYTFSFullBatchWriteRead(t *testing.T) {
 	rootDir, err := ioutil.TempDir("/tmp", "ytfsTest")
-	config := opt.DefaultOptions()
+	defer os.RemoveAll(rootDir)
+	config := opt.MemoryOptions()
 
 	ytfs, err := Open(rootDir, config)
 	if err != nil {
@@ -171,7 +252,7 @@ func TestYTFSFullBatchWriteRead(t *testing.T) {
 	fmt.Printf("Starting insert %d data blocks\n", dataCaps)
 	batch := map[types.IndexTableKey][]byte{}
 	for i := (uint64)(0); i < dataCaps; i++ {
-			testHash := (types.IndexTableKey)(common.HexToHash(fmt.Sprintf("%032X", i)))
+			testHash := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", i)))
 			buf := make([]byte, config.DataBlockSize)
 			copy(buf, testHash[:])
 			batch[testHash] = buf
@@ -194,7 +275,7 @@ func TestYTFSFullBatchWriteRead(t *testing.T) {
 
 	fmt.Printf("Starting validata %d data blocks\n", dataCaps)
 	for i := (uint64)(0); i < dataCaps; i++ {
-			testHash := (types.IndexTableKey)(common.HexToHash(fmt.Sprintf("%032X", i)))
+			testHash := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", i)))
 			buf, err := ytfs.Get(testHash)
 			if err != nil {
 					t.Fatal(fmt.Sprintf("Error: %v in %d check", err, i))
@@ -208,7 +289,8 @@ func TestYTFSFullBatchWriteRead(t *testing.T) {
 
 func TestYTFSBatchConflictReport(t *testing.T) {
 	rootDir, err := ioutil.TempDir("/tmp", "ytfsTest")
-	config := opt.DefaultOptions()
+	defer os.RemoveAll(rootDir)
+	config := opt.MemoryOptions()
 
 	ytfs, err := Open(rootDir, config)
 	if err != nil {
@@ -220,7 +302,7 @@ func TestYTFSBatchConflictReport(t *testing.T) {
 	fmt.Printf("Starting insert %d data blocks\n", dataCaps)
 	batch := map[types.IndexTableKey][]byte{}
 	for i := (uint64)(0); i <= 7; i++ {
-		testHash := (types.IndexTableKey)(common.HexToHash(fmt.Sprintf("%032X", i)))
+		testHash := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", i)))
 		buf := make([]byte, config.DataBlockSize)
 		copy(buf, testHash[:])
 		batch[testHash] = buf
@@ -230,10 +312,10 @@ func TestYTFSBatchConflictReport(t *testing.T) {
 				panic(fmt.Sprintf("Error: %v in %d insert", err, i))
 			}
 			// remove 1 item
-			testRemoveHash := (types.IndexTableKey)(common.HexToHash(fmt.Sprintf("%032X", 3)))
+			testRemoveHash := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", 3)))
 			delete(batch, testRemoveHash)
 			// add 1 new
-			testNewHash := (types.IndexTableKey)(common.HexToHash(fmt.Sprintf("%032X", 8)))
+			testNewHash := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", 8)))
 			buf := make([]byte, config.DataBlockSize)
 			copy(buf, testNewHash[:])
 			batch[testNewHash] = buf
@@ -260,7 +342,8 @@ func TestYTFSBatchConflictReport(t *testing.T) {
 
 func TestYTFSConcurrentAccessWriteSameKey(t *testing.T) {
 	rootDir, err := ioutil.TempDir("/tmp", "ytfsTest")
-	config := opt.DefaultOptions()
+	defer os.RemoveAll(rootDir)
+	config := opt.MemoryOptions()
 	// defer os.Remove(config.StorageName)
 
 	ytfs, err := Open(rootDir, config)
@@ -269,7 +352,7 @@ func TestYTFSConcurrentAccessWriteSameKey(t *testing.T) {
 	}
 	defer ytfs.Close()
 
-	testKey := (types.IndexTableKey)(common.HexToHash(fmt.Sprintf("%032X", 1)))
+	testKey := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", 1)))
 	bufIn := makeData(dataBlockSize)
 	errCh := make(chan error)
 	wg := sync.WaitGroup{}
@@ -318,7 +401,8 @@ func TestYTFSConcurrentAccessWriteSameKey(t *testing.T) {
 
 func TestYTFSConcurrentAccessFullWrite(t *testing.T) {
 	rootDir, err := ioutil.TempDir("/tmp", "ytfsTest")
-	config := opt.DefaultOptions()
+	defer os.RemoveAll(rootDir)
+	config := opt.MemoryOptions()
 
 	ytfs, err := Open(rootDir, config)
 	if err != nil {
@@ -335,11 +419,11 @@ func TestYTFSConcurrentAccessFullWrite(t *testing.T) {
 	wg := sync.WaitGroup{}
 	for i := (uint64)(0); i < dataCaps; i++ {
 		wg.Add(1)
-		testHash := (types.IndexTableKey)(common.HexToHash(fmt.Sprintf("%032X", i)))
+		testHash := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", i)))
 		go func(key types.IndexTableKey, round uint64) {
 			err := ytfs.Put(key, key[:])
 			if err != nil {
-				t.Fatal(fmt.Sprintf("Error: %v in %d insert", err, round))
+				t.Error(fmt.Sprintf("Error: %v in %d insert", err, round))
 			}
 			wg.Done()
 		}(testHash, i)
@@ -348,7 +432,7 @@ func TestYTFSConcurrentAccessFullWrite(t *testing.T) {
 	wg.Wait()
 	fmt.Printf("Starting validata %d data blocks\n", dataCaps)
 	for i := (uint64)(0); i < dataCaps; i++ {
-		testHash := (types.IndexTableKey)(common.HexToHash(fmt.Sprintf("%032X", i)))
+		testHash := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", i)))
 		buf, err := ytfs.Get(testHash)
 		if err != nil {
 			t.Fatal(fmt.Sprintf("Error: %v in %d-th check", err, i))
@@ -362,7 +446,8 @@ func TestYTFSConcurrentAccessFullWrite(t *testing.T) {
 
 func TestReloadYTFS(t *testing.T) {
 	rootDir, err := ioutil.TempDir("/tmp", "ytfsTest")
-	config := opt.DefaultOptions()
+	defer os.RemoveAll(rootDir)
+	config := opt.MemoryOptions()
 	ytfs, err := Open(rootDir, config)
 	if err != nil {
 		t.Fatal(err)
@@ -374,7 +459,7 @@ func TestReloadYTFS(t *testing.T) {
 	}
 
 	for i := (uint64)(0); i < 1; i++ {
-		testHash := (types.IndexTableKey)(common.HexToHash(fmt.Sprintf("%032X", i)))
+		testHash := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", i)))
 		err := ytfs.Put(testHash, testHash[:])
 		if err != nil {
 			t.Fatal(fmt.Sprintf("Error: %v in %d insert", err, i))
@@ -386,7 +471,7 @@ func TestReloadYTFS(t *testing.T) {
 	defer ytfsReopen.Close()
 	fmt.Printf("Starting insert %d data blocks\n", dataCaps)
 	for i := (uint64)(1); i < dataCaps; i++ {
-		testHash := (types.IndexTableKey)(common.HexToHash(fmt.Sprintf("%032X", i)))
+		testHash := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", i)))
 		err := ytfsReopen.Put(testHash, testHash[:])
 		if err != nil {
 			t.Fatal(fmt.Sprintf("Error: %v in %d insert", err, i))
@@ -395,7 +480,7 @@ func TestReloadYTFS(t *testing.T) {
 
 	fmt.Printf("Starting validata %d data blocks\n", dataCaps)
 	for i := (uint64)(0); i < dataCaps; i++ {
-		testHash := (types.IndexTableKey)(common.HexToHash(fmt.Sprintf("%032X", i)))
+		testHash := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", i)))
 		buf, err := ytfsReopen.Get(testHash)
 		if err != nil {
 			t.Fatal(fmt.Sprintf("Error: %v in %d check", err, i))
@@ -409,7 +494,9 @@ func TestReloadYTFS(t *testing.T) {
 
 func TestExpendYTFSConfigCheck(t *testing.T) {
 	rootDir, err := ioutil.TempDir("/tmp", "ytfsTest")
+	defer os.RemoveAll(rootDir)
 	config := opt.DefaultOptions()
+	defer removeStorages(config)
 	validConfig := *config
 	ytfs, err := Open(rootDir, config)
 	if err != nil {
@@ -417,35 +504,35 @@ func TestExpendYTFSConfigCheck(t *testing.T) {
 	}
 	ytfs.Close()
 
-	configNew := opt.DefaultOptions()
+	configNew := opt.MemoryOptions()
 	config.Storages = append(config.Storages, configNew.Storages...)
 	dealWithExpensionConfig(t, rootDir, config, nil)
 
-	configNew = opt.DefaultOptions()
+	configNew = opt.MemoryOptions()
 	config.Storages = append(config.Storages, configNew.Storages...)
 	config.DataBlockSize = 1 << 16
 	dealWithExpensionConfig(t, rootDir, config, opt.ErrConfigD)
 	config.DataBlockSize = validConfig.DataBlockSize
 
-	configNew = opt.DefaultOptions()
+	configNew = opt.MemoryOptions()
 	config.Storages = append(config.Storages, configNew.Storages...)
 	config.IndexTableRows = config.IndexTableRows * 2
 	dealWithExpensionConfig(t, rootDir, config, ErrSettingMismatch)
 	config.IndexTableRows = validConfig.IndexTableRows
 
-	configNew = opt.DefaultOptions()
+	configNew = opt.MemoryOptions()
 	config.Storages = append(config.Storages, configNew.Storages...)
 	config.TotalVolumn = config.TotalVolumn * 2
 	dealWithExpensionConfig(t, rootDir, config, ErrSettingMismatch)
 	config.TotalVolumn = validConfig.TotalVolumn
 
-	configNew = opt.DefaultOptions()
+	configNew = opt.MemoryOptions()
 	config.Storages = append(config.Storages, configNew.Storages...)
 	config.Storages[len(config.Storages)-1].StorageVolume = config.TotalVolumn
 	dealWithExpensionConfig(t, rootDir, config, opt.ErrConfigC)
 	config.Storages = config.Storages[:(len(config.Storages) - 1)]
 
-	configNew = opt.DefaultOptions()
+	configNew = opt.MemoryOptions()
 	config.Storages = append(config.Storages, configNew.Storages...)
 	config.Storages[len(config.Storages)-1].DataBlockSize = 1 << 14
 	dealWithExpensionConfig(t, rootDir, config, opt.ErrConfigD)
@@ -464,7 +551,8 @@ func dealWithExpensionConfig(t *testing.T, rootDir string, newConfig *opt.Option
 
 func TestExpendYTFSThenWriteFull(t *testing.T) {
 	rootDir, err := ioutil.TempDir("/tmp", "ytfsTest")
-	config := opt.DefaultOptions()
+	defer os.RemoveAll(rootDir)
+	config := opt.MemoryOptions()
 	ytfs, err := Open(rootDir, config)
 	if err != nil {
 		t.Fatal(err)
@@ -477,21 +565,21 @@ func TestExpendYTFSThenWriteFull(t *testing.T) {
 
 	fmt.Printf("Starting insert %d data blocks\n", dataCaps)
 	for i := (uint64)(0); i < dataCaps; i++ {
-		testHash := (types.IndexTableKey)(common.HexToHash(fmt.Sprintf("%032X", i)))
+		testHash := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", i)))
 		err := ytfs.Put(testHash, testHash[:])
 		if err != nil {
 			t.Fatal(fmt.Sprintf("Error: %v in %d insert", err, i))
 		}
 	}
 
-	testHash := (types.IndexTableKey)(common.HexToHash(fmt.Sprintf("%032X", dataCaps)))
+	testHash := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", dataCaps)))
 	err = ytfs.Put(testHash, testHash[:])
 	if err != errors.ErrDataOverflow {
 		t.Fatal(fmt.Sprintf("Error: expected error is ErrDataOverflow rather than %v", err))
 	}
 	ytfs.Close()
 
-	configNew := opt.DefaultOptions()
+	configNew := opt.MemoryOptions()
 	// Add one file
 	config.Storages = append(config.Storages, configNew.Storages[0])
 
@@ -500,7 +588,7 @@ func TestExpendYTFSThenWriteFull(t *testing.T) {
 	dataCapsNew := ytfsReopen.Cap()
 	fmt.Printf("Starting insert other %d data blocks to expend region\n", dataCapsNew-dataCaps)
 	for i := dataCaps; i < dataCapsNew; i++ {
-		testHash := (types.IndexTableKey)(common.HexToHash(fmt.Sprintf("%032X", i)))
+		testHash := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", i)))
 		err := ytfsReopen.Put(testHash, testHash[:])
 		if err != nil {
 			t.Fatal(fmt.Sprintf("Error: %v in %d insert", err, i))
@@ -509,7 +597,7 @@ func TestExpendYTFSThenWriteFull(t *testing.T) {
 
 	fmt.Printf("Starting validata %d data blocks\n", dataCapsNew)
 	for i := (uint64)(0); i < dataCapsNew; i++ {
-		testHash := (types.IndexTableKey)(common.HexToHash(fmt.Sprintf("%032X", i)))
+		testHash := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", i)))
 		buf, err := ytfsReopen.Get(testHash)
 		if err != nil {
 			t.Fatal(fmt.Sprintf("Error: %v in %d check", err, i))
@@ -520,3 +608,1460 @@ func TestExpendYTFSThenWriteFull(t *testing.T) {
 		}
 	}
 }
+
+func TestYTFSDelete(t *testing.T) {
+	rootDir, err := ioutil.TempDir("/tmp", "ytfsTest")
+	defer os.RemoveAll(rootDir)
+	config := opt.MemoryOptions()
+
+	ytfs, err := Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ytfs.Close()
+
+	testKey := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", 1)))
+	ytfs.Put(testKey, makeData(dataBlockSize))
+	err = ytfs.Delete(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ytfs.Get(testKey)
+	if err != errors.ErrDataNotFound {
+		t.Fatal(fmt.Sprintf("Error: expected error is ErrDataNotFound rather than %v", err))
+	}
+
+	err = ytfs.Delete(testKey)
+	if err != errors.ErrDataNotFound {
+		t.Fatal(fmt.Sprintf("Error: expected error is ErrDataNotFound rather than %v", err))
+	}
+
+	if ytfs.Len() != 0 {
+		t.Fatal(fmt.Sprintf("Error: expected len 0 but get %d", ytfs.Len()))
+	}
+}
+
+func TestYTFSDeleteThenReuseSlot(t *testing.T) {
+	rootDir, err := ioutil.TempDir("/tmp", "ytfsTest")
+	defer os.RemoveAll(rootDir)
+	config := opt.MemoryOptions()
+
+	ytfs, err := Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataCaps := ytfs.Cap()
+	for i := (uint64)(0); i < dataCaps; i++ {
+		testHash := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", i)))
+		err := ytfs.Put(testHash, makeData(dataBlockSize))
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Error: %v in %d insert", err, i))
+		}
+	}
+
+	keys := []types.IndexTableKey{}
+	for i := (uint64)(0); i < dataCaps; i += 2 {
+		keys = append(keys, (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", i))))
+	}
+	missing, err := ytfs.BatchDelete(keys)
+	if err != nil {
+		t.Fatal(fmt.Sprintf("Error: %v, missing %v", err, missing))
+	}
+	ytfs.Close()
+
+	// recycle list survives reopen
+	ytfs, err = Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ytfs.Close()
+
+	bufIns := map[types.IndexTableKey][]byte{}
+	for i := dataCaps; i < dataCaps+uint64(len(keys)); i++ {
+		testHash := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", i)))
+		bufIns[testHash] = makeData(dataBlockSize)
+		err := ytfs.Put(testHash, bufIns[testHash])
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Error: %v in %d insert", err, i))
+		}
+	}
+
+	testHash := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", dataCaps+uint64(len(keys)))))
+	err = ytfs.Put(testHash, makeData(dataBlockSize))
+	if err != errors.ErrDataOverflow {
+		t.Fatal(fmt.Sprintf("Error: expected error is ErrDataOverflow rather than %v", err))
+	}
+
+	for key, bufIn := range bufIns {
+		bufOut, err := ytfs.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Compare(bufIn, bufOut) != 0 {
+			t.Fatal(fmt.Sprintf("Fatal: test fail, want:\n%x\n, get:\n%x\n", bufIn[:10], bufOut[:10]))
+		}
+	}
+}
+
+func TestYTFSGetReusedSlot(t *testing.T) {
+	config := opt.MemoryOptions()
+	ytfs, err := Open("get-reused-slot", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ytfs.Close()
+
+	a := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", 1)))
+	b := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", 2)))
+	err = ytfs.Put(a, makeData(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos, err := ytfs.db.Get(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a is deleted and b takes its slot after a is looked up in the index.
+	err = ytfs.Delete(a)
+	if err == nil {
+		err = ytfs.Put(b, makeData(10))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reused, _ := ytfs.db.Get(b); reused != pos {
+		t.Fatal(fmt.Sprintf("Error: expected slot %d reused but get %d", pos, reused))
+	}
+	if _, err = ytfs.context.GetKeyContext(context.Background(), a, pos); err != errors.ErrDataNotFound {
+		t.Fatal(fmt.Sprintf("Error: expected ErrDataNotFound but get %v", err))
+	}
+	if _, err = ytfs.context.GetKeyContext(context.Background(), b, pos); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestYTFSDeleteFromFullRange(t *testing.T) {
+	rootDir, err := ioutil.TempDir("/tmp", "ytfsTest")
+	defer os.RemoveAll(rootDir)
+	config := opt.MemoryOptions()
+
+	ytfs, err := Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ytfs.Close()
+
+	// all keys go to the same range, the last ones spill to overflow region.
+	dataCaps := uint64(ytfs.Meta().RangeCoverage + 2)
+	keys := sameRangeKeys(ytfs, dataCaps)
+	for i := (uint64)(0); i < dataCaps; i++ {
+		testHash := keys[i]
+		err := ytfs.Put(testHash, makeData(dataBlockSize))
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Error: %v in %d insert", err, i))
+		}
+	}
+
+	for i := (uint64)(0); i < dataCaps; i++ {
+		testHash := keys[i]
+		err := ytfs.Delete(testHash)
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Error: %v in %d delete", err, i))
+		}
+
+		for j := i + 1; j < dataCaps; j++ {
+			testHash := keys[j]
+			_, err := ytfs.Get(testHash)
+			if err != nil {
+				t.Fatal(fmt.Sprintf("Error: %v in %d check after %d deleted", err, j, i))
+			}
+		}
+	}
+}
+
+func TestYTFSIterator(t *testing.T) {
+	rootDir, err := ioutil.TempDir("/tmp", "ytfsTest")
+	defer os.RemoveAll(rootDir)
+	config := opt.MemoryOptions()
+
+	ytfs, err := Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ytfs.Close()
+
+	// the same range, so the last 2 items are saved in overflow region.
+	dataCaps := uint64(ytfs.Meta().RangeCoverage + 2)
+	keys := sameRangeKeys(ytfs, dataCaps)
+	bufIns := map[types.IndexTableKey][]byte{}
+	for i := (uint64)(0); i < dataCaps; i++ {
+		testHash := keys[i]
+		bufIns[testHash] = makeData(dataBlockSize)
+		err := ytfs.Put(testHash, bufIns[testHash])
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Error: %v in %d insert", err, i))
+		}
+	}
+
+	count := 0
+	it := ytfs.NewIterator()
+	for it.Next() {
+		bufIn, ok := bufIns[it.Key()]
+		if !ok {
+			t.Fatal(fmt.Sprintf("Error: unexpected key %x", it.Key()))
+		}
+		bufOut, err := it.Data()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Compare(bufIn, bufOut) != 0 {
+			t.Fatal(fmt.Sprintf("Fatal: test fail, want:\n%x\n, get:\n%x\n", bufIn[:10], bufOut[:10]))
+		}
+		count++
+	}
+	if it.Err() != nil {
+		t.Fatal(it.Err())
+	}
+	if count != len(bufIns) {
+		t.Fatal(fmt.Sprintf("Error: iterated %d items but %d saved", count, len(bufIns)))
+	}
+
+	overflow := 0
+	it.Seek(ytfs.Meta().RangeCapacity)
+	for it.Next() {
+		if it.TableIndex() != ytfs.Meta().RangeCapacity {
+			t.Fatal(fmt.Sprintf("Error: item of table %d after seek to overflow region", it.TableIndex()))
+		}
+		overflow++
+	}
+	if overflow != 2 {
+		t.Fatal(fmt.Sprintf("Error: expected 2 items in overflow region but get %d", overflow))
+	}
+}
+
+func TestYTFSGetCorruptedData(t *testing.T) {
+	rootDir, err := ioutil.TempDir("/tmp", "ytfsTest")
+	defer os.RemoveAll(rootDir)
+	config := opt.DefaultOptions()
+	defer removeStorages(config)
+
+	ytfs, err := Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ytfs.Close()
+
+	testKey := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", 1)))
+	err = ytfs.Put(testKey, makeData(dataBlockSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// bit-rot of the first data block in storage 0.
+	fp, err := os.OpenFile(config.Storages[0].StorageName, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1)
+	fp.ReadAt(buf, int64(unsafe.Sizeof(types.Header{})))
+	fp.WriteAt([]byte{buf[0] ^ 0x1}, int64(unsafe.Sizeof(types.Header{})))
+	fp.Close()
+
+	_, err = ytfs.Get(testKey)
+	if err != errors.ErrDataCorrupted {
+		t.Fatal(fmt.Sprintf("Error: expected error is ErrDataCorrupted rather than %v", err))
+	}
+}
+
+func TestYTFSContextCanceled(t *testing.T) {
+	rootDir, err := ioutil.TempDir("/tmp", "ytfsTest")
+	defer os.RemoveAll(rootDir)
+	config := opt.MemoryOptions()
+
+	ytfs, err := Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ytfs.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	testKey := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", 1)))
+	err = ytfs.PutContext(ctx, testKey, makeData(dataBlockSize))
+	if err != context.Canceled {
+		t.Fatal(fmt.Sprintf("Error: expected error is context.Canceled rather than %v", err))
+	}
+
+	batch := map[types.IndexTableKey][]byte{testKey: makeData(dataBlockSize)}
+	_, err = ytfs.BatchPutContext(ctx, batch)
+	if err != context.Canceled {
+		t.Fatal(fmt.Sprintf("Error: expected error is context.Canceled rather than %v", err))
+	}
+
+	if ytfs.Len() != 0 {
+		t.Fatal(fmt.Sprintf("Error: expected len 0 but get %d", ytfs.Len()))
+	}
+
+	data := makeData(dataBlockSize)
+	err = ytfs.Put(testKey, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ytfs.GetContext(ctx, testKey)
+	if err != context.Canceled {
+		t.Fatal(fmt.Sprintf("Error: expected error is context.Canceled rather than %v", err))
+	}
+
+	buf, err := ytfs.GetContext(context.Background(), testKey)
+	if err != nil || !bytes.Equal(buf, data) {
+		t.Fatal(fmt.Sprintf("Error: get data mismatch, %v", err))
+	}
+}
+
+func TestYTFSContextDeadlineOnLock(t *testing.T) {
+	rootDir, err := ioutil.TempDir("/tmp", "ytfsTest")
+	defer os.RemoveAll(rootDir)
+	config := opt.MemoryOptions()
+
+	ytfs, err := Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ytfs.Close()
+
+	// a stuck writer holds the lock.
+	ytfs.mutex.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	testKey := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", 1)))
+	err = ytfs.PutContext(ctx, testKey, makeData(dataBlockSize))
+	if err != context.DeadlineExceeded {
+		t.Fatal(fmt.Sprintf("Error: expected error is context.DeadlineExceeded rather than %v", err))
+	}
+	ytfs.mutex.Unlock()
+
+	// lock is not leaked by the caller which gave up.
+	err = ytfs.Put(testKey, makeData(dataBlockSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestYTFSVariableLength(t *testing.T) {
+	rootDir, err := ioutil.TempDir("/tmp", "ytfsTest")
+	defer os.RemoveAll(rootDir)
+	config := opt.MemoryOptions()
+
+	ytfs, err := Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ytfs.Close()
+
+	values := map[types.IndexTableKey][]byte{}
+	for i, size := range []int{1, 100, dataBlockSize - 1, dataBlockSize} {
+		testKey := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", i)))
+		values[testKey] = makeData(size)
+		err = ytfs.Put(testKey, values[testKey])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	batch := map[types.IndexTableKey][]byte{}
+	for i, size := range []int{7, dataBlockSize / 2} {
+		testKey := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", 100+i)))
+		batch[testKey] = makeData(size)
+		values[testKey] = batch[testKey]
+	}
+	_, err = ytfs.BatchPut(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, value := range values {
+		buf, err := ytfs.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, value) {
+			t.Fatal(fmt.Sprintf("Error: expected %d bytes but get %d", len(value), len(buf)))
+		}
+	}
+
+	if ytfs.Len() != uint64(len(values)) {
+		t.Fatal(fmt.Sprintf("Error: expected len %d but get %d", len(values), ytfs.Len()))
+	}
+}
+
+func TestYTFSMultiBlockValue(t *testing.T) {
+	rootDir, err := ioutil.TempDir("/tmp", "ytfsTest")
+	defer os.RemoveAll(rootDir)
+	config := opt.MemoryOptions()
+
+	ytfs, err := Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ytfs.Close()
+
+	values := map[types.IndexTableKey][]byte{}
+	for i, size := range []int{dataBlockSize + 1, 3 * dataBlockSize, 10} {
+		testKey := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", i)))
+		values[testKey] = makeData(size)
+		err = ytfs.Put(testKey, values[testKey])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	batch := map[types.IndexTableKey][]byte{}
+	for i, size := range []int{2*dataBlockSize + 5, 1, dataBlockSize} {
+		testKey := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", 100+i)))
+		batch[testKey] = makeData(size)
+		values[testKey] = batch[testKey]
+	}
+	_, err = ytfs.BatchPut(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2 + 3 + 1 + 3 + 1 + 1 slots
+	if ytfs.Len() != 11 {
+		t.Fatal(fmt.Sprintf("Error: expected len 11 but get %d", ytfs.Len()))
+	}
+
+	for key, value := range values {
+		buf, err := ytfs.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, value) {
+			t.Fatal(fmt.Sprintf("Error: expected %d bytes but get %d", len(value), len(buf)))
+		}
+	}
+
+	// all slots of a multi-block value are recycled.
+	testKey := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", 1)))
+	err = ytfs.Delete(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ytfs.Len() != 8 {
+		t.Fatal(fmt.Sprintf("Error: expected len 8 but get %d", ytfs.Len()))
+	}
+}
+
+func TestYTFSCorruptedBlockCount(t *testing.T) {
+	config := opt.MemoryOptions()
+	ytfs, err := Open("corrupted-block-count", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ytfs.Close()
+
+	a := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", 1)))
+	b := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", 2)))
+	data := makeData(10)
+	for _, key := range []types.IndexTableKey{a, b} {
+		err = ytfs.Put(key, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// block count of a claims the slot of b.
+	pos, err := ytfs.db.Get(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disk := ytfs.context.storages[0].Disk
+	err = disk.WriteBlocksContext(context.Background(), pos, [][]byte{data}, []uint32{2}, []storage.BlockKey{{Key: a, Seq: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = ytfs.Get(a); err != errors.ErrDataCorrupted {
+		t.Fatal(fmt.Sprintf("Error: expected ErrDataCorrupted but get %v", err))
+	}
+	err = ytfs.Delete(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recycled := ytfs.db.indexFile.RecycledCount(); recycled != 0 {
+		t.Fatal(fmt.Sprintf("Error: expected no slot recycled but get %d", recycled))
+	}
+	if buf, err := ytfs.Get(b); err != nil || !bytes.Equal(buf, data) {
+		t.Fatal(fmt.Sprintf("Error: %v, value of b is lost", err))
+	}
+}
+
+func TestYTFSMultiBlockValueOfOldStorage(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "ytfsTest")
+	defer os.RemoveAll(rootDir)
+	config := opt.DefaultOptions()
+	defer removeStorages(config)
+
+	ytfs, err := Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ytfs.Close()
+
+	// storage of version 0.1 has no block meta.
+	for _, storageOpt := range config.Storages {
+		file, err := os.OpenFile(storageOpt.StorageName, os.O_RDWR, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = file.WriteAt([]byte{0x0, '.', 0x0, 0x1}, int64(unsafe.Offsetof(types.StorageHeader{}.Version)))
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ytfs, err = Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ytfs.Close()
+	testKey := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", 1)))
+	if err = ytfs.Put(testKey, makeData(dataBlockSize+1)); err != errors.ErrDataTooLarge {
+		t.Fatal(fmt.Sprintf("Error: expected ErrDataTooLarge but get %v", err))
+	}
+	batch := map[types.IndexTableKey][]byte{testKey: makeData(dataBlockSize + 1)}
+	if _, err = ytfs.BatchPut(batch); err != errors.ErrDataTooLarge {
+		t.Fatal(fmt.Sprintf("Error: expected ErrDataTooLarge from batch but get %v", err))
+	}
+	if err = ytfs.Put(testKey, makeData(dataBlockSize)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestYTFSLockHomeDir(t *testing.T) {
+	rootDir, err := ioutil.TempDir("/tmp", "ytfsTest")
+	defer os.RemoveAll(rootDir)
+	config := opt.DefaultOptions()
+	defer removeStorages(config)
+
+	ytfs, err := Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Open(rootDir, config)
+	locked, ok := err.(*errors.ErrLocked)
+	if !ok {
+		t.Fatal(fmt.Sprintf("Error: expected ErrLocked but get %v", err))
+	}
+	if locked.PID != os.Getpid() {
+		t.Fatal(fmt.Sprintf("Error: expected pid %d but get %d", os.Getpid(), locked.PID))
+	}
+
+	ytfs.Close()
+	ytfs, err = Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ytfs.Close()
+}
+
+func TestYTFSReadOnly(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "ytfsTest")
+	defer os.RemoveAll(rootDir)
+	config := opt.DefaultOptions()
+	defer removeStorages(config)
+
+	ytfs, err := Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testKey := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", 1)))
+	bufIn := makeData(dataBlockSize)
+	err = ytfs.Put(testKey, bufIn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roConfig := *config
+	roConfig.Storages = append([]opt.StorageOptions{}, config.Storages...)
+	roConfig.ReadOnly = true
+
+	// read-only YTFS attaches to the running writer, and to each other.
+	ro1, err := Open(rootDir, &roConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ro2, err := Open(rootDir, &roConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ro1.Get(testKey)
+	if err != nil || !bytes.Equal(buf, bufIn) {
+		t.Fatal(fmt.Sprintf("Error: get from read-only YTFS failed, %v", err))
+	}
+	ro2.Close()
+
+	// writers still exclude each other.
+	if _, err = Open(rootDir, config); err == nil {
+		t.Fatal("Error: open for write while YTFS is opened for write")
+	}
+	ytfs.Close()
+
+	files := []string{path.Join(rootDir, "index.db"), config.Storages[0].StorageName}
+	before := make([][]byte, len(files))
+	for i, name := range files {
+		before[i], _ = ioutil.ReadFile(name)
+	}
+
+	newKey := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", 2)))
+	if err = ro1.Put(newKey, bufIn); err != errors.ErrReadOnly {
+		t.Fatal(fmt.Sprintf("Error: expected ErrReadOnly but get %v", err))
+	}
+	if _, err = ro1.BatchPut(map[types.IndexTableKey][]byte{newKey: bufIn}); err != errors.ErrReadOnly {
+		t.Fatal(fmt.Sprintf("Error: expected ErrReadOnly but get %v", err))
+	}
+	if err = ro1.Delete(testKey); err != errors.ErrReadOnly {
+		t.Fatal(fmt.Sprintf("Error: expected ErrReadOnly but get %v", err))
+	}
+	if err = ro1.Reset(); err != errors.ErrReadOnly {
+		t.Fatal(fmt.Sprintf("Error: expected ErrReadOnly but get %v", err))
+	}
+	ro1.Close()
+
+	for i, name := range files {
+		after, _ := ioutil.ReadFile(name)
+		if !bytes.Equal(before[i], after) {
+			t.Fatal(fmt.Sprintf("Error: %s is modified by read-only YTFS", name))
+		}
+	}
+
+	if _, err = Open(path.Join(rootDir, "none"), &roConfig); err == nil {
+		t.Fatal("Error: read-only YTFS is created")
+	}
+}
+
+func TestYTFSRebuildIndex(t *testing.T) {
+	rootDir, err := ioutil.TempDir("/tmp", "ytfsTest")
+	defer os.RemoveAll(rootDir)
+	config := opt.DefaultOptions()
+	defer removeStorages(config)
+
+	ytfs, err := Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[types.IndexTableKey][]byte{}
+	for i, size := range []int{dataBlockSize + 1, 10, 3 * dataBlockSize, dataBlockSize} {
+		testKey := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", i)))
+		values[testKey] = makeData(size)
+		err = ytfs.Put(testKey, values[testKey])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	batch := map[types.IndexTableKey][]byte{}
+	for i, size := range []int{2*dataBlockSize + 5, 1} {
+		testKey := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", 100+i)))
+		batch[testKey] = makeData(size)
+		values[testKey] = batch[testKey]
+	}
+	_, err = ytfs.BatchPut(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// deleted values are not brought back, their slots are reused.
+	deleted := []types.IndexTableKey{}
+	for _, i := range []int{1, 2} {
+		testKey := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", i)))
+		err = ytfs.Delete(testKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		delete(values, testKey)
+		deleted = append(deleted, testKey)
+	}
+	testKey := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", 200)))
+	values[testKey] = makeData(7)
+	err = ytfs.Put(testKey, values[testKey])
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataLen := ytfs.Len()
+	ytfs.Close()
+
+	err = os.Remove(path.Join(rootDir, "index.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RebuildIndex(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ytfs, err = Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ytfs.Close()
+	if ytfs.Len() != dataLen {
+		t.Fatal(fmt.Sprintf("Error: expected len %d but get %d", dataLen, ytfs.Len()))
+	}
+	for key, value := range values {
+		buf, err := ytfs.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, value) {
+			t.Fatal(fmt.Sprintf("Error: expected %d bytes but get %d", len(value), len(buf)))
+		}
+	}
+	for _, key := range deleted {
+		if _, err = ytfs.Get(key); err != errors.ErrDataNotFound {
+			t.Fatal(fmt.Sprintf("Error: expected ErrDataNotFound but get %v", err))
+		}
+	}
+}
+
+func TestRebuildBitmap(t *testing.T) {
+	b := newBitmap(200)
+	for _, i := range []uint64{0, 63, 64, 130} {
+		b.set(i)
+	}
+	b.clear(63)
+	for _, c := range []struct {
+		slot, prev uint64
+	}{{0, 0}, {63, 0}, {64, 64}, {129, 64}, {130, 130}, {199, 130}} {
+		if prev, ok := b.prev(c.slot); !ok || prev != c.prev {
+			t.Fatalf("prev of %d: expect %d but get %d, %v", c.slot, c.prev, prev, ok)
+		}
+	}
+	b.clear(0)
+	if _, ok := b.prev(63); ok || b.get(0) || !b.get(130) {
+		t.Fatal("bit 0 is not cleared")
+	}
+}
+
+func TestYTFSResizeIndex(t *testing.T) {
+	rootDir, err := ioutil.TempDir("/tmp", "ytfsTest")
+	defer os.RemoveAll(rootDir)
+	config := opt.DefaultOptions()
+	defer removeStorages(config)
+
+	ytfs, err := Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataCaps := ytfs.Cap()
+	values := map[types.IndexTableKey][]byte{}
+	for i := (uint64)(0); i < dataCaps; i++ {
+		testHash := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", i)))
+		values[testHash] = makeData(10)
+		err := ytfs.Put(testHash, values[testHash])
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Error: %v in %d insert", err, i))
+		}
+	}
+	deleted := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", 3)))
+	err = ytfs.Delete(deleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(values, deleted)
+
+	if err = ytfs.ResizeIndex(config.IndexTableRows/2, config.TotalVolumn); err != ErrIndexShrink {
+		t.Fatal(fmt.Sprintf("Error: expected ErrIndexShrink but get %v", err))
+	}
+
+	// Get is served during resize.
+	done := make(chan error)
+	go func() {
+		for key, value := range values {
+			buf, err := ytfs.Get(key)
+			if err == nil && !bytes.Equal(buf, value) {
+				err = fmt.Errorf("Error: get %x returns wrong data", key)
+			}
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	rows, totalVolume := config.IndexTableRows*2, config.TotalVolumn*2
+	err = ytfs.ResizeIndex(rows, totalVolume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if ytfs.Meta().RangeCapacity != rows || ytfs.Meta().YtfsCapability != totalVolume {
+		t.Fatal(fmt.Sprintf("Error: index is not resized, %+v", ytfs.Meta()))
+	}
+	if ytfs.Len() != dataCaps-1 {
+		t.Fatal(fmt.Sprintf("Error: expected len %d but get %d", dataCaps-1, ytfs.Len()))
+	}
+	ytfs.Close()
+
+	// config is saved, and the recycled slot is kept.
+	ytfs, err = Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ytfs.Close()
+	for key, value := range values {
+		buf, err := ytfs.Get(key)
+		if err != nil || !bytes.Equal(buf, value) {
+			t.Fatal(fmt.Sprintf("Error: get %x after resize, %v", key, err))
+		}
+	}
+	if _, err = ytfs.Get(deleted); err != errors.ErrDataNotFound {
+		t.Fatal(fmt.Sprintf("Error: expected ErrDataNotFound but get %v", err))
+	}
+	testHash := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", dataCaps)))
+	err = ytfs.Put(testHash, makeData(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyFilter(t *testing.T) {
+	filter := newKeyFilter(1000)
+	keys := make([]types.IndexTableKey, 1000)
+	for i := range keys {
+		keys[i] = (types.IndexTableKey)(types.BytesToHash(makeData(16)))
+		filter.add(keys[i])
+	}
+	for i := 0; i < len(keys); i += 2 {
+		filter.remove(keys[i])
+	}
+	if filter.full || filter.count != 500 {
+		t.Fatal(fmt.Sprintf("Error: expected 500 keys but get %d, full %v", filter.count, filter.full))
+	}
+	for i := 1; i < len(keys); i += 2 {
+		if !filter.mayContain(keys[i]) {
+			t.Fatal(fmt.Sprintf("Error: key %x is missing", keys[i]))
+		}
+	}
+
+	positives := 0
+	for i := 0; i < 10000; i++ {
+		if filter.mayContain((types.IndexTableKey)(types.BytesToHash(makeData(16)))) {
+			positives++
+		}
+	}
+	if positives > 100 {
+		t.Fatal(fmt.Sprintf("Error: %d false positives in 10000 lookups", positives))
+	}
+}
+
+func TestYTFSKeyFilterFile(t *testing.T) {
+	rootDir, err := ioutil.TempDir("/tmp", "ytfsTest")
+	defer os.RemoveAll(rootDir)
+	config := opt.DefaultOptions()
+	defer removeStorages(config)
+
+	ytfs, err := Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []types.IndexTableKey{}
+	for i := 0; i < 10; i++ {
+		testKey := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", i)))
+		err = ytfs.Put(testKey, makeData(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, testKey)
+	}
+	err = ytfs.Delete(keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ytfs.Close()
+
+	filterName := path.Join(rootDir, "index.db.filter")
+	if _, err = os.Stat(filterName); err != nil {
+		t.Fatal(err)
+	}
+
+	// filter file is removed while YTFS is opened for write.
+	ytfs, err = Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ytfs.Close()
+	if _, err = os.Stat(filterName); !os.IsNotExist(err) {
+		t.Fatal(fmt.Sprintf("Error: expected filter file removed but get %v", err))
+	}
+	if ytfs.db.filter.count != 9 {
+		t.Fatal(fmt.Sprintf("Error: expected 9 keys in filter but get %d", ytfs.db.filter.count))
+	}
+	for _, key := range keys[1:] {
+		if _, err = ytfs.Get(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = ytfs.Get(keys[0]); err != errors.ErrDataNotFound {
+		t.Fatal(fmt.Sprintf("Error: expected ErrDataNotFound but get %v", err))
+	}
+}
+
+func TestYTFSKeyFilterSize(t *testing.T) {
+	for _, size := range []int64{-1, 4} {
+		config := opt.MemoryOptions()
+		config.KeyFilterSize = size
+		ytfs, err := Open(fmt.Sprintf("key-filter-%d", size), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys := []types.IndexTableKey{}
+		for i := 0; i < 32; i++ {
+			testKey := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", i)))
+			err = ytfs.Put(testKey, makeData(10))
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, testKey)
+		}
+		for _, key := range keys {
+			if _, err = ytfs.Get(key); err != nil {
+				t.Fatal(fmt.Sprintf("Error: %v of key filter size %d", err, size))
+			}
+		}
+
+		stats, err := ytfs.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := KeyFilterStat{}
+		if size > 0 {
+			expect = KeyFilterStat{Capacity: uint64(size), Keys: stats.KeyFilter.Keys, Full: true}
+		}
+		if stats.KeyFilter != expect {
+			t.Fatal(fmt.Sprintf("Error: expected key filter %+v but get %+v", expect, stats.KeyFilter))
+		}
+		ytfs.Close()
+	}
+}
+
+func TestIndexDBKeyFilterOnConflict(t *testing.T) {
+	config := opt.MemoryOptions()
+	ytfs, err := Open("key-filter-conflict", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ytfs.Close()
+
+	testKey := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", 1)))
+	err = ytfs.Put(testKey, makeData(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a key is in the filter before the index is written, a failed write
+	// takes it back.
+	if err = ytfs.db.Put(testKey, 1, 1); err == nil {
+		t.Fatal("Error: key is put twice")
+	}
+	items := []types.IndexItem{{Hash: testKey, OffsetIdx: 2}}
+	if _, err = ytfs.db.BatchPut(items, 3); err == nil {
+		t.Fatal("Error: key is put twice by batch")
+	}
+	if ytfs.db.filter.count != 1 {
+		t.Fatal(fmt.Sprintf("Error: expected 1 key in filter but get %d", ytfs.db.filter.count))
+	}
+	if _, err = ytfs.Get(testKey); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestYTFSStats(t *testing.T) {
+	rootDir, err := ioutil.TempDir("/tmp", "ytfsTest")
+	config := opt.MemoryOptions()
+	defer os.RemoveAll(rootDir)
+
+	ytfs, err := Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataCaps := ytfs.Cap()
+	for i := (uint64)(0); i < dataCaps; i++ {
+		testHash := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", i)))
+		err := ytfs.Put(testHash, makeData(10))
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Error: %v in %d insert", err, i))
+		}
+	}
+	for i := (uint64)(0); i < 10; i++ {
+		ytfs.Get((types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", i))))
+	}
+	err = ytfs.Delete((types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", 3))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkStats := func(ytfs *YTFS) *Stats {
+		stats, err := ytfs.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		index := stats.Index
+		if index.Entries != dataCaps-1 || stats.Len != dataCaps-1 || stats.Recycled != 1 {
+			t.Fatal(fmt.Sprintf("Error: wrong entries %d, len %d, recycled %d", index.Entries, stats.Len, stats.Recycled))
+		}
+		ranges := uint32(0)
+		for _, n := range index.FillHistogram {
+			ranges += n
+		}
+		if ranges != index.Ranges || index.Ranges != config.IndexTableRows {
+			t.Fatal(fmt.Sprintf("Error: histogram counts %d of %d ranges", ranges, index.Ranges))
+		}
+		if index.MinTableSize > index.MaxTableSize || index.AvgTableSize < float64(index.MinTableSize) || index.AvgTableSize > float64(index.MaxTableSize) {
+			t.Fatal(fmt.Sprintf("Error: wrong table size min %d, max %d, avg %f", index.MinTableSize, index.MaxTableSize, index.AvgTableSize))
+		}
+		if (index.OverflowPuts == 0) != (index.RangeFullSeconds == -1) {
+			t.Fatal(fmt.Sprintf("Error: wrong projection %d with %d overflow puts", index.RangeFullSeconds, index.OverflowPuts))
+		}
+		return stats
+	}
+
+	stats := checkStats(ytfs)
+	if stats.Index.PutCount != dataCaps || stats.Index.GetCount < 10 || stats.Index.DelCount != 1 {
+		t.Fatal(fmt.Sprintf("Error: wrong op counters %+v", stats.Index))
+	}
+	buf, err := json.Marshal(stats)
+	if err != nil || !bytes.Contains(buf, []byte(`"fillHistogram":[`)) {
+		t.Fatal(fmt.Sprintf("Error: %v, stats json %s", err, buf))
+	}
+	ytfs.Close()
+
+	// table sizes are read from disk after reopen.
+	ytfs, err = Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ytfs.Close()
+	stats = checkStats(ytfs)
+	if stats.Index.PutCount != 0 {
+		t.Fatal(fmt.Sprintf("Error: op counters are not reset %+v", stats.Index))
+	}
+}
+
+func TestYTFSCheck(t *testing.T) {
+	rootDir, err := ioutil.TempDir("/tmp", "ytfsTest")
+	config := opt.DefaultOptions()
+	defer removeStorages(config)
+	defer os.RemoveAll(rootDir)
+
+	ytfs, err := Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []types.IndexTableKey{}
+	for i := 0; i < 20; i++ {
+		key := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", i)))
+		err := ytfs.Put(key, makeData(10))
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Error: %v in %d insert", err, i))
+		}
+		keys = append(keys, key)
+	}
+	err = ytfs.Delete(keys[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ytfs.Close()
+
+	report, err := Check(rootDir, config, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || len(report.Problems) != 0 || report.Entries != 19 || report.Recycled != 1 || report.UsedSlots+report.Recycled != report.DataEndPoint {
+		t.Fatal(fmt.Sprintf("Error: wrong report of clean YTFS %+v", report))
+	}
+
+	// a value beyond data end point, and a used slot in recycle list.
+	ytfs, err = Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexFile := ytfs.db.indexFile
+	used, err := indexFile.Get(keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	recycled, err := indexFile.RecycledSlots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataEnd := indexFile.MetaData().DataEndPoint
+	err = indexFile.ReplaceRecycled(append(recycled, used))
+	if err == nil {
+		invalid := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", 100)))
+		err = indexFile.Put(invalid, types.IndexTableValue(dataEnd+5))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	ytfs.Close()
+
+	// Put moves data end point beyond the value, move it back.
+	file, err := os.OpenFile(path.Join(rootDir, "index.db"), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, dataEnd)
+	_, err = file.WriteAt(buf, int64(unsafe.Offsetof(types.Header{}.DataEndPoint)))
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = Check(rootDir, config, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK() || len(report.Problems) != 2 {
+		t.Fatal(fmt.Sprintf("Error: wrong report of corrupted YTFS %+v", report))
+	}
+	buf, err = json.Marshal(report)
+	if err != nil || !bytes.Contains(buf, []byte(`"kind":"invalidValue"`)) || !bytes.Contains(buf, []byte(`"kind":"recycled"`)) {
+		t.Fatal(fmt.Sprintf("Error: %v, report json %s", err, buf))
+	}
+
+	report, err = Check(rootDir, config, true)
+	if err != nil || !report.OK() || len(report.Problems) != 2 {
+		t.Fatal(fmt.Sprintf("Error: %v, problems are not fixed %+v", err, report))
+	}
+	report, err = Check(rootDir, config, false)
+	if err != nil || len(report.Problems) != 0 || report.Entries != 19 || report.Recycled != 1 {
+		t.Fatal(fmt.Sprintf("Error: %v, problems are left after repair %+v", err, report))
+	}
+
+	ytfs, err = Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ytfs.Close()
+	for i, key := range keys {
+		_, err := ytfs.Get(key)
+		if (i == 3) != (err == errors.ErrDataNotFound) {
+			t.Fatal(fmt.Sprintf("Error: %v in %d get", err, i))
+		}
+	}
+}
+
+func TestYTFSCheckRepairLostHeader(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "ytfsTest")
+	defer os.RemoveAll(rootDir)
+	config := opt.DefaultOptions()
+	defer removeStorages(config)
+
+	ytfs, err := Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []types.IndexTableKey{}
+	for i := 0; i < 10; i++ {
+		key := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", i)))
+		err := ytfs.Put(key, makeData(10))
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Error: %v in %d insert", err, i))
+		}
+		keys = append(keys, key)
+	}
+	ytfs.Close()
+
+	indexPath := path.Join(rootDir, "index.db")
+	file, err := os.OpenFile(indexPath, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.WriteAt([]byte("XXXX"), 0)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the index is not formatted, so rows are not dropped.
+	report, err := Check(rootDir, config, true)
+	if err != nil || report.OK() || len(report.Problems) != 1 || report.Problems[0].Kind != ProblemIndex {
+		t.Fatal(fmt.Sprintf("Error: %v, wrong report of lost header %+v", err, report))
+	}
+
+	file, err = os.OpenFile(indexPath, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.WriteAt([]byte("YTFS"), 0)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ytfs, err = Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ytfs.Close()
+	for i, key := range keys {
+		if _, err := ytfs.Get(key); err != nil {
+			t.Fatal(fmt.Sprintf("Error: %v in %d get", err, i))
+		}
+	}
+}
+
+func TestYTFSInMemory(t *testing.T) {
+	// home is never created for a YTFS in memory.
+	rootDir := path.Join(os.TempDir(), fmt.Sprintf("ytfsMemory%d", time.Now().UnixNano()))
+	config := opt.MemoryOptions()
+	ytfs, err := Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[types.IndexTableKey][]byte{}
+	for i := 0; i < 20; i++ {
+		testHash := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", i)))
+		values[testHash] = makeData(10)
+		err := ytfs.Put(testHash, values[testHash])
+		if err != nil {
+			t.Fatal(fmt.Sprintf("Error: %v in %d insert", err, i))
+		}
+	}
+	err = ytfs.ResizeIndex(config.IndexTableRows*2, config.TotalVolumn*2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ytfs.Close()
+
+	if _, err = os.Stat(rootDir); !os.IsNotExist(err) {
+		t.Fatal(fmt.Sprintf("Error: home of YTFS in memory is created, %v", err))
+	}
+	if err = RebuildIndex(rootDir, config); err != ErrIndexInMemory {
+		t.Fatal(fmt.Sprintf("Error: expected ErrIndexInMemory but get %v", err))
+	}
+
+	// storages and index are kept by the process after close, config is
+	// updated by resize.
+	ytfs, err = Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ytfs.Close()
+	for key, value := range values {
+		buf, err := ytfs.Get(key)
+		if err != nil || !bytes.Equal(buf, value) {
+			t.Fatal(fmt.Sprintf("Error: get %x after reopen, %v", key, err))
+		}
+	}
+}
+
+func TestYTFSIndexBackend(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "ytfsTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	// index is kept by a backend of its own, storages are in memory.
+	opened := []opt.StorageOptions{}
+	storage.Register("test-index", func(config *opt.StorageOptions) (storage.Storage, error) {
+		opened = append(opened, *config)
+		return storage.OpenMemoryStorage(config)
+	})
+	config := opt.MemoryOptions()
+	config.IndexBackend = "test-index"
+	config.IndexBackendOptions = json.RawMessage(`{"limit": 10}`)
+	defer storage.DeleteMemoryStorage(path.Join(rootDir, "index.db"))
+
+	ytfs, err := Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testHash := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", 1)))
+	value := makeData(10)
+	err = ytfs.Put(testHash, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ytfs.Close()
+
+	ytfs, err = Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ytfs.Close()
+	if buf, err := ytfs.Get(testHash); err != nil || !bytes.Equal(buf, value) {
+		t.Fatal(fmt.Sprintf("Error: get after reopen, %v", err))
+	}
+	if len(opened) != 2 || opened[0].StorageName != path.Join(rootDir, "index.db") || string(opened[0].BackendOptions) != `{"limit": 10}` {
+		t.Fatal(fmt.Sprintf("Error: index is not opened by its backend, %+v", opened))
+	}
+}
+
+// failingIndexReads is the number of next reads of index opened by
+// "test-failing-index" backend which fail.
+var failingIndexReads int32
+
+type failingReader struct {
+	storage.Reader
+}
+
+func (r failingReader) ReadAt(p []byte, off int64) (int, error) {
+	if atomic.AddInt32(&failingIndexReads, -1) >= 0 {
+		return 0, errInjected
+	}
+	atomic.StoreInt32(&failingIndexReads, 0)
+	return r.Reader.ReadAt(p, off)
+}
+
+type failingStorage struct {
+	storage.Storage
+}
+
+func (s failingStorage) Reader() (storage.Reader, error) {
+	reader, err := s.Storage.Reader()
+	return failingReader{reader}, err
+}
+
+var errInjected = errors.New("injected fault")
+
+func init() {
+	storage.Register("test-failing-index", func(config *opt.StorageOptions) (storage.Storage, error) {
+		store, err := storage.OpenMemoryStorage(config)
+		if err != nil {
+			return nil, err
+		}
+		return failingStorage{store}, nil
+	})
+}
+
+func TestYTFSPutOnIndexReadError(t *testing.T) {
+	config := opt.MemoryOptions()
+	config.IndexBackend = "test-failing-index"
+	config.IndexCacheSize = 0
+	rootDir := path.Join(os.TempDir(), fmt.Sprintf("ytfsFailing%d", time.Now().UnixNano()))
+	defer os.RemoveAll(rootDir)
+	defer storage.DeleteMemoryStorage(path.Join(rootDir, "index.db"))
+
+	ytfs, err := Open(rootDir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ytfs.Close()
+	testHash := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", 1)))
+	err = ytfs.Put(testHash, makeData(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// lookup of the key fails, it may exist, so it is not written again.
+	atomic.StoreInt32(&failingIndexReads, 1)
+	err = ytfs.Put(testHash, makeData(10))
+	if err != errInjected {
+		t.Fatal(fmt.Sprintf("Error: expected injected fault but get %v", err))
+	}
+	if ytfs.Len() != 1 {
+		t.Fatal(fmt.Sprintf("Error: expected len 1 but get %d", ytfs.Len()))
+	}
+}
+
+func TestContextLocateWideStorages(t *testing.T) {
+	c := &Context{storages: []*storageContext{{Cap: 1 << 33}, {Cap: 1 << 33}}}
+
+	sp, err := c.locate(1<<32 + 7)
+	if err != nil || sp.dev != 0 || sp.posIdx != 1<<32+7 {
+		t.Fatalf("locate(1<<32 + 7) = %+v, %v", sp, err)
+	}
+	sp, err = c.locate(1<<33 + 5)
+	if err != nil || sp.dev != 1 || sp.posIdx != 5 {
+		t.Fatalf("locate(1<<33 + 5) = %+v, %v", sp, err)
+	}
+
+	c.sp = &storagePointer{0, 1<<33 - 1, 1<<33 - 1}
+	if err = c.forward(); err != nil || c.sp.dev != 1 || c.sp.posIdx != 0 || c.sp.index != 1<<33 {
+		t.Fatalf("forward() = %+v, %v", c.sp, err)
+	}
+}
+
+func TestYTFSSeqAfterReopen(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "ytfsTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	config := opt.DefaultOptions()
+	defer removeStorages(config)
+
+	maxSeq := func(ytfs *YTFS) uint64 {
+		seq := uint64(0)
+		err := ytfs.context.scanBlockRecords(func(index uint64, record storage.BlockRecord) error {
+			if record.Seq > seq {
+				seq = record.Seq
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return seq
+	}
+	put := func(i int) uint64 {
+		ytfs, err := Open(rootDir, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ytfs.Close()
+		last := maxSeq(ytfs)
+		testKey := (types.IndexTableKey)(types.HexToHash(fmt.Sprintf("%032X", i)))
+		if err = ytfs.Put(testKey, makeData(10)); err != nil {
+			t.Fatal(err)
+		}
+		seq := maxSeq(ytfs)
+		if seq <= last {
+			t.Fatalf("seq of put %d is %d, not after %d", i, seq, last)
+		}
+		for _, s := range ytfs.context.storages {
+			if saved, ok := s.Disk.Seq(); !ok || saved < seq {
+				t.Fatalf("saved seq %d, %v is behind %d", saved, ok, seq)
+			}
+		}
+		return seq
+	}
+
+	// seq goes on after the last run, whatever the clock says.
+	first := put(0)
+	if second := put(1); second <= first {
+		t.Fatalf("seq %d after reopen is not after %d", second, first)
+	}
+
+	// storage of version 0.3 saves block keys but not seq, it is read for
+	// the highest seq on open.
+	for _, storageOpt := range config.Storages {
+		file, err := os.OpenFile(storageOpt.StorageName, os.O_RDWR, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = file.WriteAt([]byte{0x0, '.', 0x0, 0x3}, int64(unsafe.Offsetof(types.StorageHeader{}.Version)))
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(2)
+}